@@ -0,0 +1,89 @@
+package assembler
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AsmError 汇编时的错误，Line和Column从1开始，为0表示不确定
+type AsmError struct {
+	File    string // .include进来的asm文件，ParseAsmContent传入的内容中为空
+	Line    int
+	Column  int
+	Name    string // 出错的伪指令(如.func)或指令名，const/upvalue/local段中的行为空
+	Message string
+}
+
+func newAsmError(column int, name string, message string) *AsmError {
+	return &AsmError{Column: column, Name: name, Message: message}
+}
+
+func (e *AsmError) Error() string {
+	var result string
+	if len(e.File) > 0 {
+		result = e.File + ":"
+		if e.Line < 1 {
+			result += " "
+		}
+	}
+	if e.Line > 0 {
+		result += "L:" + strconv.Itoa(e.Line)
+		if e.Column > 0 {
+			result += ":" + strconv.Itoa(e.Column)
+		}
+		result += ": "
+	}
+	if len(e.Name) > 0 {
+		result += e.Name + ": "
+	}
+	return result + e.Message
+}
+
+// AsmErrors 一次汇编中收集到的所有错误
+type AsmErrors []*AsmError
+
+func (errs AsmErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// 按文件、行号、列号排序，相同位置的错误保持收集时的顺序
+func (errs AsmErrors) sort() {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i], errs[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// 把err展开成AsmError列表，没有行号的错误使用line作为行号
+func asmErrorsOf(err error, line int) (result AsmErrors) {
+	switch e := err.(type) {
+	case AsmErrors:
+		result = append(result, e...)
+	case *AsmError:
+		result = append(result, e)
+	default:
+		result = append(result, &AsmError{Message: err.Error()})
+	}
+	for _, asmErr := range result {
+		if asmErr.Line == 0 {
+			asmErr.Line = line
+		}
+	}
+	return
+}
+
+// 行中第一个非空白字符所在的列
+func lineColumn(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t")) + 1
+}
@@ -0,0 +1,69 @@
+package assembler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAsmContentCollectsErrors(t *testing.T) {
+	asm := strings.Join([]string{
+		".upvalues 1",
+		".func main 2 0 0",
+		".begin_code",
+		"  badop %0 %1",
+		"  move %0 %x",
+		"  jmp 0 $missing",
+		"return %0 1",
+		".end_code",
+		".foo",
+	}, "\n")
+	_, err := NewAssembler().ParseAsmContent(asm)
+	errs, ok := err.(AsmErrors)
+	if !ok {
+		t.Fatalf("expect AsmErrors but got %v", err)
+	}
+	expected := []AsmError{
+		{Line: 4, Column: 3, Name: "badop"},
+		{Line: 5, Column: 11, Name: "move"},
+		{Line: 6, Column: 0, Name: ""},
+		{Line: 9, Column: 1, Name: ".foo"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expect %d errors but got:\n%s", len(expected), errs.Error())
+	}
+	for i, e := range expected {
+		if errs[i].Line != e.Line || errs[i].Column != e.Column || errs[i].Name != e.Name {
+			t.Errorf("error %d: expect L:%d:%d %s but got %s", i, e.Line, e.Column, e.Name, errs[i].Error())
+		}
+	}
+	if !strings.Contains(errs[2].Message, "missing") {
+		t.Errorf("expect undeclared location error but got %s", errs[2].Error())
+	}
+}
+
+func TestParseAsmContentNumericConstantOperand(t *testing.T) {
+	asm := strings.Join([]string{
+		".upvalues 1",
+		".func main 2 0 0",
+		".begin_const",
+		"\t2",
+		"\t3",
+		".end_const",
+		".begin_code",
+		"idiv %0 const 3 const 2",
+		"return %0 2",
+		"return %0 1",
+		".end_code",
+	}, "\n")
+	bytecode, err := NewAssembler().ParseAsmContent(asm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asmStr, err := NewDisassembler().DisassembleBytecode(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.ToLower(asmStr), "idiv %0 const 3 const 2") {
+		t.Errorf("numeric constant operand lost:\n%s", asmStr)
+	}
+}
@@ -10,8 +10,7 @@ import (
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"math"
+	"io/ioutil"
 	"unicode"
 )
 
@@ -187,6 +186,10 @@ type ParsedFunction struct {
 	lastlinedefined   uint
 	//add locals
 	locals []LocVar
+	// 子函数，直接从Prototype生成时使用。从asm解析时为空，写字节码时按usedSubroutines查找
+	protos []*ParsedFunction
+	// 每条指令所在的asm行号，用于报告错误
+	instructionLines []int
 }
 
 // ParseStates
@@ -223,14 +226,17 @@ type Assembler struct {
 
 	lineinfos []int
 
+	lineNumber       int   // 正在解析的asm行号
+	instructionLines []int // 当前函数每条指令所在的asm行号
+
 	fMaxstacksize, fParams, fVararg uint
 	constants                       []*TValue
 
 	wBuffer *bytes.Buffer
 }
 
-func (assembler *Assembler) Assemble() (bool, string) {
-	return true, ""
+func (assembler *Assembler) Assemble() error {
+	return nil
 }
 
 type AsmValue struct {
@@ -295,10 +301,12 @@ func (assembler *Assembler) getLinenumberFromAsmLineComment(lineComment string)
 	return lineNumber
 }
 
-func (assembler *Assembler) finalizeFunction() (bool, string) {
-	if len(assembler.neededLocations) > 0 {
-		return false, fmt.Sprintf("undeclared locations: %v", assembler.neededLocations)
+func (assembler *Assembler) finalizeFunction() error {
+	var errs AsmErrors
+	for _, location := range assembler.neededLocations {
+		errs = append(errs, &AsmError{Line: assembler.instructionLine(location.right), Message: "undeclared location " + location.left})
 	}
+	assembler.neededLocations = assembler.neededLocations[:0]
 	fn := new(ParsedFunction)
 	fn.name = assembler.funcname
 	fn.instructions = make([]Instruction, len(assembler.instructions))
@@ -328,11 +336,34 @@ func (assembler *Assembler) finalizeFunction() (bool, string) {
 	fn.lineinfos = make([]int, len(assembler.lineinfos))
 	copy(fn.lineinfos, assembler.lineinfos)
 	assembler.lineinfos = assembler.lineinfos[:0]
+	fn.instructionLines = make([]int, len(assembler.instructionLines))
+	copy(fn.instructionLines, assembler.instructionLines)
+	assembler.instructionLines = assembler.instructionLines[:0]
 	assembler.functions[fn.name] = fn
 
 	assembler.locations = make(map[string]int)
-	//assembler.neededLocations = assembler.neededLocations[:0]
-	return true, ""
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// 当前函数第idx条指令所在的asm行号
+func (assembler *Assembler) instructionLine(idx int) int {
+	if idx < len(assembler.instructionLines) {
+		return assembler.instructionLines[idx]
+	}
+	return 0
+}
+
+// 引用子函数name的第一条指令所在的asm行号，直接从Prototype生成时为0
+func (fn *ParsedFunction) subroutineLine(name string) int {
+	for _, p := range fn.neededSubroutines {
+		if p.left == name && p.right < len(fn.instructionLines) {
+			return fn.instructionLines[p.right]
+		}
+	}
+	return 0
 }
 
 // extract symbol from line
@@ -421,25 +452,25 @@ func ParseStr(line string, start int, end int) (bool, int, string) {
 }
 
 //end
-func CheckName(name string) (bool, string) {
+func CheckName(name string) error {
 	if len(name) <= 0 {
-		return false, "invalid name:" + name
+		return errors.New("invalid name:" + name)
 	}
 	if !IsSymbolStartChar(rune(name[0])) {
-		return false, "invalid name:" + name
+		return errors.New("invalid name:" + name)
 	}
 
 	cpos := strings.IndexFunc(name[0:len(name)], func(c rune) bool {
 		return unicode.IsSpace(c) || !(unicode.IsDigit(c) || unicode.IsLetter(c) || c == '_')
 	})
 	if cpos < 0 {
-		return true, ""
+		return nil
 	} else {
-		return false, "invalid name:" + name
+		return errors.New("invalid name:" + name)
 	}
 }
 
-func (assembler *Assembler) parseDirective(line string, lineLen int) (bool, string) {
+func (assembler *Assembler) parseDirective(line string, lineLen int) error {
 	var nameEnd = len(line)
 	var cmdEnd = len(line)
 	for i := 1; i < len(line); i++ {
@@ -450,7 +481,7 @@ func (assembler *Assembler) parseDirective(line string, lineLen int) (bool, stri
 				nameEnd = i
 				break
 			}
-			return false, "could not parse directive: illegal character '" + string(iChar) + "'"
+			return newAsmError(i+1, "", "could not parse directive: illegal character '"+string(iChar)+"'")
 		}
 	}
 	for i := 0; i < len(line); i++ {
@@ -463,123 +494,159 @@ func (assembler *Assembler) parseDirective(line string, lineLen int) (bool, stri
 	name := strings.ToLower(strings.Trim(line[1:nameEnd], " \t")) // ignore first because directive starts with '.'
 	lineWithoutComment := strings.Trim(line[0:cmdEnd], " \t")
 	if len(name) < 1 {
-		return false, "could not parse directive " + line
+		return newAsmError(1, "", "could not parse directive "+line)
 	}
+	directive := "." + name
 	argsAfterDirectiveName := strings.Trim(lineWithoutComment[len(name)+1:], " \t") // +1 when starts with '.'
 	// var curPosOfArgs = 0 // which pos when parsing to argsAfterDirectiveName
 	// lineComment := assembler.getLineCommentFromAsmLineCode(line, lineLen)
 	// lineNumber := assembler.getLinenumberFromAsmLineComment(lineComment)
 	if name == "upvalues" {
 		if assembler.bUpvalues {
-			return false, "already declared amount of upvalues"
+			return newAsmError(1, directive, "already declared amount of upvalues")
 		}
 		var argErr error
 		assembler.nUpvalues, argErr = strconv.Atoi(argsAfterDirectiveName)
 		if argErr != nil {
-			return false, "invalid args for directive .upvalues"
+			return newAsmError(1, directive, "invalid args for directive .upvalues")
 		}
 		assembler.bUpvalues = true
 	} else if name == "func" {
 		if assembler.parseStatus != PARSE_FUNC && assembler.parseStatus != PARSE_NONE {
-			return false, "func declaration cannot be inside a code or const segment"
+			return newAsmError(1, directive, "func declaration cannot be inside a code or const segment")
 		}
+		var errs AsmErrors
 		// even empty func can finalize
-		finalizeFuncRes, err := assembler.finalizeFunction()
-		if !finalizeFuncRes {
-			return false, err
+		if finalizeErr := assembler.finalizeFunction(); finalizeErr != nil {
+			errs = append(errs, asmErrorsOf(finalizeErr, 0)...)
 		}
-		parseRes, _, funcname := ParseLabel(argsAfterDirectiveName, 0, len(argsAfterDirectiveName))
-		if !parseRes {
-			return false, "parse funcname error"
-		}
-		assembler.funcname = strings.Trim(funcname, " ")
-		argsAfterDirectiveName = strings.Trim(argsAfterDirectiveName[len(funcname):], " ")
-
-		parseRes, maxStacksizeLend, maxStacksize := ParseInt(argsAfterDirectiveName, 0, len(argsAfterDirectiveName))
-		if !parseRes {
-			return false, "parse maxstacksize int error"
-		}
-		assembler.fMaxstacksize = uint(maxStacksize)
-		argsAfterDirectiveName = strings.Trim(argsAfterDirectiveName[maxStacksizeLend:], " ")
-
-		parseRes, lend, params := ParseInt(argsAfterDirectiveName, 0, len(argsAfterDirectiveName))
-		if !parseRes {
-			return false, "parse params int error"
-		}
-		assembler.fParams = uint(params)
-		argsAfterDirectiveName = strings.Trim(argsAfterDirectiveName[lend:], " ")
-
-		parseRes, lend, vararg := ParseInt(argsAfterDirectiveName, 0, len(argsAfterDirectiveName))
-		if !parseRes {
-			return false, "parse vararg int error"
-		}
-		assembler.fVararg = uint(vararg)
-		argsAfterDirectiveName = strings.Trim(argsAfterDirectiveName[lend:], " ")
+		// 参数有错时也进入新函数，避免后面的行都报错
 		assembler.funcid++
 		assembler.parseStatus = PARSE_FUNC
-		//fmt.Printf("func %s %d %d %d\n", funcname, maxStacksize, params, vararg)
+		if argsErr := assembler.parseFuncArgs(argsAfterDirectiveName); argsErr != nil {
+			errs = append(errs, newAsmError(1, directive, argsErr.Error()))
+		}
+		if len(errs) > 0 {
+			return errs
+		}
 	} else if name == "begin_const" {
 		if assembler.parseStatus != PARSE_FUNC {
-			return false, "const declaration must be inside function"
+			return newAsmError(1, directive, "const declaration must be inside function")
 		}
 		assembler.parseStatus = PARSE_CONST
 	} else if name == "end_const" {
 		if assembler.parseStatus != PARSE_CONST {
-			return false, "end_const must be inside const segment"
+			return newAsmError(1, directive, "end_const must be inside const segment")
 		}
 		assembler.parseStatus = PARSE_FUNC
 	} else if name == "begin_code" {
 		if assembler.parseStatus != PARSE_FUNC {
-			return false, "code declaration must be inside function"
+			return newAsmError(1, directive, "code declaration must be inside function")
 		}
 		assembler.parseStatus = PARSE_CODE
 	} else if name == "end_code" {
 		if assembler.parseStatus != PARSE_CODE {
-			return false, "end_code must be inside code segment"
+			return newAsmError(1, directive, "end_code must be inside code segment")
 		}
 		assembler.parseStatus = PARSE_FUNC
 	} else if name == "begin_upvalue" {
 		if assembler.parseStatus != PARSE_FUNC {
-			return false, "upvalue declaration must be inside function"
+			return newAsmError(1, directive, "upvalue declaration must be inside function")
 		}
 		assembler.parseStatus = PARSE_UPVALUE
 	} else if name == "end_upvalue" {
 		if assembler.parseStatus != PARSE_UPVALUE {
-			return false, "end_upvalue must be inside upvalue segment"
+			return newAsmError(1, directive, "end_upvalue must be inside upvalue segment")
 		}
 		assembler.parseStatus = PARSE_FUNC
 		//add local>>>>>>>>>>>>>>>>
 	} else if name == "begin_local" {
 		if assembler.parseStatus != PARSE_FUNC {
-			return false, "local declaration must be inside function"
+			return newAsmError(1, directive, "local declaration must be inside function")
 		}
 		assembler.parseStatus = PARSE_LOCAL
 	} else if name == "end_local" {
 		if assembler.parseStatus != PARSE_LOCAL {
-			return false, "end_local must be inside local segment"
+			return newAsmError(1, directive, "end_local must be inside local segment")
 		}
 		assembler.parseStatus = PARSE_FUNC
 		//add local end <<<<<<<<<<<<<<<<<<<
+	} else if name == "include" || name == "define" || name == "macro" || name == "end_macro" {
+		// 由ParseAsmContent在解析前展开
+		return newAsmError(1, directive, "directive "+directive+" must be expanded before parsing")
 	} else {
-		return false, "Unsupported directive name " + name
+		return newAsmError(1, directive, "Unsupported directive name "+name)
+	}
+	return nil
+}
+
+// 解析.func的参数: funcname maxstacksize params vararg
+func (assembler *Assembler) parseFuncArgs(args string) error {
+	parseRes, _, funcname := ParseLabel(args, 0, len(args))
+	if !parseRes {
+		return errors.New("parse funcname error")
+	}
+	assembler.funcname = strings.Trim(funcname, " ")
+	args = strings.Trim(args[len(funcname):], " ")
+
+	parseRes, maxStacksizeLend, maxStacksize := ParseInt(args, 0, len(args))
+	if !parseRes {
+		return errors.New("parse maxstacksize int error")
+	}
+	assembler.fMaxstacksize = uint(maxStacksize)
+	args = strings.Trim(args[maxStacksizeLend:], " ")
+
+	parseRes, lend, params := ParseInt(args, 0, len(args))
+	if !parseRes {
+		return errors.New("parse params int error")
+	}
+	assembler.fParams = uint(params)
+	args = strings.Trim(args[lend:], " ")
+
+	parseRes, lend, vararg := ParseInt(args, 0, len(args))
+	if !parseRes {
+		return errors.New("parse vararg int error")
 	}
-	return true, ""
+	assembler.fVararg = uint(vararg)
+	//fmt.Printf("func %s %d %d %d\n", funcname, maxStacksize, params, vararg)
+	return nil
 }
 
 //parse const string
-func (assembler *Assembler) parseString(line string,hasComment bool) (bool, int, string) {
+func (assembler *Assembler) parseString(line string, hasComment bool) (result string, end int, err error) {
 	buf := bytes.NewBuffer([]byte{})
 	current := 1
-	end := len(line)-1
-	c := line[0]
+	lastPos := len(line) - 1
 	success := false
-	if line[0] == '"' && end >=1 {
-		for current<=end{
-			c = line[current]
-			if(c == '\\'){
+	if len(line) > 0 && line[0] == '"' && lastPos >= 1 {
+		for current <= lastPos {
+			c := line[current]
+			if c == '\\' {
 				current++
+				if current > lastPos {
+					break
+				}
 				c = line[current]
-			}else if(c == '"'){
+				// \n、\r、\t和\xHH转义，其他字符原样
+				switch c {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				case 'x':
+					if current+2 > lastPos {
+						return "", len(line), errors.New("invalid escape in constant string value " + line)
+					}
+					hex, hexErr := strconv.ParseUint(line[current+1:current+3], 16, 8)
+					if hexErr != nil {
+						return "", len(line), errors.New("invalid escape in constant string value " + line)
+					}
+					c = byte(hex)
+					current += 2
+				}
+			} else if c == '"' {
 				success = true
 				break
 			}
@@ -587,84 +654,82 @@ func (assembler *Assembler) parseString(line string,hasComment bool) (bool, int,
 			current++
 		}
 
-		if(success){
-			result := string(buf.Bytes())
-			remainStr := line[(current+1):]
+		if success {
+			result = string(buf.Bytes())
+			remainStr := line[(current + 1):]
 			Trim(remainStr)
-			if(len(remainStr)>0) && (remainStr[0]==';'){
-				return true, len(line), result
+			if (len(remainStr) > 0) && (remainStr[0] == ';') {
+				return result, len(line), nil
 			}
-			return true, len(result)+2, result
+			return result, current + 1, nil
 		}
 
 	}
-	return false, len(line), "truncated constant string value " + line
-
+	return "", len(line), errors.New("truncated constant string value " + line)
 }
 
-func (assembler *Assembler) parseConstant(line string, lineLen int, id *int) (bool, int, string) {
+func (assembler *Assembler) parseConstant(line string, lineLen int, id *int) (end int, err error) {
 	var tval TValue
-	c := 0
 	// lineComment := assembler.getLineCommentFromAsmLineCode(line, lineLen)
 	// lineNumber := assembler.getLinenumberFromAsmLineComment(lineComment)
 	line = Trim(line)
+	if len(line) < 1 {
+		return 0, errors.New("missing constant value")
+	}
 
-	cf := strings.ToLower(line[c : c+1])[0]
+	cf := strings.ToLower(line[0:1])[0]
 	cfStr := string(cf)
-	if cfStr != "\"" {  // /////
+	if cfStr != "\"" { // /////
 		if strings.Index(line, ";") >= 0 {
 			line = line[:strings.Index(line, ";")]
 		}
 	}
-	lineBytes := []byte(line)
 	bend := StringFirstIndexOf(line, func(c byte) bool {
 		return IsEmptyChar(c)
 	}) // read constant value string end index
-	// TODO: read next value or using tokenizer to parse line tokens
+	token := line[:bend]
 	if cfStr == "\"" { // parse string
-		ok,end,result := assembler.parseString(line,true)
-		if(!ok){
-			return false, bend, result
+		result, strEnd, strErr := assembler.parseString(line, true)
+		if strErr != nil {
+			return bend, strErr
 		}
-		bend = end
+		bend = strEnd
 		tstr := new(TString)
 		tstr.string_value = result
 		tval = tstr
 	} else if cfStr == "+" || cfStr == "-" || cfStr == "." || unicode.IsDigit(rune(cf)) {
-		if strings.Index(line, ".") >= 0 {
-			// parse float
+		if strings.ContainsAny(token, ".eE") {
+			// parse float，带小数点或指数的数字总是浮点数，如2.0
 			var fltVal float64
-			json.Unmarshal(lineBytes, &fltVal)
-			if math.Abs(fltVal-math.Trunc(fltVal)) > 0.000001 {
-				tnum := new(TNumber)
-				tnum.number_value = fltVal
-				tval = tnum
-			} else {
-				tnum := new(TInteger)
-				tnum.int_value = int64(fltVal)
-				tval = tnum
+			if jsonErr := json.Unmarshal([]byte(token), &fltVal); jsonErr != nil {
+				return bend, errors.New("invalid float constant value " + token)
 			}
+			tnum := new(TNumber)
+			tnum.number_value = fltVal
+			tval = tnum
 		} else {
 			// parse int
 			var intVal int64
-			json.Unmarshal(lineBytes, &intVal)
+			if jsonErr := json.Unmarshal([]byte(token), &intVal); jsonErr != nil {
+				return bend, errors.New("invalid integer constant value " + token)
+			}
 			tnum := new(TInteger)
 			tnum.int_value = int64(intVal)
 			tval = tnum
 		}
-	} else if line == "true" {
+	} else if token == "true" {
 		tbool := new(TBool)
 		tbool.bool_value = true
 		tval = tbool
-	} else if line == "false" {
+	} else if token == "false" {
 		tbool := new(TBool)
 		tbool.bool_value = false
 		tval = tbool
-	} else if line == "nil" {
+	} else if token == "nil" {
 		tnilval := new(TNil)
 		tval = tnilval
 	} else {
-		return false, bend, "unexpected constant value " + line
+		return bend, errors.New("unexpected constant value " + line)
 	}
 	found := false
 	for i := 0; i < len(assembler.constants); i++ {
@@ -683,7 +748,7 @@ func (assembler *Assembler) parseConstant(line string, lineLen int, id *int) (bo
 			*id = len(assembler.constants) - 1
 		}
 	}
-	return true, bend, ""
+	return bend, nil
 }
 
 type OpCode uint8
@@ -821,46 +886,46 @@ const ParseOperandDefaultLimit = 0xFFFFFFFF
 /**
 @return success, end, value
 */
-func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit int) (bool, int, string) {
+func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit int) (end int, err error) {
 	cpos := strings.IndexFunc(line, func(c rune) bool {
 		return !unicode.IsSpace(c)
 	})
 	if cpos < 0 {
-		return false, 0, "empty line"
+		return 0, errors.New("empty line")
 	}
 	switch line[cpos] {
 	case '%': // stack index
 		if (limit&parser.LIMIT_STACKIDX) == 0 || cpos >= len(line) {
-			return false, 0, "error stack index in " + line
+			return 0, errors.New("error stack index in " + line)
 		}
 		cpos++
 		parseRes, lend, val := ParseInt(line, cpos, len(line))
 		if !parseRes {
-			return false, cpos, "parse stack index error " + line
+			return cpos, errors.New("parse stack index error " + line)
 		}
 		operand.opType = STACKIDX
 		operand.value = val
-		return true, lend, ""
+		return lend, nil
 	case '@': // upvalue index.
 		if (limit&parser.LIMIT_UPVALUE) == 0 || cpos >= len(line) {
-			return false, 0, "error upvalue index in " + line
+			return 0, errors.New("error upvalue index in " + line)
 		}
 		cpos++
 		parseRes, lend, val := ParseInt(line[cpos:], 0, len(line[cpos:]))
 		if !parseRes {
-			return false, cpos, "parse upvalue index error " + line
+			return cpos, errors.New("parse upvalue index error " + line)
 		}
 		operand.opType = UPVALUE
 		operand.value = val
-		return true, cpos + lend, ""
+		return cpos + lend, nil
 	case '$': // jmp location
 		if (limit&parser.LIMIT_LOCATION) == 0 || cpos >= len(line) {
-			return false, 0, "error location in " + line
+			return 0, errors.New("error location in " + line)
 		}
 		cpos++
 		parseRes, lend, label := ParseLabel(line[cpos:], 0, len(line[cpos:]))
 		if !parseRes {
-			return false, cpos, "parse location error " + line
+			return cpos, errors.New("parse location error " + line)
 		}
 		operand.opType = LOCATION
 		if it, ok := assembler.locations[label]; ok {
@@ -872,7 +937,7 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 			pair.right = len(assembler.instructions)
 			assembler.neededLocations = append(assembler.neededLocations, pair)
 		}
-		return true, cpos + lend, ""
+		return cpos + lend, nil
 	default:
 		if line[cpos] == 'c' { // could be const
 			firstNotAlpha := strings.IndexFunc(line[cpos:], func(c rune) bool {
@@ -880,7 +945,7 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 			})
 			if firstNotAlpha >= 0 && strings.Index(line[cpos:], "const") == 0 {
 				if (limit & parser.LIMIT_CONSTANT) == 0 {
-					return false, 0, "error constant in " + line
+					return 0, errors.New("error constant in " + line)
 				}
 				remainingLine := line[firstNotAlpha:]
 				bendOfConstant := StringFirstIndexOfNot(remainingLine, func(c byte) bool {
@@ -895,9 +960,9 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 				// }
 				bend := bendOfConstant + firstNotAlpha
 				var id int
-				parseRes, bend2, _ := assembler.parseConstant(line[bend:], len(line[bend:]), &id)
-				if !parseRes {
-					return false, cpos, "parse constant error " + line
+				bend2, constErr := assembler.parseConstant(line[bend:], len(line[bend:]), &id)
+				if constErr != nil {
+					return cpos, errors.New("parse constant error " + constErr.Error())
 				}
 				bend += bend2
 				operand.opType = CONSTANT
@@ -906,18 +971,18 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 				} else {
 					operand.value = id
 				}
-				return true, bend, ""
+				return bend, nil
 			}
 		}
 
 		if (limit & parser.LIMIT_PROTO) != 0 {
 			parseRes, bend, label := ParseLabel(line[cpos:], 0, len(line[cpos:]))
 			if !parseRes {
-				return false, 0, "parse label error " + line
+				return 0, errors.New("parse label error " + line)
 			}
 			// FIXME
 			//if u, ok := assembler.usedSubroutines[label]; ok && u != assembler.funcid {
-			//	return false, 0, "used subproutine " + label
+			//	return 0, errors.New("used subproutine " + label)
 			//}
 			bend += cpos
 			_, subroutineFound := assembler.subroutines[label]
@@ -930,11 +995,11 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 				assembler.usedSubroutines[label] = assembler.funcid
 				assembler.fUsedSubroutines = append(assembler.fUsedSubroutines, label)
 			}
-			return true, bend, ""
+			return bend, nil
 		}
 
 		if (limit & (parser.LIMIT_EMBED | parser.LIMIT_CONSTANT)) == 0 {
-			return false, 0, "wrong limit " + string(limit)
+			return 0, errors.New("wrong limit " + strconv.Itoa(limit))
 		}
 		cf := strings.ToLower(string(line[cpos]))[0]
 		var val int
@@ -944,7 +1009,7 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 				return !unicode.IsLetter(c)
 			})
 			if bend < 0 {
-				return false, 0, "error parse in " + line
+				return 0, errors.New("error parse in " + line)
 			}
 			s := line[cpos:bend]
 			if s == "true" {
@@ -952,36 +1017,35 @@ func (assembler *Assembler) ParseOperand(operand *Operand, line string, limit in
 			} else if s == "false" {
 				val = 0
 			} else {
-				return false, cpos, "error parse bool value in " + line
+				return cpos, errors.New("error parse bool value in " + line)
 			}
 		} else {
 			parseRes, bendOfN, n := ParseInt(line[cpos:], 0, len(line[cpos:]))
 			if !parseRes {
-				return false, 0, "parse int error in " + line[cpos:]
+				return 0, errors.New("parse int error in " + line[cpos:])
 			}
 			bend = bendOfN
 			val = n
 		}
 		operand.opType = EMBEDDED
 		operand.value = val
-		return true, bend, ""
+		return bend, nil
 	}
-	return true, cpos, "not supported operand " + line
-	// return false, cpos, "not supported operand"
 }
 
-func (assembler *Assembler) parseCode(line string, lineLen int) (bool, string) {
+func (assembler *Assembler) parseCode(line string, lineLen int) error {
 	lineComment := assembler.getLineCommentFromAsmLineCode(line, lineLen)
 	lineNumber := assembler.getLinenumberFromAsmLineComment(lineComment)
 	if lineNumber >= 0 {
 		assembler.lineinfos = append(assembler.lineinfos, lineNumber)
 	}
+	lineStart := lineColumn(line) - 1
 	line = Trim(line)
 
 	remainingLine := line
 	parseRes, lend, opcodestr := ParseLabel(remainingLine, 0, len(remainingLine))
 	if !parseRes {
-		return false, "parse code opcode error " + line
+		return newAsmError(lineStart+1, "", "parse code opcode error "+line)
 	}
 	remainingLine = strings.Trim(remainingLine[lend:], " \t")
 
@@ -999,17 +1063,20 @@ func (assembler *Assembler) parseCode(line string, lineLen int) (bool, string) {
 				i++
 			}
 		}
-		return true, ""
+		return nil
 	}
 	opcodestr = strings.ToLower(opcodestr)
 
-	var opcode OpCode
+	opcode := OpCode(parser.NUM_OPCODES)
 	for i := 0; i < int(parser.NUM_OPCODES); i++ {
 		if IsSameStringIgnoreCase(opcodestr, parser.OpNames[i]) {
 			opcode = OpCode(i)
 			break
 		}
 	}
+	if opcode == OpCode(parser.NUM_OPCODES) {
+		return newAsmError(lineStart+1, opcodestr, "unknown opcode "+opcodestr)
+	}
 
 
 	var ins Instruction
@@ -1020,11 +1087,22 @@ func (assembler *Assembler) parseCode(line string, lineLen int) (bool, string) {
 	count := parser.Opcounts[opcode]
 	info := parser.Opinfos[opcode]
 
+	// 指令解析失败时撤销操作数中记录的跳转位置和子函数引用
+	neededLocationsLen := len(assembler.neededLocations)
+	neededSubroutinesLen := len(assembler.neededSubroutines)
+	usedSubroutinesLen := len(assembler.fUsedSubroutines)
+	operandError := func(message string) error {
+		assembler.neededLocations = assembler.neededLocations[:neededLocationsLen]
+		assembler.neededSubroutines = assembler.neededSubroutines[:neededSubroutinesLen]
+		assembler.fUsedSubroutines = assembler.fUsedSubroutines[:usedSubroutinesLen]
+		return newAsmError(lineStart+len(line)-len(remainingLine)+1, opcodestr, message)
+	}
+
 	for i := 0; i < count; i++ {
 		var op Operand
-		res, bend, err := assembler.ParseOperand(&op, remainingLine, info[i].Limit)
-		if !res {
-			return false, "invalid operand(s) " + err + " in line " + line
+		bend, err := assembler.ParseOperand(&op, remainingLine, info[i].Limit)
+		if err != nil {
+			return operandError("invalid operand(s) " + err.Error())
 		}
 		remainingLine = Trim(remainingLine[bend:])
 		opValue := uint(op.value)
@@ -1056,20 +1134,22 @@ func (assembler *Assembler) parseCode(line string, lineLen int) (bool, string) {
 	}
 	remainingLine = Trim(remainingLine)
 	if len(remainingLine) > 0 && remainingLine[0]!=';'{
-		return false, "too many operands in instruction " + line
+		return operandError("too many operands in instruction " + line)
 	}
 	assembler.instructions = append(assembler.instructions, ins)
+	assembler.instructionLines = append(assembler.instructionLines, assembler.lineNumber)
 
 	if useExtended {
 		extendedInst := Instruction(0)
 		SET_OPCODE(&extendedInst, OpCode(parser.OpExtraArg))
 		SETARG_Ax(&extendedInst, uint(extended))
 		assembler.instructions = append(assembler.instructions, extendedInst)
+		assembler.instructionLines = append(assembler.instructionLines, assembler.lineNumber)
 	}
-	return true, ""
+	return nil
 }
 
-func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string) {
+func (assembler *Assembler) parseUpvalue(line string, lineLen int) error {
 	cpos := strings.IndexFunc(line, func(c rune) bool {
 		return !unicode.IsSpace(c)
 	})
@@ -1080,7 +1160,7 @@ func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string
 	var instack, idx int
 	res, nc, n1 := ParseInt(line, cpos, end)
 	if !res {
-		return false, "could not parse instack " + line[cpos:end]
+		return newAsmError(cpos+1, "", "could not parse instack " + line[cpos:end])
 	}
 	instack = n1
 	cpos = nc
@@ -1089,7 +1169,7 @@ func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string
 	}) + cpos
 	res, nc, n2 := ParseInt(line, cpos, end)
 	if !res {
-		return false, "could not parse idx " + line[cpos:end]
+		return newAsmError(cpos+1, "", "could not parse idx " + line[cpos:end])
 	}
 	idx = n2
 	cpos = nc
@@ -1103,9 +1183,8 @@ func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string
 		res, nc, varname := ParseStr(line, cpos, end)
 		if res { //find str
 			if varname != "_ENV" {
-				isValid, errmsg := CheckName(varname)
-				if !isValid {
-					return false, errmsg
+				if checkErr := CheckName(varname); checkErr != nil {
+					return newAsmError(cpos+1, "", checkErr.Error())
 				}
 			}
 			name = varname
@@ -1116,18 +1195,18 @@ func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string
 			})
 
 			if apos >= 0 && cpos+apos < end && line[cpos+apos] != ';' {
-				return false, "invalid upvalue:" + line
+				return newAsmError(lineColumn(line), "", "invalid upvalue:" + line)
 			}
 
 		} else {
 			if cpos < end && line[cpos] != ';' {
-				return false, "invalid upvalue:" + line
+				return newAsmError(lineColumn(line), "", "invalid upvalue:" + line)
 			}
 		}
 
 	} else {
 		if cpos < end && line[cpos] != ';' {
-			return false, "invalid upvalue:" + line
+			return newAsmError(lineColumn(line), "", "invalid upvalue:" + line)
 		}
 
 	}
@@ -1137,11 +1216,11 @@ func (assembler *Assembler) parseUpvalue(line string, lineLen int) (bool, string
 	upvalue.instack = uint8(instack)
 	upvalue.name = name
 	assembler.upvalues = append(assembler.upvalues, upvalue)
-	return true, ""
+	return nil
 }
 
 //add parse local func>>>>>>>>>>>>>>>>>
-func (assembler *Assembler) parseLocal(line string, lineLen int) (bool, string) {
+func (assembler *Assembler) parseLocal(line string, lineLen int) error {
 	cpos := strings.IndexFunc(line, func(c rune) bool {
 		return !unicode.IsSpace(c)
 	})
@@ -1152,12 +1231,11 @@ func (assembler *Assembler) parseLocal(line string, lineLen int) (bool, string)
 	var startpc, endpc int
 	res, nc, name := ParseStr(line, cpos, end)
 	if !res {
-		return false, "could not parse local varname " + line[cpos:end]
+		return newAsmError(cpos+1, "", "could not parse local varname " + line[cpos:end])
 	}
 
-	//	isValid, errmsg := CheckName(name)
-	//	if !isValid {
-	//		return false, errmsg
+	//	if checkErr := CheckName(name); checkErr != nil {
+	//		return newAsmError(cpos+1, "", checkErr.Error())
 	//	}
 	cpos = nc
 	cpos = strings.IndexFunc(line[cpos:], func(c rune) bool {
@@ -1165,7 +1243,7 @@ func (assembler *Assembler) parseLocal(line string, lineLen int) (bool, string)
 	}) + cpos
 	res, nc, n1 := ParseInt(line, cpos, end)
 	if !res {
-		return false, "could not parse local startpc " + line[cpos:end]
+		return newAsmError(cpos+1, "", "could not parse local startpc " + line[cpos:end])
 	}
 	startpc = n1
 	cpos = nc
@@ -1174,7 +1252,7 @@ func (assembler *Assembler) parseLocal(line string, lineLen int) (bool, string)
 	}) + cpos
 	res, nc, n2 := ParseInt(line, cpos, end)
 	if !res {
-		return false, "could not parse local endpc " + line[cpos:end]
+		return newAsmError(cpos+1, "", "could not parse local endpc " + line[cpos:end])
 	}
 	endpc = n2
 	cpos = nc
@@ -1182,24 +1260,24 @@ func (assembler *Assembler) parseLocal(line string, lineLen int) (bool, string)
 		return !unicode.IsSpace(c)
 	})
 	if foundSpace >= 0 && cpos+foundSpace < end && line[cpos+foundSpace] != ';' {
-		return false, "invalid local:" + line
+		return newAsmError(lineColumn(line), "", "invalid local:" + line)
 	}
 	var local LocVar
 	local.varname = name
 	local.startpc = startpc
 	local.endpc = endpc
 	assembler.locals = append(assembler.locals, local)
-	return true, ""
+	return nil
 }
 
 //parse local func end
 
-func (assembler *Assembler) ParseLine(line string, lineLen int) (bool, string) {
+func (assembler *Assembler) ParseLine(line string, lineLen int) error {
 	if len(Trim(line)) < 1 {
-		return true, ""
+		return nil
 	}
 	if Trim(line)[0] == ';' {
-		return true, ""
+		return nil
 	}
 	if line[0] == '.' {
 		return assembler.parseDirective(line, lineLen)
@@ -1207,8 +1285,10 @@ func (assembler *Assembler) ParseLine(line string, lineLen int) (bool, string) {
 	switch assembler.parseStatus {
 	case PARSE_CONST:
 		var id int
-		res, _, err := assembler.parseConstant(line, lineLen, &id)
-		return res, err
+		if _, err := assembler.parseConstant(line, lineLen, &id); err != nil {
+			return newAsmError(lineColumn(line), "", err.Error())
+		}
+		return nil
 	case PARSE_CODE:
 		return assembler.parseCode(line, lineLen)
 	case PARSE_UPVALUE:
@@ -1218,13 +1298,12 @@ func (assembler *Assembler) ParseLine(line string, lineLen int) (bool, string) {
 		return assembler.parseLocal(line, lineLen)
 		//parse local end
 	case PARSE_FUNC:
-		return false, "unimplemented syntax"
+		return newAsmError(lineColumn(line), "", "unimplemented syntax")
 	case PARSE_NONE:
-		return false, "unimplemented syntax"
+		return newAsmError(lineColumn(line), "", "unimplemented syntax")
 	default:
-		return false, "unknown parse status"
+		return newAsmError(lineColumn(line), "", "unknown parse status")
 	}
-	return true, ""
 }
 
 func NewAssembler() *Assembler {
@@ -1240,65 +1319,65 @@ func NewAssembler() *Assembler {
 /**
  * write lua bytecode header
  */
-func (assembler *Assembler) writeHeader() (bool, string) {
+func (assembler *Assembler) writeHeader() error {
 	if BufferWriteCharArray(assembler.wBuffer, CurrentLuaConfig.LuaSignature) != nil {
-		return false, "failed to write signature"
+		return errors.New("failed to write signature")
 	}
 	if BufferWriteInt8(assembler.wBuffer, CurrentLuaConfig.CompilerVersion) != nil {
-		return false, "failed to write version"
+		return errors.New("failed to write version")
 	}
 	if BufferWriteInt8(assembler.wBuffer, CurrentLuaConfig.CompilerFormat) != nil {
-		return false, "failed to write format"
+		return errors.New("failed to write format")
 	}
 	if BufferWriteCharArray(assembler.wBuffer, CurrentLuaConfig.MagicData) != nil {
-		return false, "failed to write LUAC_DATA"
+		return errors.New("failed to write LUAC_DATA")
 	}
 	// write int32 size
 	if BufferWriteInt8(assembler.wBuffer, 4) != nil {
-		return false, "failed to write int size"
+		return errors.New("failed to write int size")
 	}
 	if BufferWriteInt8(assembler.wBuffer, CurrentLuaConfig.SizeTypeSize) != nil {
-		return false, "failed to write size_t size"
+		return errors.New("failed to write size_t size")
 	}
 	// write instruction size
 	if BufferWriteInt8(assembler.wBuffer, 4) != nil {
-		return false, "failed to write instruction size"
+		return errors.New("failed to write instruction size")
 	}
 	if BufferWriteInt8(assembler.wBuffer, CurrentLuaConfig.IntegerTypeSize) != nil {
-		return false, "failed to write integer size"
+		return errors.New("failed to write integer size")
 	}
 	if BufferWriteInt8(assembler.wBuffer, CurrentLuaConfig.NumberTypeSize) != nil {
-		return false, "failed to write number size"
+		return errors.New("failed to write number size")
 	}
 	if CurrentLuaConfig.IntegerTypeSize == 4 {
 		if BufferWriteUInt32(assembler.wBuffer, CurrentLuaConfig.MagicInt32) != nil {
-			return false, "failed to write LUAC_INT"
+			return errors.New("failed to write LUAC_INT")
 		}
 	} else if CurrentLuaConfig.IntegerTypeSize == 8 {
 		if BufferWriteUInt64(assembler.wBuffer, CurrentLuaConfig.MagicInt64) != nil {
-			return false, "failed to write LUAC_INT"
+			return errors.New("failed to write LUAC_INT")
 		}
 	} else {
-		return false, "unsupported lua_Integer size " + string(CurrentLuaConfig.IntegerTypeSize)
+		return errors.New("unsupported lua_Integer size " + string(CurrentLuaConfig.IntegerTypeSize))
 	}
 	if CurrentLuaConfig.NumberTypeSize == 4 {
 		if BufferWriteFloat32(assembler.wBuffer, CurrentLuaConfig.MagicFloat32) != nil {
-			return false, "failed to write LUAC_NUM"
+			return errors.New("failed to write LUAC_NUM")
 		}
 	} else if CurrentLuaConfig.NumberTypeSize == 8 {
 		if BufferWriteFloat64(assembler.wBuffer, CurrentLuaConfig.MagicFloat64) != nil {
-			return false, "failed to write LUAC_NUM"
+			return errors.New("failed to write LUAC_NUM")
 		}
 	} else {
-		return false, "unsupported lua_Number size " + string(CurrentLuaConfig.NumberTypeSize)
+		return errors.New("unsupported lua_Number size " + string(CurrentLuaConfig.NumberTypeSize))
 	}
-	return true, ""
+	return nil
 }
 
 /**
  * write proto to bytecode buffer
  */
-func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
+func (assembler *Assembler) writeFunction(fn *ParsedFunction) error {
 	wBuffer := assembler.wBuffer
 	//fmt.Printf("proto name: %s\n", fn.name)
 	funcname := fn.name
@@ -1306,7 +1385,7 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 		funcname = ""
 	}
 	if BufferWriteString(wBuffer, funcname) != nil {
-		return false, "write proto name error"
+		return errors.New("write proto name error")
 	}
 	linedefined, lastlinedefined := 0, 0
 	lines := len(fn.lineinfos)
@@ -1326,29 +1405,29 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 	}
 	//  linedefined, maybe use first instruction's linenumber or use .begin_code directive's linenumber comment
 	if BufferWriteUInt32(wBuffer, uint32(linedefined)) != nil {
-		return false, "write proto linedefined error"
+		return errors.New("write proto linedefined error")
 	}
 	//  lastlinedefined
 	if BufferWriteUInt32(wBuffer, uint32(lastlinedefined)) != nil {
-		return false, "write proto lastlinedefined error"
+		return errors.New("write proto lastlinedefined error")
 	}
 	if BufferWriteInt8(wBuffer, uint8(fn.params)) != nil {
-		return false, "write proto params num error"
+		return errors.New("write proto params num error")
 	}
 	if BufferWriteInt8(wBuffer, uint8(fn.vararg)) != nil {
-		return false, "write proto vararg error"
+		return errors.New("write proto vararg error")
 	}
 	if BufferWriteInt8(wBuffer, uint8(fn.maxstacksize)) != nil {
-		return false, "write proto maxstacksize error"
+		return errors.New("write proto maxstacksize error")
 	}
 
-	var protos []*ParsedFunction
+	protos := fn.protos
 	// fix missing closure pointers
 	for i := 0; i < len(fn.usedSubroutines); i++ {
 		pName := fn.usedSubroutines[i]
 		sub, ok := assembler.functions[pName]
 		if !ok {
-			return false, "no such function " + pName
+			return &AsmError{Line: fn.subroutineLine(pName), Name: "closure", Message: "no such function " + pName}
 		}
 		protos = append(protos, sub)
 		for j := 0; j < len(fn.neededSubroutines); {
@@ -1367,16 +1446,16 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 	}
 
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.instructions))) != nil {
-		return false, "write function instructions length error"
+		return errors.New("write function instructions length error")
 	}
 	for i := 0; i < len(fn.instructions); i++ {
 		if BufferWriteUInt32(wBuffer, uint32(fn.instructions[i])) != nil {
-			return false, "failed to write instructions"
+			return errors.New("failed to write instructions")
 		}
 	}
 
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.constants))) != nil {
-		return false, "write function constants length error"
+		return errors.New("write function constants length error")
 	}
 	for i := 0; i < len(fn.constants); i++ {
 		constantValue := *fn.constants[i]
@@ -1386,7 +1465,7 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 			valtype = LUA_TLNGSTR
 		}
 		if BufferWriteInt8(wBuffer, uint8(valtype)) != nil {
-			return false, "write constant value type error " + constantValue.str()
+			return errors.New("write constant value type error " + constantValue.str())
 		}
 		switch constantValue.valueType() {
 		case LUA_TNIL:
@@ -1396,12 +1475,12 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 		case LUA_TSTRING:
 			strVal, _ := constantValue.(*TString)
 			if BufferWriteString(wBuffer, strVal.string_value) != nil {
-				return false, "write constant value error " + constantValue.str()
+				return errors.New("write constant value error " + constantValue.str())
 			}
 		case LUA_TNUMINT:
 			numVal, _ := constantValue.(*TInteger)
 			if BufferWriteInt64(wBuffer, numVal.int_value) != nil {
-				return false, "write constant value error " + constantValue.str()
+				return errors.New("write constant value error " + constantValue.str())
 			}
 			//case LUA_TNUMFLT:
 			//  numVal, _ := constantValue.(*TNumber)
@@ -1411,124 +1490,149 @@ func (assembler *Assembler) writeFunction(fn *ParsedFunction) (bool, string) {
 		case LUA_TNUMBER:
 			numVal, _ := constantValue.(*TNumber)
 			if BufferWriteFloat64(wBuffer, numVal.number_value) != nil {
-				return false, "write constant value error " + constantValue.str()
+				return errors.New("write constant value error " + constantValue.str())
 			}
 		case LUA_TBOOLEAN:
 			boolVal, _ := constantValue.(*TBool)
 			if BufferWriteBool(wBuffer, boolVal.bool_value) != nil {
-				return false, "write constant value error " + constantValue.str()
+				return errors.New("write constant value error " + constantValue.str())
 			}
 		default:
-			return false, "unknown constant value type " + strconv.Itoa(constantValue.valueType())
+			return errors.New("unknown constant value type " + strconv.Itoa(constantValue.valueType()))
 		}
 	}
 
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.upvalues))) != nil {
-		return false, "write function upvalues length error"
+		return errors.New("write function upvalues length error")
 	}
 
 	for i := 0; i < len(fn.upvalues); i++ {
 		upvalue := fn.upvalues[i]
 		if BufferWriteInt8(wBuffer, upvalue.instack) != nil {
-			return false, "write function's upvalue instack error"
+			return errors.New("write function's upvalue instack error")
 		}
 		if BufferWriteInt8(wBuffer, upvalue.idx) != nil {
-			return false, "write function's upvalue idx error"
+			return errors.New("write function's upvalue idx error")
 		}
 	}
 
 	if BufferWriteUInt32(wBuffer, uint32(len(protos))) != nil {
-		return false, "write function's sub protos length error"
+		return errors.New("write function's sub protos length error")
 	}
 	for i := 0; i < len(protos); i++ {
 		proto := protos[i]
-		if ok, err := assembler.writeFunction(proto); !ok {
-			return false, err
+		if err := assembler.writeFunction(proto); err != nil {
+			return err
 		}
 	}
 
 	// line info size
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.lineinfos))) != nil {
-		return false, "write function's lineinfos length error"
+		return errors.New("write function's lineinfos length error")
 	}
 	for i := 0; i < len(fn.lineinfos); i++ {
 		lineinfo := fn.lineinfos[i]
 		if BufferWriteUInt32(wBuffer, uint32(lineinfo)) != nil {
-			return false, "write function's lineinfos error"
+			return errors.New("write function's lineinfos error")
 		}
 	}
 
 	// locals
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.locals))) != nil {
-		return false, "write function's local var size error"
+		return errors.New("write function's local var size error")
 	}
 	for i := 0; i < len(fn.locals); i++ {
 		if BufferWriteString(wBuffer, fn.locals[i].varname) != nil {
-			return false, "write function's locals name error"
+			return errors.New("write function's locals name error")
 		}
 		if BufferWriteUInt32(wBuffer, uint32(fn.locals[i].startpc)) != nil {
-			return false, "write function's local var startpc error"
+			return errors.New("write function's local var startpc error")
 		}
 		if BufferWriteUInt32(wBuffer, uint32(fn.locals[i].endpc)) != nil {
-			return false, "write function's local var endpc error"
+			return errors.New("write function's local var endpc error")
 		}
 	}
 
 	//upvalues name
 	if BufferWriteUInt32(wBuffer, uint32(len(fn.upvalues))) != nil {
-		return false, "write function's upvalues length error"
+		return errors.New("write function's upvalues length error")
 	}
 	for i := 0; i < len(fn.upvalues); i++ {
 		if BufferWriteString(wBuffer, fn.upvalues[i].name) != nil {
-			return false, "write function's upvalues name error"
+			return errors.New("write function's upvalues name error")
 		}
 	}
 
-	return true, ""
+	return nil
 }
 func (assembler *Assembler) ParseAsmContent(asmContent string) (result []byte, err error) {
-	lines := strings.Split(asmContent, "\n")
-	var line string
+	return assembler.parseAsm(asmContent, "")
+}
+
+// ParseAsmFile 汇编asm文件，文件中.include的相对路径从文件所在目录查找，错误中带文件名
+func (assembler *Assembler) ParseAsmFile(filename string) (result []byte, err error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	return assembler.parseAsm(string(content), filename)
+}
+
+func (assembler *Assembler) parseAsm(asmContent string, filename string) (result []byte, err error) {
+	// 先展开.include、.define和.macro，ParseAsmContent传入内容的.include从当前目录查找
+	pp := newAsmPreprocessor(".")
+	pp.processContent(asmContent, filename)
+	lines := pp.lines
+	// 出错后继续解析后面的行，一次返回所有错误
+	errs := pp.errs
+	var parseErrs AsmErrors
 	for i := 0; i < len(lines); i++ {
-		line = strings.Trim(lines[i], "\r\n")
-		if len(line) < 1 {
-			continue
-		}
-		res, ParseLineError := assembler.ParseLine(line, len(line))
-		if !res {
-			err = errors.New("L:" + strconv.Itoa(i+1) + ": " + ParseLineError)
-			return
+		// 解析时的行号是预处理后的行号，最后再换成源文件中的位置
+		assembler.lineNumber = i + 1
+		if lineErr := assembler.ParseLine(lines[i].text, len(lines[i].text)); lineErr != nil {
+			parseErrs = append(parseErrs, asmErrorsOf(lineErr, i+1)...)
 		}
 	}
 	if len(assembler.instructions) > 0 {
-		res, finalizeFunctionErr := assembler.finalizeFunction()
-		if !res {
-			err = errors.New(finalizeFunctionErr)
-			return
+		if finalizeFunctionErr := assembler.finalizeFunction(); finalizeFunctionErr != nil {
+			parseErrs = append(parseErrs, asmErrorsOf(finalizeFunctionErr, 0)...)
 		}
 	}
+	errs = append(errs, locateAsmErrors(parseErrs, lines)...)
 
 	if !assembler.bUpvalues {
-		err = errors.New("amount of upvalues never declared")
+		errs = append(errs, &AsmError{File: filename, Name: ".upvalues", Message: "amount of upvalues never declared"})
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		err = errs
 		return
 	}
 
-	if ok, writeHeaderErr := assembler.writeHeader(); !ok {
-		err = errors.New(writeHeaderErr)
+	mainFn, ok := assembler.functions["main"]
+	if !ok {
+		err = AsmErrors{&AsmError{File: filename, Name: ".func", Message: "no main function"}}
 		return
 	}
-	if BufferWriteInt8(assembler.wBuffer, uint8(assembler.nUpvalues)) != nil {
-		err = errors.New("failed to write num upvalues")
+	result, err = assembler.writeBytecode(assembler.nUpvalues, mainFn)
+	if err != nil {
+		err = locateAsmErrors(asmErrorsOf(err, 0), lines)
+	}
+	return
+}
+
+/**
+ * write header, upvalues amount and main function
+ */
+func (assembler *Assembler) writeBytecode(nUpvalues int, mainFn *ParsedFunction) (result []byte, err error) {
+	if err = assembler.writeHeader(); err != nil {
 		return
 	}
-	mainFn, ok := assembler.functions["main"]
-	if !ok {
-		err = errors.New("no main function")
+	if BufferWriteInt8(assembler.wBuffer, uint8(nUpvalues)) != nil {
+		err = errors.New("failed to write num upvalues")
 		return
 	}
-
-	if ok, writeFunctionErr := assembler.writeFunction(mainFn); !ok {
-		err = errors.New(writeFunctionErr)
+	if err = assembler.writeFunction(mainFn); err != nil {
 		return
 	}
 	result = assembler.wBuffer.Bytes()
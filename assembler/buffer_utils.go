@@ -3,7 +3,10 @@ package assembler
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"math"
+	"strconv"
 )
 
 func BufferWriteBytes(buffer *bytes.Buffer, data []byte, size int) (err error) {
@@ -81,3 +84,64 @@ func BufferWriteBool(buffer *bytes.Buffer, data bool) error {
 	}
 	return BufferWriteInt8(buffer, n)
 }
+
+// 以下读取函数和上面的写入函数一一对应，用于反汇编字节码
+
+func BufferReadInt8(reader *bytes.Reader) (uint8, error) {
+	return reader.ReadByte()
+}
+
+func BufferReadUInt32(reader *bytes.Reader) (uint32, error) {
+	bs := make([]byte, 4)
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(bs), nil
+}
+
+func BufferReadUInt64(reader *bytes.Reader) (uint64, error) {
+	bs := make([]byte, 8)
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(bs), nil
+}
+
+func BufferReadInt64(reader *bytes.Reader) (int64, error) {
+	n, err := BufferReadUInt64(reader)
+	return int64(n), err
+}
+
+func BufferReadFloat64(reader *bytes.Reader) (float64, error) {
+	n, err := BufferReadUInt64(reader)
+	return math.Float64frombits(n), err
+}
+
+// BufferReadString 只接受BufferWriteString写出的编码，长度0(NULL字符串)和可以用短格式的长格式都返回错误
+func BufferReadString(reader *bytes.Reader) (string, error) {
+	b, err := BufferReadInt8(reader)
+	if err != nil {
+		return "", err
+	}
+	size := uint64(b)
+	if b == 0xFF {
+		size, err = BufferReadUInt64(reader)
+		if err != nil {
+			return "", err
+		}
+		if size < 0xFF {
+			return "", errors.New("non-canonical string size " + strconv.FormatUint(size, 10))
+		}
+	}
+	if size == 0 {
+		return "", errors.New("null string is not supported")
+	}
+	if size-1 > uint64(reader.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	bs := make([]byte, size-1)
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
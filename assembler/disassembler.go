@@ -0,0 +1,633 @@
+package assembler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// 反汇编得到的函数，protos是子函数，顺序和字节码中一致
+type disasmFunction struct {
+	fn      *ParsedFunction
+	asmName string // asm中.func使用的名称，字节码中函数名为空时生成一个以fake结尾的名称
+	protos  []*disasmFunction
+}
+
+// Disassembler 把ParseAsmContent生成的字节码还原成asm文本，重新汇编后和原字节码逐字节相同。
+// 字节码头按CurrentLuaConfig校验，asm无法表达的内容返回错误而不是生成不同的字节码
+type Disassembler struct {
+	reader     *bytes.Reader
+	usedNames  map[string]bool
+	fakeNameId int
+}
+
+func NewDisassembler() *Disassembler {
+	instance := new(Disassembler)
+	instance.usedNames = make(map[string]bool)
+	return instance
+}
+
+func (disassembler *Disassembler) DisassembleBytecode(bytecode []byte) (result string, err error) {
+	// 字节码头和汇编器按当前配置写出的完全相同
+	headerWriter := NewAssembler()
+	if err = headerWriter.writeHeader(); err != nil {
+		return
+	}
+	header := headerWriter.wBuffer.Bytes()
+	if !bytes.HasPrefix(bytecode, header) {
+		err = errors.New("bytecode header doesn't match " + CurrentLuaConfig.VersionString)
+		return
+	}
+	disassembler.reader = bytes.NewReader(bytecode[len(header):])
+	nUpvalues, err := disassembler.readInt8("num upvalues")
+	if err != nil {
+		return
+	}
+	mainFn, err := disassembler.readFunction()
+	if err != nil {
+		return
+	}
+	if disassembler.reader.Len() > 0 {
+		err = fmt.Errorf("unexpected %d bytes after main function", disassembler.reader.Len())
+		return
+	}
+	if mainFn.fn.name != "main" {
+		err = fmt.Errorf("main function should be named main but got %q", mainFn.fn.name)
+		return
+	}
+	err = disassembler.collectFunctionNames(mainFn, true)
+	if err != nil {
+		return
+	}
+	disassembler.assignFunctionNames(mainFn)
+
+	out := bytes.NewBuffer([]byte{})
+	out.WriteString(".upvalues " + strconv.Itoa(int(nUpvalues)) + "\r\n")
+	err = disassembler.writeFunctionAsm(out, mainFn)
+	if err != nil {
+		return
+	}
+	result = out.String()
+	return
+}
+
+func (disassembler *Disassembler) readInt8(what string) (uint8, error) {
+	n, err := BufferReadInt8(disassembler.reader)
+	if err != nil {
+		return 0, errors.New("read " + what + " error: " + err.Error())
+	}
+	return n, nil
+}
+
+func (disassembler *Disassembler) readUInt32(what string) (uint32, error) {
+	n, err := BufferReadUInt32(disassembler.reader)
+	if err != nil {
+		return 0, errors.New("read " + what + " error: " + err.Error())
+	}
+	return n, nil
+}
+
+func (disassembler *Disassembler) readString(what string) (string, error) {
+	s, err := BufferReadString(disassembler.reader)
+	if err != nil {
+		return "", errors.New("read " + what + " error: " + err.Error())
+	}
+	return s, nil
+}
+
+/**
+ * read proto from bytecode, the reverse of writeFunction
+ */
+func (disassembler *Disassembler) readFunction() (result *disasmFunction, err error) {
+	fn := new(ParsedFunction)
+	result = &disasmFunction{fn: fn}
+	if fn.name, err = disassembler.readString("proto name"); err != nil {
+		return
+	}
+	linedefined, err := disassembler.readUInt32("proto linedefined")
+	if err != nil {
+		return
+	}
+	lastlinedefined, err := disassembler.readUInt32("proto lastlinedefined")
+	if err != nil {
+		return
+	}
+	fn.linedefined = uint(linedefined)
+	fn.lastlinedefined = uint(lastlinedefined)
+	params, err := disassembler.readInt8("proto params num")
+	if err != nil {
+		return
+	}
+	vararg, err := disassembler.readInt8("proto vararg")
+	if err != nil {
+		return
+	}
+	maxstacksize, err := disassembler.readInt8("proto maxstacksize")
+	if err != nil {
+		return
+	}
+	fn.params = uint(params)
+	fn.vararg = uint(vararg)
+	fn.maxstacksize = uint(maxstacksize)
+
+	instructionsCount, err := disassembler.readUInt32("function instructions length")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < instructionsCount; i++ {
+		ins, readErr := disassembler.readUInt32("instructions")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		fn.instructions = append(fn.instructions, Instruction(ins))
+	}
+
+	constantsCount, err := disassembler.readUInt32("function constants length")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < constantsCount; i++ {
+		var tval TValue
+		tval, err = disassembler.readConstant()
+		if err != nil {
+			return
+		}
+		fn.constants = append(fn.constants, &tval)
+	}
+
+	upvaluesCount, err := disassembler.readUInt32("function upvalues length")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < upvaluesCount; i++ {
+		var upvalue Upvalue
+		if upvalue.instack, err = disassembler.readInt8("function's upvalue instack"); err != nil {
+			return
+		}
+		if upvalue.idx, err = disassembler.readInt8("function's upvalue idx"); err != nil {
+			return
+		}
+		fn.upvalues = append(fn.upvalues, upvalue)
+	}
+
+	protosCount, err := disassembler.readUInt32("function's sub protos length")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < protosCount; i++ {
+		var proto *disasmFunction
+		proto, err = disassembler.readFunction()
+		if err != nil {
+			return
+		}
+		result.protos = append(result.protos, proto)
+	}
+
+	lineinfosCount, err := disassembler.readUInt32("function's lineinfos length")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < lineinfosCount; i++ {
+		lineinfo, readErr := disassembler.readUInt32("function's lineinfos")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		fn.lineinfos = append(fn.lineinfos, int(lineinfo))
+	}
+
+	localsCount, err := disassembler.readUInt32("function's local var size")
+	if err != nil {
+		return
+	}
+	for i := uint32(0); i < localsCount; i++ {
+		var local LocVar
+		if local.varname, err = disassembler.readString("function's locals name"); err != nil {
+			return
+		}
+		startpc, readErr := disassembler.readUInt32("function's local var startpc")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		endpc, readErr := disassembler.readUInt32("function's local var endpc")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		local.startpc = int(startpc)
+		local.endpc = int(endpc)
+		fn.locals = append(fn.locals, local)
+	}
+
+	upvalueNamesCount, err := disassembler.readUInt32("function's upvalues length")
+	if err != nil {
+		return
+	}
+	if int(upvalueNamesCount) != len(fn.upvalues) {
+		err = fmt.Errorf("function %s has %d upvalue names for %d upvalues", fn.name, upvalueNamesCount, len(fn.upvalues))
+		return
+	}
+	for i := 0; i < len(fn.upvalues); i++ {
+		if fn.upvalues[i].name, err = disassembler.readString("function's upvalues name"); err != nil {
+			return
+		}
+	}
+
+	// linedefined和lastlinedefined由汇编器根据行号信息计算，不能在asm中指定
+	expectedLinedefined, expectedLastlinedefined := 0, 0
+	if len(fn.lineinfos) > 0 {
+		expectedLinedefined = fn.lineinfos[0]
+		expectedLastlinedefined = fn.lineinfos[0]
+		for _, lineinfo := range fn.lineinfos {
+			if lineinfo < expectedLinedefined {
+				expectedLinedefined = lineinfo
+			}
+			if lineinfo > expectedLastlinedefined {
+				expectedLastlinedefined = lineinfo
+			}
+		}
+	}
+	if int(fn.linedefined) != expectedLinedefined || int(fn.lastlinedefined) != expectedLastlinedefined {
+		err = fmt.Errorf("function %s defined in lines %d-%d but line infos give %d-%d",
+			fn.name, fn.linedefined, fn.lastlinedefined, expectedLinedefined, expectedLastlinedefined)
+		return
+	}
+	return
+}
+
+func (disassembler *Disassembler) readConstant() (tval TValue, err error) {
+	valtype, err := disassembler.readInt8("constant value type")
+	if err != nil {
+		return
+	}
+	switch valtype {
+	case LUA_TNIL:
+		tval = new(TNil)
+	case LUA_TBOOLEAN:
+		b, readErr := disassembler.readInt8("constant value")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		if b > 1 {
+			err = fmt.Errorf("invalid bool constant value %d", b)
+			return
+		}
+		tval = &TBool{bool_value: b == 1}
+	case LUA_TNUMFLT:
+		f, readErr := BufferReadFloat64(disassembler.reader)
+		if readErr != nil {
+			err = errors.New("read constant value error: " + readErr.Error())
+			return
+		}
+		tval = &TNumber{number_value: f}
+	case LUA_TNUMINT:
+		n, readErr := BufferReadInt64(disassembler.reader)
+		if readErr != nil {
+			err = errors.New("read constant value error: " + readErr.Error())
+			return
+		}
+		tval = &TInteger{int_value: n}
+	case LUA_TSHRSTR, LUA_TLNGSTR:
+		s, readErr := disassembler.readString("constant value")
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		// 长短字符串由汇编器按长度决定
+		if (valtype == LUA_TLNGSTR) != (len(s) > CurrentLuaConfig.MaxShortLen) {
+			err = fmt.Errorf("string constant %q has wrong type %d for its length", s, valtype)
+			return
+		}
+		tval = &TString{string_value: s}
+	default:
+		err = errors.New("unknown constant value type " + strconv.Itoa(int(valtype)))
+	}
+	return
+}
+
+// 检查字节码中的函数名能否原样写回，汇编器按函数名查找子函数，所以名称不能重复
+func (disassembler *Disassembler) collectFunctionNames(f *disasmFunction, isTop bool) (err error) {
+	name := f.fn.name
+	if len(name) > 0 {
+		if checkErr := CheckName(name); checkErr != nil {
+			err = errors.New("function " + checkErr.Error())
+			return
+		}
+		// 汇编器写字节码时会把以fake结尾的函数名写成空字符串
+		if strings.HasSuffix(name, "fake") {
+			err = errors.New("function name " + name + " can't be written in asm")
+			return
+		}
+		// 子函数在closure指令中引用，以const开头会被当成常量
+		if !isTop && strings.HasPrefix(name, "const") {
+			err = errors.New("function name " + name + " can't be used in closure instruction")
+			return
+		}
+		if disassembler.usedNames[name] {
+			err = errors.New("duplicate function name " + name)
+			return
+		}
+		disassembler.usedNames[name] = true
+	}
+	for _, proto := range f.protos {
+		if err = disassembler.collectFunctionNames(proto, false); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (disassembler *Disassembler) assignFunctionNames(f *disasmFunction) {
+	f.asmName = f.fn.name
+	if len(f.asmName) < 1 {
+		for len(f.asmName) < 1 || disassembler.usedNames[f.asmName] {
+			disassembler.fakeNameId++
+			f.asmName = "proto_" + strconv.Itoa(disassembler.fakeNameId) + "_fake"
+		}
+		disassembler.usedNames[f.asmName] = true
+	}
+	for _, proto := range f.protos {
+		disassembler.assignFunctionNames(proto)
+	}
+}
+
+// const段和指令操作数中的常量字面量
+func constantLiteral(tval TValue) (result string, err error) {
+	switch v := tval.(type) {
+	case *TNil:
+		result = "nil"
+	case *TBool:
+		result = strconv.FormatBool(v.bool_value)
+	case *TInteger:
+		result = strconv.FormatInt(v.int_value, 10)
+	case *TNumber:
+		f := v.number_value
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			err = errors.New("float constant " + v.str() + " can't be written in asm")
+			return
+		}
+		// 带小数点或指数的数字汇编成浮点数
+		result = strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(result, ".e") {
+			result += ".0"
+		}
+	case *TString:
+		buf := bytes.NewBuffer([]byte{})
+		buf.WriteByte('"')
+		for i := 0; i < len(v.string_value); i++ {
+			c := v.string_value[i]
+			switch {
+			case c == '\\' || c == '"':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case c == '\n':
+				buf.WriteString("\\n")
+			case c == '\r':
+				buf.WriteString("\\r")
+			case c == '\t':
+				buf.WriteString("\\t")
+			case c == ';' || c < 0x20 || c == 0x7f:
+				// ;会被当成行号注释的开始
+				buf.WriteString(fmt.Sprintf("\\x%02x", c))
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte('"')
+		result = buf.String()
+	default:
+		err = errors.New("unknown constant value type " + strconv.Itoa(tval.valueType()))
+	}
+	return
+}
+
+func (disassembler *Disassembler) writeFunctionAsm(out *bytes.Buffer, f *disasmFunction) (err error) {
+	fn := f.fn
+	if len(fn.instructions) < 1 {
+		err = errors.New("function " + f.asmName + " has no instructions")
+		return
+	}
+	out.WriteString(".func " + f.asmName + " " + strconv.Itoa(int(fn.maxstacksize)) +
+		" " + strconv.Itoa(int(fn.params)) + " " + strconv.Itoa(int(fn.vararg)) + "\r\n")
+
+	out.WriteString(".begin_const\r\n")
+	for i := 0; i < len(fn.constants); i++ {
+		constantValue := *fn.constants[i]
+		// 汇编器会合并相同的常量
+		for j := 0; j < i; j++ {
+			prev := *fn.constants[j]
+			if prev.valueType() == constantValue.valueType() && prev.str() == constantValue.str() {
+				err = fmt.Errorf("duplicate constant %s in function %s", constantValue.str(), f.asmName)
+				return
+			}
+		}
+		literal, literalErr := constantLiteral(constantValue)
+		if literalErr != nil {
+			err = literalErr
+			return
+		}
+		out.WriteString("\t" + literal + "\r\n")
+	}
+	out.WriteString(".end_const\r\n")
+
+	out.WriteString(".begin_upvalue\r\n")
+	for _, upvalue := range fn.upvalues {
+		out.WriteString("\t" + strconv.Itoa(int(upvalue.instack)) + " " + strconv.Itoa(int(upvalue.idx)))
+		if len(upvalue.name) > 0 {
+			if checkErr := CheckName(upvalue.name); checkErr != nil {
+				err = errors.New("upvalue " + checkErr.Error())
+				return
+			}
+			out.WriteString(" \"" + upvalue.name + "\"")
+		}
+		out.WriteString("\r\n")
+	}
+	out.WriteString(".end_upvalue\r\n")
+
+	out.WriteString(".begin_local\r\n")
+	for _, local := range fn.locals {
+		if len(local.varname) < 1 || strings.ContainsAny(local.varname, "\"\n") {
+			err = fmt.Errorf("local name %q can't be written in asm", local.varname)
+			return
+		}
+		out.WriteString("\t\"" + local.varname + "\" " + strconv.Itoa(local.startpc) + " " + strconv.Itoa(local.endpc) + "\r\n")
+	}
+	out.WriteString(".end_local\r\n")
+
+	codeLines, labels, err := disassembler.disassembleCode(f)
+	if err != nil {
+		return
+	}
+	out.WriteString(".begin_code\r\n")
+	lineinfoIdx := 0
+	for pc := 0; pc <= len(fn.instructions); pc++ {
+		if labels[pc] {
+			out.WriteString("label_" + strconv.Itoa(pc) + ":\r\n")
+		}
+		if pc == len(fn.instructions) || len(codeLines[pc]) < 1 {
+			continue
+		}
+		out.WriteString("\t" + codeLines[pc])
+		// 汇编器按带行号注释的代码行依次收集行号
+		if lineinfoIdx < len(fn.lineinfos) {
+			out.WriteString(";L" + strconv.Itoa(fn.lineinfos[lineinfoIdx]) + ";")
+			lineinfoIdx++
+		}
+		out.WriteString("\r\n")
+	}
+	if lineinfoIdx < len(fn.lineinfos) {
+		err = fmt.Errorf("function %s has %d line infos but only %d code lines", f.asmName, len(fn.lineinfos), lineinfoIdx)
+		return
+	}
+	out.WriteString(".end_code\r\n")
+
+	for _, proto := range f.protos {
+		out.WriteString("\r\n")
+		if err = disassembler.writeFunctionAsm(out, proto); err != nil {
+			return
+		}
+	}
+	out.WriteString("\r\n")
+	return
+}
+
+// 把函数的指令转成asm代码行，codeLines[pc]为空表示该指令由前一条指令自动生成。labels是跳转目标的位置
+func (disassembler *Disassembler) disassembleCode(f *disasmFunction) (codeLines []string, labels map[int]bool, err error) {
+	fn := f.fn
+	codeLines = make([]string, len(fn.instructions))
+	labels = make(map[int]bool)
+	extraArgPcs := make(map[int]bool)
+	closuresCount := 0
+	for pc := 0; pc < len(fn.instructions); pc++ {
+		ins := fn.instructions[pc]
+		opcode := GET_OPCODE(ins)
+		if int(opcode) >= int(parser.NUM_OPCODES) {
+			err = fmt.Errorf("unknown opcode %d at pc %d of function %s", opcode, pc, f.asmName)
+			return
+		}
+		count := parser.Opcounts[opcode]
+		info := parser.Opinfos[opcode]
+
+		// 按汇编器的方式重新编码指令，不同说明有asm无法表达的位
+		var rebuilt Instruction
+		SET_OPCODE(&rebuilt, opcode)
+		line := strings.ToLower(parser.OpNames[opcode])
+		for i := 0; i < count; i++ {
+			var value uint
+			switch info[i].Pos {
+			case parser.OPP_A:
+				value = GETARG_A(ins)
+				SETARG_A(&rebuilt, value)
+			case parser.OPP_B:
+				value = GETARG_B(ins)
+				SETARG_B(&rebuilt, value)
+			case parser.OPP_C, parser.OPP_C_ARG:
+				value = GETARG_C(ins)
+				SETARG_C(&rebuilt, value)
+			case parser.OPP_Bx, parser.OPP_sBx:
+				value = GETARG_Bx(ins)
+				SETARG_Bx(&rebuilt, value)
+			case parser.OPP_Ax:
+				value = GETARG_Ax(ins)
+				SETARG_Ax(&rebuilt, value)
+			case parser.OPP_ARG:
+				// 汇编器自动在后面生成extraarg指令
+				if pc+1 >= len(fn.instructions) || GET_OPCODE(fn.instructions[pc+1]) != OpCode(parser.OpExtraArg) {
+					err = fmt.Errorf("missing extraarg after pc %d of function %s", pc, f.asmName)
+					return
+				}
+				value = GETARG_Ax(fn.instructions[pc+1])
+				var extraArg Instruction
+				SET_OPCODE(&extraArg, OpCode(parser.OpExtraArg))
+				SETARG_Ax(&extraArg, value)
+				if extraArg != fn.instructions[pc+1] {
+					err = fmt.Errorf("invalid extraarg at pc %d of function %s", pc+1, f.asmName)
+					return
+				}
+				extraArgPcs[pc+1] = true
+			}
+			operand, operandErr := disassembler.operandAsm(f, pc, info[i].Limit, value, labels, &closuresCount)
+			if operandErr != nil {
+				err = operandErr
+				return
+			}
+			line += " " + operand
+		}
+		if rebuilt != ins {
+			err = fmt.Errorf("instruction %08x at pc %d of function %s can't be written in asm", uint32(ins), pc, f.asmName)
+			return
+		}
+		codeLines[pc] = line
+		if extraArgPcs[pc+1] {
+			pc++
+		}
+	}
+	// 汇编器按closure指令出现的顺序排列子函数
+	if closuresCount != len(f.protos) {
+		err = fmt.Errorf("function %s has %d sub functions but %d closure instructions", f.asmName, len(f.protos), closuresCount)
+		return
+	}
+	for pc := range labels {
+		if extraArgPcs[pc] {
+			err = fmt.Errorf("jump to extraarg at pc %d of function %s", pc, f.asmName)
+			return
+		}
+	}
+	return
+}
+
+func (disassembler *Disassembler) operandAsm(f *disasmFunction, pc int, limit int, value uint,
+	labels map[int]bool, closuresCount *int) (result string, err error) {
+	switch limit {
+	case parser.LIMIT_STACKIDX:
+		result = "%" + strconv.Itoa(int(value))
+	case parser.LIMIT_UPVALUE:
+		result = "@" + strconv.Itoa(int(value))
+	case parser.LIMIT_EMBED:
+		result = strconv.Itoa(int(value))
+	case parser.LIMIT_CONSTANT:
+		result = constantOperandAsm(f, value, value)
+	case parser.LIMIT_CONST_STACK:
+		if ISK(value) {
+			result = constantOperandAsm(f, INDEXK(value), value)
+		} else {
+			result = "%" + strconv.Itoa(int(value))
+		}
+	case parser.LIMIT_LOCATION:
+		dest := pc + 1 + int(value) - MAXARG_sBx
+		if dest < 0 || dest > len(f.fn.instructions) {
+			err = fmt.Errorf("jmp dest %d exceed at pc %d of function %s", dest, pc, f.asmName)
+			return
+		}
+		labels[dest] = true
+		result = "$label_" + strconv.Itoa(dest)
+	case parser.LIMIT_PROTO:
+		if int(value) != *closuresCount || int(value) >= len(f.protos) {
+			err = fmt.Errorf("closure at pc %d of function %s should use sub function %d but got %d", pc, f.asmName, *closuresCount, value)
+			return
+		}
+		*closuresCount++
+		result = f.protos[value].asmName
+	default:
+		err = fmt.Errorf("unknown operand limit %d at pc %d of function %s", limit, pc, f.asmName)
+	}
+	return
+}
+
+// 常量能安全写成字面量时用const形式，否则直接写操作数的值
+func constantOperandAsm(f *disasmFunction, constIdx uint, value uint) string {
+	if int(constIdx) < len(f.fn.constants) {
+		if literal, err := constantLiteral(*f.fn.constants[constIdx]); err == nil {
+			return "const " + literal
+		}
+	}
+	return strconv.Itoa(int(value))
+}
@@ -0,0 +1,120 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/glualang/gluac/parser"
+	"github.com/glualang/gluac/utils"
+)
+
+func compileProto(t *testing.T, source string) *parser.Prototype {
+	proto, _, _, err := parser.Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proto
+}
+
+func compileToBytecode(t *testing.T, source string) []byte {
+	return assembleAsm(t, compileProto(t, source))
+}
+
+// 经过asm文本生成字节码
+func assembleAsm(t *testing.T, proto *parser.Prototype) []byte {
+	asmOutStream := utils.NewSimpleByteStream()
+	if err := proto.ToFuncAsm(asmOutStream, true); err != nil {
+		t.Fatal(err)
+	}
+	bytecode, err := NewAssembler().ParseAsmContent(string(asmOutStream.ToBytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytecode
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	sources := []string{
+		`local a = 1
+local b = a + 2.5
+print(a, b, true, nil, "say \"hi\"; bye", 'back\\slash')
+return a`,
+		`local function fib(n)
+    if n < 2 then
+        return n
+    end
+    return fib(n - 1) + fib(n - 2)
+end
+local sum = 0
+for i = 1, 10 do
+    sum = sum + fib(i)
+end
+while sum > 100 do
+    sum = sum - 7
+end
+local t = {1, 2, 3, x = -3, y = 0.25}
+for k, v in pairs(t) do
+    print(k, v)
+end
+local function counter()
+    local c = 0
+    return function(...)
+        c = c + select('#', ...)
+        return c
+    end
+end
+return counter()`,
+		`local g = 2.0
+local h = 1e300 * g
+local s = "line1\nline2\r\tend; \"quoted\" \1"
+print(s, "a;b", g + 0.1234567, h)
+return g`,
+	}
+	originConfig := CurrentLuaConfig
+	defer func() {
+		CurrentLuaConfig = originConfig
+	}()
+	for _, config := range []*LuaConfig{Lua53Config, GluaConfig} {
+		CurrentLuaConfig = config
+		for _, source := range sources {
+			bytecode := compileToBytecode(t, source)
+			asmStr, err := NewDisassembler().DisassembleBytecode(bytecode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reassembled, err := NewAssembler().ParseAsmContent(asmStr)
+			if err != nil {
+				t.Fatalf("reassemble error %s in asm:\n%s", err.Error(), asmStr)
+			}
+			if !bytes.Equal(bytecode, reassembled) {
+				t.Fatalf("%s round trip bytecode changed, asm:\n%s", config.VersionString, asmStr)
+			}
+		}
+	}
+}
+
+func TestDisassembleInvalidBytecode(t *testing.T) {
+	originConfig := CurrentLuaConfig
+	defer func() {
+		CurrentLuaConfig = originConfig
+	}()
+	CurrentLuaConfig = GluaConfig
+	bytecode := compileToBytecode(t, `return 1`)
+
+	CurrentLuaConfig = Lua53Config
+	_, err := NewDisassembler().DisassembleBytecode(bytecode)
+	if err == nil || !strings.Contains(err.Error(), "header") {
+		t.Errorf("expect header error but got %v", err)
+	}
+
+	CurrentLuaConfig = GluaConfig
+	_, err = NewDisassembler().DisassembleBytecode(bytecode[:len(bytecode)-3])
+	if err == nil {
+		t.Error("expect error for truncated bytecode")
+	}
+	_, err = NewDisassembler().DisassembleBytecode(append(append([]byte{}, bytecode...), 0))
+	if err == nil {
+		t.Error("expect error for trailing bytes")
+	}
+}
@@ -0,0 +1,421 @@
+package assembler
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// asm预处理，在解析.func/.begin_const/.begin_code等之前展开.include、.define和.macro:
+//
+//	.include "common.asm"      ; 相对路径从当前asm文件所在目录查找
+//	.define BASE 2             ; 之后的行中单词BASE替换成2，字符串和注释中不替换
+//	.macro cmp_jmp a, b, label ; 参数用逗号分隔
+//	    cmp_eq %BASE a b
+//	    jmp 0 $label
+//	.end_macro
+//	cmp_jmp %0, const 1, label_3
+
+// 宏嵌套展开的最大深度，避免宏递归调用时无限展开
+const maxMacroDepth = 64
+
+// 预处理后的一行asm和它在源文件中的位置
+type asmSourceLine struct {
+	text    string
+	file    string // 所在的asm文件，ParseAsmContent传入的内容为空
+	line    int
+	macro   string // 由宏展开得到时为宏名
+	changed bool   // 文本被宏参数或.define替换过，列号不再对应源文件
+}
+
+type asmMacro struct {
+	params []string
+	body   []asmSourceLine
+}
+
+type asmPreprocessor struct {
+	baseDir      string // ParseAsmContent传入内容中.include的起始目录
+	defines      map[string]string
+	macros       map[string]*asmMacro
+	includeStack []string
+	lines        []asmSourceLine
+	errs         AsmErrors
+
+	// 正在记录的宏，名称无效时name为空，结束时丢弃
+	macro     *asmMacro
+	macroName string
+	macroLine asmSourceLine
+}
+
+func newAsmPreprocessor(baseDir string) *asmPreprocessor {
+	pp := new(asmPreprocessor)
+	pp.baseDir = baseDir
+	pp.defines = make(map[string]string)
+	pp.macros = make(map[string]*asmMacro)
+	return pp
+}
+
+// 生成源文件位置上的错误，宏展开或替换过的行不报告列号
+func sourceError(src asmSourceLine, column int, name string, message string) *AsmError {
+	if src.changed {
+		column = 0
+	}
+	if len(src.macro) > 0 {
+		message += " (in macro " + src.macro + ")"
+	}
+	return &AsmError{File: src.file, Line: src.line, Column: column, Name: name, Message: message}
+}
+
+// 把按预处理后行号报告的错误换成源文件中的位置
+func locateAsmErrors(errs AsmErrors, lines []asmSourceLine) AsmErrors {
+	for i, e := range errs {
+		if e.Line < 1 || e.Line > len(lines) {
+			continue
+		}
+		errs[i] = sourceError(lines[e.Line-1], e.Column, e.Name, e.Message)
+	}
+	return errs
+}
+
+func (pp *asmPreprocessor) addError(src asmSourceLine, name string, message string) {
+	pp.errs = append(pp.errs, sourceError(src, lineColumn(src.text), name, message))
+}
+
+func (pp *asmPreprocessor) processContent(content string, file string) {
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.Trim(lines[i], "\r\n")
+		if len(line) < 1 {
+			continue
+		}
+		pp.processLine(asmSourceLine{text: line, file: file, line: i + 1}, 0)
+	}
+	if pp.macro != nil {
+		pp.addError(pp.macroLine, ".macro", "missing .end_macro for macro "+pp.macroName)
+		pp.macro = nil
+	}
+}
+
+func (pp *asmPreprocessor) processLine(src asmSourceLine, depth int) {
+	trimmed := Trim(src.text)
+	directive, args := splitDirective(trimmed)
+	if pp.macro != nil {
+		switch directive {
+		case "end_macro":
+			if len(pp.macroName) > 0 {
+				pp.macros[pp.macroName] = pp.macro
+			}
+			pp.macro = nil
+		case "macro":
+			pp.addError(src, ".macro", "macro definition cannot be inside another macro")
+		default:
+			pp.macro.body = append(pp.macro.body, src)
+		}
+		return
+	}
+	switch directive {
+	case "include":
+		pp.include(src, args)
+	case "define":
+		pp.define(src, args)
+	case "macro":
+		pp.beginMacro(src, args)
+	case "end_macro":
+		pp.addError(src, ".end_macro", "end_macro must be after macro")
+	case "":
+		if name, rest := splitMacroCall(trimmed); len(name) > 0 {
+			if macro, ok := pp.macros[name]; ok {
+				pp.expandMacro(src, name, macro, rest, depth)
+				return
+			}
+		}
+		pp.emit(src)
+	default:
+		pp.emit(src)
+	}
+}
+
+// 替换.define的常量后作为普通asm行输出
+func (pp *asmPreprocessor) emit(src asmSourceLine) {
+	text, changed := substituteLine(src.text, pp.defines)
+	src.text = text
+	src.changed = src.changed || changed
+	pp.lines = append(pp.lines, src)
+}
+
+func (pp *asmPreprocessor) include(src asmSourceLine, args string) {
+	args = Trim(stripAsmComment(args))
+	if len(args) < 3 || args[0] != '"' || args[len(args)-1] != '"' || strings.IndexByte(args[1:len(args)-1], '"') >= 0 {
+		pp.addError(src, ".include", "invalid args for directive .include, need a quoted file path")
+		return
+	}
+	path := args[1 : len(args)-1]
+	if !filepath.IsAbs(path) {
+		dir := pp.baseDir
+		if len(src.file) > 0 {
+			dir = filepath.Dir(src.file)
+		}
+		path = filepath.Join(dir, path)
+	}
+	for _, including := range pp.includeStack {
+		if including == path {
+			pp.addError(src, ".include", "recursive include of "+path)
+			return
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		pp.addError(src, ".include", err.Error())
+		return
+	}
+	pp.includeStack = append(pp.includeStack, path)
+	pp.processContent(string(content), path)
+	pp.includeStack = pp.includeStack[:len(pp.includeStack)-1]
+}
+
+func (pp *asmPreprocessor) define(src asmSourceLine, args string) {
+	args = Trim(stripAsmComment(args))
+	name := args
+	value := ""
+	if pos := strings.IndexAny(args, " \t"); pos >= 0 {
+		name = args[:pos]
+		value = Trim(args[pos:])
+	}
+	if err := pp.checkSymbolName(name); err != nil {
+		pp.addError(src, ".define", err.Error())
+		return
+	}
+	if len(value) < 1 {
+		pp.addError(src, ".define", "missing value for "+name)
+		return
+	}
+	// 值中用到的常量在定义时展开
+	value, _ = substituteWords(value, 0, pp.defines)
+	pp.defines[name] = value
+}
+
+func (pp *asmPreprocessor) beginMacro(src asmSourceLine, args string) {
+	args = Trim(stripAsmComment(args))
+	name := args
+	var params []string
+	if pos := strings.IndexAny(args, " \t"); pos >= 0 {
+		name = args[:pos]
+		params = splitMacroArgs(args[pos:])
+	}
+	pp.macro = new(asmMacro)
+	pp.macroName = ""
+	pp.macroLine = src
+	if err := pp.checkSymbolName(name); err != nil {
+		pp.addError(src, ".macro", err.Error())
+		return
+	}
+	for i, param := range params {
+		if err := CheckName(param); err != nil {
+			pp.addError(src, ".macro", "invalid macro param "+strconv.Quote(param))
+			return
+		}
+		for _, previous := range params[:i] {
+			if previous == param {
+				pp.addError(src, ".macro", "duplicate macro param "+param)
+				return
+			}
+		}
+	}
+	pp.macro.params = params
+	pp.macroName = name
+}
+
+func (pp *asmPreprocessor) expandMacro(src asmSourceLine, name string, macro *asmMacro, argsText string, depth int) {
+	if depth >= maxMacroDepth {
+		pp.addError(src, name, "macro expansion too deep, maybe recursive macro")
+		return
+	}
+	callArgs := stripAsmComment(argsText)
+	comment := argsText[len(callArgs):]
+	args := splitMacroArgs(callArgs)
+	if len(args) != len(macro.params) {
+		pp.addError(src, name, "macro "+name+" expects "+strconv.Itoa(len(macro.params))+" args but got "+strconv.Itoa(len(args)))
+		return
+	}
+	values := make(map[string]string)
+	for i, param := range macro.params {
+		values[param] = args[i]
+	}
+	for _, bodyLine := range macro.body {
+		text, _ := substituteLine(bodyLine.text, values)
+		if len(comment) > 0 {
+			text = withCallComment(text, comment)
+		}
+		// 宏中的行都报告在调用宏的位置
+		pp.processLine(asmSourceLine{text: text, file: src.file, line: src.line, macro: name, changed: true}, depth+1)
+	}
+}
+
+// 宏展开的代码行换成调用处的注释，保留;L1;这样的行号注释，伪指令和label行不变
+func withCallComment(text string, comment string) string {
+	trimmed := Trim(text)
+	if directive, _ := splitDirective(trimmed); len(directive) > 0 {
+		return text
+	}
+	if name, _ := splitMacroCall(trimmed); len(name) < 1 {
+		return text
+	}
+	return strings.TrimRight(stripAsmComment(text), " \t") + comment
+}
+
+// .define和.macro的名称不能和指令、const关键字以及已有的常量和宏重名
+func (pp *asmPreprocessor) checkSymbolName(name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	if IsSameStringIgnoreCase(name, "const") {
+		return errors.New("name const is reserved")
+	}
+	for i := 0; i < int(parser.NUM_OPCODES); i++ {
+		if IsSameStringIgnoreCase(name, parser.OpNames[i]) {
+			return errors.New("name " + name + " conflicts with opcode")
+		}
+	}
+	if _, ok := pp.defines[name]; ok {
+		return errors.New(name + " already defined")
+	}
+	if _, ok := pp.macros[name]; ok {
+		return errors.New(name + " already defined as macro")
+	}
+	return nil
+}
+
+// 伪指令行返回去掉'.'的小写伪指令名和后面的参数，不是伪指令时返回空
+func splitDirective(line string) (name string, args string) {
+	if len(line) < 2 || line[0] != '.' {
+		return
+	}
+	end := 1
+	for end < len(line) && isAsmWordChar(line[end]) {
+		end++
+	}
+	return strings.ToLower(line[1:end]), line[end:]
+}
+
+// 代码行开头的名称，是label时返回空
+func splitMacroCall(line string) (name string, rest string) {
+	end := 0
+	for end < len(line) && isAsmWordChar(line[end]) {
+		end++
+	}
+	rest = line[end:]
+	if len(Trim(rest)) > 0 && Trim(rest)[0] == ':' {
+		return "", line
+	}
+	return line[:end], rest
+}
+
+// 按逗号分隔宏参数，字符串中的逗号不分隔
+func splitMacroArgs(argsText string) (args []string) {
+	argsText = Trim(argsText)
+	if len(argsText) < 1 {
+		return
+	}
+	inString := false
+	start := 0
+	for i := 0; i < len(argsText); i++ {
+		c := argsText[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ',' {
+			args = append(args, Trim(argsText[start:i]))
+			start = i + 1
+		}
+	}
+	args = append(args, Trim(argsText[start:]))
+	return
+}
+
+// 去掉字符串外';'开始的注释
+func stripAsmComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ';' {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// 替换一行中的单词，伪指令行不替换伪指令名
+func substituteLine(line string, values map[string]string) (string, bool) {
+	start := 0
+	trimmed := strings.TrimLeft(line, " \t")
+	if directive, _ := splitDirective(trimmed); len(directive) > 0 {
+		start = len(line) - len(trimmed) + 1 + len(directive)
+	}
+	return substituteWords(line, start, values)
+}
+
+// 从start开始把values中的单词换成对应的值，字符串和注释中的内容不替换
+func substituteWords(line string, start int, values map[string]string) (result string, changed bool) {
+	if len(values) < 1 {
+		return line, false
+	}
+	var out strings.Builder
+	out.WriteString(line[:start])
+	inString := false
+	for i := start; i < len(line); {
+		c := line[i]
+		if inString {
+			if c == '\\' && i+1 < len(line) {
+				out.WriteString(line[i : i+2])
+				i += 2
+				continue
+			}
+			if c == '"' {
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ';' {
+			out.WriteString(line[i:])
+			break
+		} else if isAsmWordChar(c) && (i == 0 || !isAsmWordChar(line[i-1])) {
+			end := i
+			for end < len(line) && isAsmWordChar(line[end]) {
+				end++
+			}
+			word := line[i:end]
+			if value, ok := values[word]; ok {
+				out.WriteString(value)
+				changed = true
+			} else {
+				out.WriteString(word)
+			}
+			i = end
+			continue
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return out.String(), changed
+}
+
+func isAsmWordChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,139 @@
+package assembler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeAsmFile(t *testing.T, dir string, name string, lines ...string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\r\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreprocessIncludeDefineMacro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluac_asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeAsmFile(t, dir, "defs.asm",
+		".define BASE 1",
+		".define TOP BASE ; 值中的常量在定义时展开",
+		".macro push_cmp a, b",
+		"\tpush %TOP",
+		"\tcmp_eq %BASE a b",
+		"\tpop %TOP",
+		".end_macro",
+	)
+	mainPath := writeAsmFile(t, dir, "main.asm",
+		`.include "defs.asm"`,
+		".define COST 10",
+		".macro metered a, b",
+		"\tmeter COST",
+		"\tpush_cmp a, b",
+		".end_macro",
+		".upvalues 1",
+		".func main 3 0 0",
+		".begin_const",
+		"\t\"BASE, COST\"",
+		".end_const",
+		".begin_code",
+		"\tmetered %0, const \"BASE, COST\" ;L1;",
+		"\treturn %0 1;L2;",
+		".end_code",
+	)
+	expanded := strings.Join([]string{
+		".upvalues 1",
+		".func main 3 0 0",
+		".begin_const",
+		"\t\"BASE, COST\"",
+		".end_const",
+		".begin_code",
+		"\tmeter 10 ;L1;",
+		"\tpush %1 ;L1;",
+		"\tcmp_eq %1 %0 const \"BASE, COST\" ;L1;",
+		"\tpop %1 ;L1;",
+		"\treturn %0 1;L2;",
+		".end_code",
+	}, "\n")
+	originConfig := CurrentLuaConfig
+	defer func() {
+		CurrentLuaConfig = originConfig
+	}()
+	CurrentLuaConfig = GluaConfig
+	bytecode, err := NewAssembler().ParseAsmFile(mainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBytecode, err := NewAssembler().ParseAsmContent(expanded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytecode, expectedBytecode) {
+		t.Error("bytecode of preprocessed asm differs from expanded asm")
+	}
+}
+
+func TestPreprocessErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluac_asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeAsmFile(t, dir, "self.asm", `.include "self.asm"`)
+	incPath := writeAsmFile(t, dir, "inc.asm",
+		".macro two a, b",
+		"\tmove a b",
+		"\tbadop a",
+		".end_macro",
+	)
+	mainPath := writeAsmFile(t, dir, "main.asm",
+		`.include "inc.asm"`,
+		`.include "self.asm"`,
+		`.include "missing.asm"`,
+		".define move 1",
+		".upvalues 1",
+		".func main 2 0 0",
+		".begin_code",
+		"\ttwo %0",
+		"\ttwo %0, %1",
+		"\treturn %0 1",
+		".end_code",
+		".macro open",
+	)
+	_, err = NewAssembler().ParseAsmFile(mainPath)
+	errs, ok := err.(AsmErrors)
+	if !ok {
+		t.Fatalf("expect AsmErrors but got %v", err)
+	}
+	selfPath := filepath.Join(dir, "self.asm")
+	expected := []AsmError{
+		{File: mainPath, Line: 3, Column: 1, Name: ".include"},
+		{File: mainPath, Line: 4, Column: 1, Name: ".define"},
+		{File: mainPath, Line: 8, Column: 2, Name: "two"},
+		{File: mainPath, Line: 9, Column: 0, Name: "badop"},
+		{File: mainPath, Line: 12, Column: 1, Name: ".macro"},
+		{File: selfPath, Line: 1, Column: 1, Name: ".include"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expect %d errors but got:\n%s", len(expected), errs.Error())
+	}
+	for i, e := range expected {
+		if errs[i].File != e.File || errs[i].Line != e.Line || errs[i].Column != e.Column || errs[i].Name != e.Name {
+			t.Errorf("error %d: expect %s:L:%d:%d %s but got %s", i, e.File, e.Line, e.Column, e.Name, errs[i].Error())
+		}
+	}
+	if !strings.Contains(errs[3].Error(), "in macro two") {
+		t.Errorf("expect error in macro two but got %s", errs[3].Error())
+	}
+	if strings.Contains(errs.Error(), incPath) {
+		t.Errorf("errors in macro body should be reported at the call site:\n%s", errs.Error())
+	}
+}
@@ -0,0 +1,75 @@
+package assembler
+
+import (
+	"fmt"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// AssemblePrototype 直接把编译得到的Prototype写成字节码，不经过ToFuncAsm生成asm文本再解析。
+// 常量按原值写入，不受asm中字面量格式化和转义的影响
+func (assembler *Assembler) AssemblePrototype(proto *parser.Prototype) (result []byte, err error) {
+	mainFn, err := parsedFunctionFromPrototype(proto)
+	if err != nil {
+		return
+	}
+	return assembler.writeBytecode(len(proto.UpValues()), mainFn)
+}
+
+func parsedFunctionFromPrototype(proto *parser.Prototype) (fn *ParsedFunction, err error) {
+	fn = new(ParsedFunction)
+	fn.name = proto.Name()
+	fn.maxstacksize = uint(proto.MaxStackSize())
+	fn.params = uint(proto.ParameterCount())
+	// ToFuncAsm在.func的vararg位置写的是局部变量数，保持一致使两种方式生成的字节码相同
+	fn.vararg = uint(len(proto.LocalVariables()))
+	for _, ins := range proto.Code() {
+		fn.instructions = append(fn.instructions, Instruction(ins))
+	}
+	for _, constant := range proto.Constants() {
+		tval, constErr := constantFromValue(constant)
+		if constErr != nil {
+			err = constErr
+			return
+		}
+		fn.constants = append(fn.constants, &tval)
+	}
+	for _, upvalue := range proto.UpValues() {
+		var instack uint8
+		if upvalue.IsLocal {
+			instack = 1
+		}
+		fn.upvalues = append(fn.upvalues, Upvalue{instack: instack, idx: uint8(upvalue.Index), name: upvalue.Name})
+	}
+	for _, local := range proto.LocalVariables() {
+		fn.locals = append(fn.locals, LocVar{varname: local.Name, startpc: local.StartPC, endpc: local.EndPC})
+	}
+	fn.lineinfos = proto.LineInfo()
+	for _, subProto := range proto.Prototypes() {
+		sub, subErr := parsedFunctionFromPrototype(subProto)
+		if subErr != nil {
+			err = subErr
+			return
+		}
+		fn.protos = append(fn.protos, sub)
+	}
+	return
+}
+
+func constantFromValue(value interface{}) (tval TValue, err error) {
+	switch v := value.(type) {
+	case string:
+		tval = &TString{string_value: v}
+	case int64:
+		tval = &TInteger{int_value: v}
+	case float64:
+		tval = &TNumber{number_value: v}
+	case bool:
+		tval = &TBool{bool_value: v}
+	case nil:
+		tval = new(TNil)
+	default:
+		err = fmt.Errorf("non-literal constant value %v", value)
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssemblePrototype(t *testing.T) {
+	source := `local function fib(n)
+    if n < 2 then
+        return n
+    end
+    return fib(n - 1) + fib(n - 2)
+end
+local t = {1, 2, 3, x = -3, y = 0.25, name = "say \"hi\""}
+for k, v in pairs(t) do
+    print(k, v, fib(10))
+end
+local function counter()
+    local c = 0
+    return function(...)
+        c = c + select('#', ...)
+        return c
+    end
+end
+return counter()`
+	originConfig := CurrentLuaConfig
+	defer func() {
+		CurrentLuaConfig = originConfig
+	}()
+	for _, config := range []*LuaConfig{Lua53Config, GluaConfig} {
+		CurrentLuaConfig = config
+		proto := compileProto(t, source)
+		bytecode, err := NewAssembler().AssemblePrototype(proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bytecode, assembleAsm(t, proto)) {
+			t.Errorf("%s bytecode differs from assembling asm", config.VersionString)
+		}
+	}
+}
+
+// 字面量直接写入字节码时保持原值
+func TestAssemblePrototypeKeepsLiterals(t *testing.T) {
+	proto := compileProto(t, `local s = "a\nb\\c; d"
+local f = 0.1234567
+local g = 2.0
+return s, f, g`)
+	bytecode, err := NewAssembler().AssemblePrototype(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerWriter := NewAssembler()
+	headerWriter.writeHeader()
+	disassembler := NewDisassembler()
+	disassembler.reader = bytes.NewReader(bytecode[headerWriter.wBuffer.Len()+1:])
+	mainFn, err := disassembler.readFunction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 字符串中的;在asm中会被当成行号注释的开始
+	if len(mainFn.fn.lineinfos) != len(mainFn.fn.instructions) {
+		t.Errorf("expect %d line infos but got %d", len(mainFn.fn.instructions), len(mainFn.fn.lineinfos))
+	}
+	var constants []string
+	for _, constant := range mainFn.fn.constants {
+		constants = append(constants, (*constant).str())
+	}
+	expected := []TValue{&TString{string_value: "a\nb\\c; d"}, &TNumber{number_value: 0.1234567}, &TNumber{number_value: 2.0}}
+	if len(mainFn.fn.constants) != len(expected) {
+		t.Fatalf("expect %d constants but got %v", len(expected), constants)
+	}
+	for i, constant := range mainFn.fn.constants {
+		if (*constant).valueType() != expected[i].valueType() || (*constant).str() != expected[i].str() {
+			t.Errorf("constant %d expect %s but got %s", i, expected[i].str(), (*constant).str())
+		}
+	}
+}
+
+func TestDisassembleAssembledPrototype(t *testing.T) {
+	proto := compileProto(t, `local s = "a\nb\\c; d"
+local f = 0.1234567
+local g = 2.0
+print(s, "x;y", f + g)
+return s, f, g`)
+	bytecode, err := NewAssembler().AssemblePrototype(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asmStr, err := NewDisassembler().DisassembleBytecode(bytecode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, literal := range []string{`"a\nb\\c\x3b d"`, `"x\x3by"`, "0.1234567", "2.0"} {
+		if !strings.Contains(asmStr, "const "+literal) {
+			t.Errorf("expect constant %s in asm:\n%s", literal, asmStr)
+		}
+	}
+	reassembled, err := NewAssembler().ParseAsmContent(asmStr)
+	if err != nil {
+		t.Fatalf("reassemble error %s in asm:\n%s", err.Error(), asmStr)
+	}
+	if !bytes.Equal(bytecode, reassembled) {
+		t.Errorf("round trip bytecode changed, asm:\n%s", asmStr)
+	}
+}
@@ -7,6 +7,8 @@ type Storage = {
     name: string
 }
 
+event setName(data: string)
+
 var M = Contract<Storage>()
 
 function M:init()
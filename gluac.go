@@ -1,21 +1,25 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/glualang/gluac/assembler"
+	"github.com/glualang/gluac/lsp"
 	"github.com/glualang/gluac/packager"
 	"github.com/glualang/gluac/parser"
 	"github.com/glualang/gluac/utils"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime/debug"
 )
 
-var targetTypeFlag = flag.String("target", "asm", "target type(asm or binary or meta)")
+var targetTypeFlag = flag.String("target", "asm", "target type(asm or binary or meta or abi or inspect or disasm)")
 
 var vmTypeFlag = flag.String("vm", "lua53", "target bytecode type(lua53 or glua)")
 
@@ -23,13 +27,31 @@ var packageFlag = flag.Bool("package", false, "package bytecode with code info t
 
 var metaInfoFlag = flag.String("meta", "", "meta info json file path if you want package")
 
+var packageFormatFlag = flag.String("package-format", "legacy", "package format(legacy or v1), v1 has magic, format version and sections and needs chain support")
+
+var writeMetaFlag = flag.Bool("write-meta", false, "write generated meta info json alongside when packaging without -meta")
+
 var meterFlag = flag.Bool("meter", false, "add meter op")
 
+var strictFlag = flag.Bool("strict", false, "treat type check problems as errors")
+
+// 没有模块版本(比如go build本地源码)时使用的编译器版本
+const defaultGluacVersion = "1.0"
+
+// 写入打包文件的编译器版本，go install指定版本安装时使用模块的版本号
+func gluacVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && len(info.Main.Version) > 0 && info.Main.Version != "(devel)" {
+		return "gluac " + info.Main.Version
+	}
+	return "gluac " + defaultGluacVersion
+}
+
 type commandType int
 
 const (
 	SHOW_HELP_COMMAND commandType = iota
 	COMPILE_TO_ASM_COMMAND
+	LSP_COMMAND // gluac lsp, 通过stdio提供language server
 )
 
 func isNoArgsCommand(cmdType commandType) bool {
@@ -58,6 +80,99 @@ func createFileIfNotExists(filepath string) (err error) {
 	return
 }
 
+// 打印诊断信息，能找到源码位置时在下面显示出错的源码行
+func printDiagnostic(diagnostic error, source []byte) {
+	fmt.Println(diagnostic.Error())
+	if d, ok := diagnostic.(*parser.Diagnostic); ok {
+		if excerpt := d.SourceExcerpt(source); len(excerpt) > 0 {
+			fmt.Println(excerpt)
+		}
+	}
+}
+
+// 解析.gpc文件，把字节码摘要和合约元信息以json格式打印出来
+func inspectPackage(filename string) (err error) {
+	packaged, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	contract, err := packager.UnpackageBytecode(packaged)
+	if err != nil {
+		return
+	}
+	contractJson, err := json.MarshalIndent(contract, "", "  ")
+	if err != nil {
+		return
+	}
+	fmt.Println(string(contractJson))
+	return
+}
+
+// 把字节码文件反汇编成asm文本，字节码头按-vm指定的格式校验
+func disassembleBytecode(filename string) (err error) {
+	bytecode, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	asmStr, err := assembler.NewDisassembler().DisassembleBytecode(bytecode)
+	if err != nil {
+		return
+	}
+	fmt.Print(asmStr)
+	return
+}
+
+// 从源码的类型信息生成合约元信息
+func generateCodeInfo(typeChecker *parser.TypeChecker) (codeInfo *packager.CodeInfo, err error) {
+	codeInfo, err = packager.DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil {
+		return
+	}
+	if codeInfo == nil {
+		err = errors.New("source doesn't return a contract, can't generate meta info")
+		return
+	}
+	return
+}
+
+// 把合约元信息写到源码旁边的.gen.meta.json文件
+func writeCodeInfoFile(filename string, codeInfo *packager.CodeInfo) (err error) {
+	codeInfoBytes, err := json.Marshal(codeInfo)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filename+".gen.meta.json", codeInfoBytes, 0644)
+	return
+}
+
+// 检查手写的元信息和源码是否一致，严格模式下警告也当成错误
+func checkMetaInfo(codeInfo *packager.CodeInfo, typeChecker *parser.TypeChecker) (err error) {
+	compiledCodeInfo, err := generateCodeInfo(typeChecker)
+	if err != nil {
+		return
+	}
+	metaWarnings, metaErrs := packager.CheckCodeInfo(codeInfo, compiledCodeInfo)
+	if *strictFlag {
+		metaErrs = append(metaErrs, metaWarnings...)
+		metaWarnings = nil
+	}
+	if len(metaWarnings) > 0 {
+		fmt.Println("meta info warnings:")
+		for _, warning := range metaWarnings {
+			fmt.Println(warning.Error())
+		}
+	}
+	if len(metaErrs) > 0 {
+		fmt.Println("meta info errors:")
+		for _, metaErr := range metaErrs {
+			fmt.Println(metaErr.Error())
+		}
+		err = errors.New("meta info doesn't match contract")
+		return
+	}
+	return
+}
+
 func programMain() (err error) {
 	var programCmdType = COMPILE_TO_ASM_COMMAND
 	flag.Parse()
@@ -69,6 +184,9 @@ func programMain() (err error) {
 	isMeter := *meterFlag
 
 	otherArgs := flag.Args()
+	if len(otherArgs) > 0 && otherArgs[0] == "lsp" {
+		programCmdType = LSP_COMMAND
+	}
 
 	if vmType == "lua53" {
 		assembler.CurrentLuaConfig = assembler.Lua53Config
@@ -82,19 +200,69 @@ func programMain() (err error) {
 	if isNoArgsCommand(programCmdType) {
 		return
 	}
+	if programCmdType == LSP_COMMAND {
+		// stdout用来和编辑器通信，退出时不能再输出其他内容
+		err = lsp.NewServer(os.Stdin, os.Stdout).Run()
+		if err == nil {
+			os.Exit(0)
+		}
+		return
+	}
 	if len(otherArgs) < 1 {
 		fmt.Println("please pass the filename as argument or -h to see help")
 		os.Exit(1)
 		return
 	}
 	filename := otherArgs[0]
-	f, err := os.Open(filename)
+	if targetType == "inspect" {
+		err = inspectPackage(filename)
+		if err == nil {
+			// stdout输出的是json，退出时不能再输出其他内容
+			os.Exit(0)
+		}
+		return
+	}
+	if targetType == "disasm" {
+		err = disassembleBytecode(filename)
+		if err == nil {
+			// stdout输出的是asm文本，退出时不能再输出其他内容
+			os.Exit(0)
+		}
+		return
+	}
+	source, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	r := bufio.NewReader(f)
-	proto, typeChecker := parser.ParseToPrototype(r, filename)
+	proto, typeChecker, diagnostics, compileErr := parser.Compile(bytes.NewReader(source), filename)
+	if len(diagnostics) > 0 {
+		fmt.Println("compile diagnostics:")
+		for _, d := range diagnostics {
+			printDiagnostic(d, source)
+		}
+	}
+	if compileErr != nil {
+		err = errors.New("compile failed")
+		return
+	}
+
+	// 类型检查的错误在生成asm/binary/meta之前报告，有错误时不生成输出
+	typeChecker.Strict = *strictFlag
+	warinings, compileErrs := typeChecker.Validate()
+	if len(warinings) > 0 {
+		fmt.Println("compile warnings:")
+		for _, warning := range warinings {
+			printDiagnostic(warning, source)
+		}
+	}
+	if len(compileErrs) > 0 {
+		fmt.Println("compile errors:")
+		for _, compileErr := range compileErrs {
+			printDiagnostic(compileErr, source)
+		}
+		err = errors.New("type check failed")
+		return
+	}
 
 	// dump AST tree to tree string
 	typeTree, err := typeChecker.ToTreeString()
@@ -145,41 +313,68 @@ func programMain() (err error) {
 			return
 		}
 		defer dumpProtoF.Close()
-		asmOutStream := utils.NewSimpleByteStream()
-		proto.ToFuncAsm(asmOutStream, true)
-		asmStr := string(asmOutStream.ToBytes())
+		// 直接从Prototype生成字节码，不经过asm文本
 		ass := assembler.NewAssembler()
-		binaryBytes, parseAsmErr := ass.ParseAsmContent(asmStr)
-		if parseAsmErr != nil {
-			err = parseAsmErr
+		binaryBytes, assembleErr := ass.AssemblePrototype(proto)
+		if assembleErr != nil {
+			err = assembleErr
 			return
 		}
 		dumpProtoF.Write(binaryBytes)
-		_ = proto
 
 		if packageToSingleFile {
 			// 如果要把字节码和元信息json文件一起打包到单独一个文件的话
+			// 没有指定元信息文件时从源码生成元信息
+			var codeInfo *packager.CodeInfo
 			if len(metaInfoFilePath) < 1 {
-				err = errors.New("please specify meta info json path")
-				return
-			}
-			metaInfoFile, openMetaInfoFileErr := os.OpenFile(metaInfoFilePath, readFileMode, writeFilePerMode)
-			if openMetaInfoFileErr != nil {
-				err = openMetaInfoFileErr
-				return
+				codeInfo, err = generateCodeInfo(typeChecker)
+				if err != nil {
+					return
+				}
+				if *writeMetaFlag {
+					err = writeCodeInfoFile(filename, codeInfo)
+					if err != nil {
+						return
+					}
+				}
+			} else {
+				metaInfoFile, openMetaInfoFileErr := os.OpenFile(metaInfoFilePath, readFileMode, writeFilePerMode)
+				if openMetaInfoFileErr != nil {
+					err = openMetaInfoFileErr
+					return
+				}
+				defer metaInfoFile.Close()
+				metaInfo, readMetaInfoErr := ioutil.ReadAll(metaInfoFile)
+				if readMetaInfoErr != nil {
+					err = readMetaInfoErr
+					return
+				}
+				codeInfo = &packager.CodeInfo{}
+				err = json.Unmarshal(metaInfo, codeInfo)
+				if err != nil {
+					return
+				}
+				err = checkMetaInfo(codeInfo, typeChecker)
+				if err != nil {
+					return
+				}
 			}
-			defer metaInfoFile.Close()
-			metaInfo, readMetaInfoErr := ioutil.ReadAll(metaInfoFile)
-			if readMetaInfoErr != nil {
-				err = readMetaInfoErr
-				return
-			}
-			var codeInfo packager.CodeInfo
-			err = json.Unmarshal(metaInfo, &codeInfo)
-			if err != nil {
-				return
+			var packagedBytes []byte
+			var packageErr error
+			switch *packageFormatFlag {
+			case "legacy":
+				packagedBytes, packageErr = packager.PackageBytecodeWithCodeInfo(binaryBytes, codeInfo)
+			case "v1":
+				sourceDigest := sha1.Sum(source)
+				packagedBytes, packageErr = packager.PackageContract(&packager.PackagedContract{
+					Bytecode:        binaryBytes,
+					CodeInfo:        codeInfo,
+					SourceDigest:    hex.EncodeToString(sourceDigest[:]),
+					CompilerVersion: gluacVersion(),
+				})
+			default:
+				packageErr = errors.New("invalid package format " + *packageFormatFlag)
 			}
-			packagedBytes, packageErr := packager.PackageBytecodeWithCodeInfo(binaryBytes, &codeInfo)
 			if packageErr != nil {
 				err = packageErr
 				return
@@ -204,48 +399,41 @@ func programMain() (err error) {
 	} else if targetType == "meta" {
 		// generate contract meta info file
 		var dumpCodeInfo *packager.CodeInfo
-		dumpCodeInfo, err = packager.DumpCodeInfoFromTypeChecker(typeChecker)
+		dumpCodeInfo, err = generateCodeInfo(typeChecker)
 		if err != nil {
 			return
 		}
-		var dumpCodeInfoBytes []byte
-		dumpCodeInfoBytes, err = json.Marshal(dumpCodeInfo)
+		err = writeCodeInfoFile(filename, dumpCodeInfo)
 		if err != nil {
 			return
 		}
-		codeInfoFilePath := filename + ".gen.meta.json"
-		err = createFileIfNotExists(codeInfoFilePath)
+	} else if targetType == "abi" {
+		// generate contract abi json file
+		var abi *packager.ContractAbi
+		abi, err = packager.DumpContractAbi(typeChecker)
 		if err != nil {
 			return
 		}
-
-		dumpCodeInfoF, openFileErr := os.OpenFile(codeInfoFilePath, createReadWriteFileMode, writeFilePerMode)
-		if openFileErr != nil {
-			err = openFileErr
+		if abi == nil {
+			err = errors.New("source doesn't return a contract, can't generate abi")
 			return
 		}
-		defer dumpCodeInfoF.Close()
-		_, err = dumpCodeInfoF.Write(dumpCodeInfoBytes)
+		// 类型名称中有 < > ，不转义成\u003c
+		var abiBuf bytes.Buffer
+		abiEncoder := json.NewEncoder(&abiBuf)
+		abiEncoder.SetEscapeHTML(false)
+		abiEncoder.SetIndent("", "  ")
+		err = abiEncoder.Encode(abi)
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(filename+".abi.json", abiBuf.Bytes(), writeFilePerMode)
 		if err != nil {
 			return
 		}
 	} else {
 		panic("not supported target type " + targetType)
 	}
-
-	warinings, compileErrs := typeChecker.Validate()
-	if len(warinings) > 0 {
-		fmt.Println("compile warnings:")
-		for _, warning := range warinings {
-			fmt.Println(warning.Error())
-		}
-	}
-	if len(compileErrs) > 0 {
-		fmt.Println("compile errors:")
-		for _, compileErr := range compileErrs {
-			fmt.Println(compileErr.Error())
-		}
-	}
 	return
 }
 
@@ -253,7 +441,7 @@ func main() {
 	err := programMain()
 	if err != nil {
 		log.Println(err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("loaded")
 }
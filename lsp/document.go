@@ -0,0 +1,302 @@
+package lsp
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// 打开的文档和它最近一次编译的结果
+type document struct {
+	uri         string
+	version     int
+	text        string
+	lines       []string
+	typeChecker *parser.TypeChecker
+	diagnostics []*parser.Diagnostic
+}
+
+var keywords = []string{
+	"and", "break", "do", "else", "elseif", "end", "false", "for", "function", "goto", "if",
+	"in", "local", "type", "var", "let", "offline", "emit", "nil", "not", "or", "repeat",
+	"return", "then", "true", "until", "while",
+}
+
+// 文档uri对应的文件名，用于诊断信息
+func uriToFilename(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
+
+// 编译文档，收集语法错误和类型检查的诊断信息
+func newDocument(uri string, version int, text string) (doc *document) {
+	doc = &document{
+		uri:     uri,
+		version: version,
+		text:    text,
+		lines:   strings.Split(text, "\n"),
+	}
+	for i, line := range doc.lines {
+		doc.lines[i] = strings.TrimRight(line, "\r")
+	}
+	_, typeChecker, diagnostics, _ := parser.Compile(strings.NewReader(text), uriToFilename(uri))
+	doc.typeChecker = typeChecker
+	doc.diagnostics = diagnostics
+	warnings, errs := typeChecker.Validate()
+	for _, items := range [][]error{errs, warnings} {
+		for _, item := range items {
+			if d, ok := item.(*parser.Diagnostic); ok {
+				doc.diagnostics = append(doc.diagnostics, d)
+			}
+		}
+	}
+	return
+}
+
+func (doc *document) line(line int) string {
+	if line < 0 || line >= len(doc.lines) {
+		return ""
+	}
+	return doc.lines[line]
+}
+
+// utf16列号转成行内的字节偏移
+func byteColumn(line string, character int) int {
+	units := 0
+	for i, r := range line {
+		if units >= character {
+			return i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+// 行内的字节偏移转成utf16列号
+func utf16Column(line string, column int) int {
+	if column > len(line) {
+		column = len(line)
+	}
+	if column < 0 {
+		column = 0
+	}
+	return len(utf16.Encode([]rune(line[:column])))
+}
+
+// 从1开始的行号和字节列号转成lsp的位置
+func (doc *document) position(line int, column int) Position {
+	if line < 1 {
+		return Position{}
+	}
+	return Position{Line: line - 1, Character: utf16Column(doc.line(line-1), column-1)}
+}
+
+func (doc *document) lspDiagnostics() []Diagnostic {
+	result := make([]Diagnostic, 0, len(doc.diagnostics))
+	for _, d := range doc.diagnostics {
+		start := doc.position(d.Line, d.Column)
+		end := start
+		if d.EndLine > 0 {
+			end = doc.position(d.EndLine, d.EndColumn)
+		}
+		severity := diagnosticSeverityError
+		if d.Severity == parser.SeverityWarning {
+			severity = diagnosticSeverityWarning
+		}
+		result = append(result, Diagnostic{
+			Range:    Range{Start: start, End: end},
+			Severity: severity,
+			Source:   "gluac",
+			Message:  d.Message,
+		})
+	}
+	return result
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// 光标所在的标识符，以及标识符前面 a.b 或者 a:b 形式的对象名(没有时为空)
+type wordAtPosition struct {
+	word      string
+	qualifier string
+	line      int
+	start     int // 标识符开始的字节偏移
+	end       int
+}
+
+func (doc *document) wordAt(pos Position) (result wordAtPosition, ok bool) {
+	line := doc.line(pos.Line)
+	column := byteColumn(line, pos.Character)
+	start, end := column, column
+	for start > 0 && isNameChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isNameChar(line[end]) {
+		end++
+	}
+	if start == end || ('0' <= line[start] && line[start] <= '9') {
+		return
+	}
+	result = wordAtPosition{word: line[start:end], line: pos.Line, start: start, end: end}
+	if qualifierEnd := start - 1; qualifierEnd > 0 && (line[qualifierEnd] == '.' || line[qualifierEnd] == ':') {
+		qualifierStart := qualifierEnd
+		for qualifierStart > 0 && isNameChar(line[qualifierStart-1]) {
+			qualifierStart--
+		}
+		result.qualifier = line[qualifierStart:qualifierEnd]
+	}
+	ok = true
+	return
+}
+
+// 光标所在行的最内层类型信息作用域
+func (doc *document) scopeAt(pos Position) *parser.TypeInfoScope {
+	return doc.typeChecker.RootScope.FindScopeAtLine(pos.Line + 1)
+}
+
+// 查找name的record类型，不是record类型时返回nil
+func recordTypeOf(scope *parser.TypeInfoScope, name string) *parser.RecordTypeInfo {
+	item, _, _, ok := scope.Lookup(name)
+	if !ok || item == nil {
+		return nil
+	}
+	item = scope.Resolve(item)
+	if !item.IsRecordType() {
+		return nil
+	}
+	return item.RecordType
+}
+
+func declareKeyword(varType parser.VariableType) string {
+	switch varType {
+	case parser.CONST_VARIABLE:
+		return "let"
+	case parser.LOCAL_VARIABLE:
+		return "local"
+	case parser.PARAM_VARIABLE:
+		return "(parameter)"
+	default:
+		return "var"
+	}
+}
+
+func (doc *document) hover(pos Position) *Hover {
+	word, ok := doc.wordAt(pos)
+	if !ok {
+		return nil
+	}
+	scope := doc.scopeAt(pos)
+	var content string
+	if len(word.qualifier) > 0 {
+		recordType := recordTypeOf(scope, word.qualifier)
+		if recordType == nil {
+			return nil
+		}
+		propType, ok := recordType.FindProp(word.word)
+		if !ok {
+			return nil
+		}
+		content = fmt.Sprintf("(property) %s.%s: %s", recordType.Name, word.word, propType.String())
+	} else {
+		item, _, varType, ok := scope.Lookup(word.word)
+		if !ok || item == nil {
+			return nil
+		}
+		content = fmt.Sprintf("%s %s: %s", declareKeyword(varType), word.word, item.String())
+	}
+	lineText := doc.line(word.line)
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: "```glua\n" + content + "\n```"},
+		Range: &Range{
+			Start: Position{Line: word.line, Character: utf16Column(lineText, word.start)},
+			End:   Position{Line: word.line, Character: utf16Column(lineText, word.end)},
+		},
+	}
+}
+
+// 跳转到变量申明的位置. 作用域里只记录了申明所在的行，列号在那一行里查找变量名
+func (doc *document) definition(pos Position) *Location {
+	word, ok := doc.wordAt(pos)
+	if !ok || len(word.qualifier) > 0 {
+		return nil
+	}
+	_, line, _, ok := doc.scopeAt(pos).Lookup(word.word)
+	if !ok || line < 1 {
+		return nil
+	}
+	lineText := doc.line(line - 1)
+	start, end := 0, 0
+	wordPattern := regexp.MustCompile(`\b` + regexp.QuoteMeta(word.word) + `\b`)
+	if loc := wordPattern.FindStringIndex(lineText); loc != nil {
+		start, end = loc[0], loc[1]
+	}
+	return &Location{
+		URI: doc.uri,
+		Range: Range{
+			Start: Position{Line: line - 1, Character: utf16Column(lineText, start)},
+			End:   Position{Line: line - 1, Character: utf16Column(lineText, end)},
+		},
+	}
+}
+
+var memberAccessPattern = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\s*[.:]\s*([A-Za-z0-9_]*)$`)
+var namePrefixPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*$`)
+
+// a.或者a:后面补全record的成员，否则补全当前作用域可见的变量和关键字
+func (doc *document) completion(pos Position) *CompletionList {
+	lineText := doc.line(pos.Line)
+	before := lineText[:byteColumn(lineText, pos.Character)]
+	scope := doc.scopeAt(pos)
+	result := &CompletionList{Items: make([]CompletionItem, 0)}
+	if match := memberAccessPattern.FindStringSubmatch(before); match != nil {
+		recordType := recordTypeOf(scope, match[1])
+		if recordType == nil {
+			return result
+		}
+		for _, prop := range recordType.Props {
+			if !strings.HasPrefix(prop.PropName, match[2]) {
+				continue
+			}
+			kind := completionItemKindField
+			if prop.PropType.IsFuncType() {
+				kind = completionItemKindMethod
+			}
+			result.Items = append(result.Items, CompletionItem{Label: prop.PropName, Kind: kind, Detail: prop.PropType.String()})
+		}
+		return result
+	}
+	prefix := namePrefixPattern.FindString(before)
+	added := make(map[string]bool)
+	for s := scope; s != nil; s = s.Parent {
+		names := append([]string{}, s.Names...)
+		sort.Strings(names)
+		for _, name := range names {
+			if added[name] || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			added[name] = true
+			item, _, _, _ := s.Lookup(name)
+			detail := ""
+			if item != nil {
+				detail = item.String()
+			}
+			result.Items = append(result.Items, CompletionItem{Label: name, Kind: completionItemKindVariable, Detail: detail})
+		}
+	}
+	for _, keyword := range keywords {
+		if strings.HasPrefix(keyword, prefix) {
+			result.Items = append(result.Items, CompletionItem{Label: keyword, Kind: completionItemKindKeyword})
+		}
+	}
+	return result
+}
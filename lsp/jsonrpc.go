@@ -0,0 +1,63 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC消息的读写. 每个消息前面有 Content-Length: n 的头部，头部和消息体之间用空行分隔
+
+// 读取一个消息的消息体
+func readMessage(reader *bufio.Reader) (content []byte, err error) {
+	contentLength := -1
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		colonIndex := strings.Index(line, ":")
+		if colonIndex < 0 {
+			err = errors.New("invalid message header " + line)
+			return
+		}
+		name := strings.TrimSpace(line[:colonIndex])
+		value := strings.TrimSpace(line[colonIndex+1:])
+		if strings.EqualFold(name, "Content-Length") {
+			contentLength, err = strconv.Atoi(value)
+			if err != nil {
+				err = errors.New("invalid Content-Length " + value)
+				return
+			}
+		}
+	}
+	if contentLength < 0 {
+		err = errors.New("message without Content-Length header")
+		return
+	}
+	content = make([]byte, contentLength)
+	_, err = io.ReadFull(reader, content)
+	return
+}
+
+func writeMessage(writer io.Writer, message interface{}) (err error) {
+	content, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(writer, "Content-Length: %d\r\n\r\n", len(content))
+	if err != nil {
+		return
+	}
+	_, err = writer.Write(content)
+	return
+}
@@ -0,0 +1,225 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// gluac lsp 的language server，通过stdio收发JSON-RPC消息，单线程按顺序处理请求
+
+type Server struct {
+	reader      *bufio.Reader
+	writer      io.Writer
+	documents   map[string]*document
+	initialized bool
+	shutdown    bool
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		reader:    bufio.NewReader(in),
+		writer:    out,
+		documents: make(map[string]*document),
+	}
+}
+
+// Run 处理消息直到收到exit通知. 没有先收到shutdown请求就退出时返回错误
+func (server *Server) Run() (err error) {
+	for {
+		content, readErr := readMessage(server.reader)
+		if readErr != nil {
+			if readErr == io.EOF && server.shutdown {
+				return
+			}
+			err = readErr
+			return
+		}
+		var request requestMessage
+		if unmarshalErr := json.Unmarshal(content, &request); unmarshalErr != nil {
+			err = server.replyError(nil, &ResponseError{Code: parseErrorCode, Message: unmarshalErr.Error()})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if request.Method == "exit" {
+			if !server.shutdown {
+				err = errors.New("exit notification received before shutdown")
+			}
+			return
+		}
+		err = server.handleMessage(&request)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 处理一个请求或通知. 返回的错误只有写消息失败，处理过程中的错误回复给客户端
+func (server *Server) handleMessage(request *requestMessage) (err error) {
+	result, responseErr := server.dispatch(request)
+	if request.ID == nil {
+		if responseErr != nil {
+			log.Printf("lsp: %s: %s", request.Method, responseErr.Message)
+		}
+		return
+	}
+	if responseErr != nil {
+		return server.replyError(request.ID, responseErr)
+	}
+	return writeMessage(server.writer, &responseMessage{JSONRPC: jsonRPCVersion, ID: request.ID, Result: result})
+}
+
+func (server *Server) replyError(id *json.RawMessage, responseErr *ResponseError) error {
+	return writeMessage(server.writer, &errorResponseMessage{JSONRPC: jsonRPCVersion, ID: id, Error: responseErr})
+}
+
+func (server *Server) notify(method string, params interface{}) error {
+	return writeMessage(server.writer, &notificationMessage{JSONRPC: jsonRPCVersion, Method: method, Params: params})
+}
+
+func (server *Server) dispatch(request *requestMessage) (result interface{}, responseErr *ResponseError) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			responseErr = &ResponseError{Code: internalErrorCode, Message: fmt.Sprintf("internal error: %v", recovered)}
+		}
+	}()
+	if !server.initialized && request.Method != "initialize" {
+		if request.ID == nil {
+			return
+		}
+		responseErr = &ResponseError{Code: serverNotInitializedCode, Message: "server not initialized"}
+		return
+	}
+	switch request.Method {
+	case "initialize":
+		server.initialized = true
+		result = &InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:   textDocumentSyncKindFull,
+				HoverProvider:      true,
+				DefinitionProvider: true,
+				CompletionProvider: &CompletionOptions{TriggerCharacters: []string{".", ":"}},
+			},
+			ServerInfo: ServerInfo{Name: "gluac"},
+		}
+	case "initialized":
+	case "shutdown":
+		server.shutdown = true
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if responseErr = unmarshalParams(request, &params); responseErr != nil {
+			return
+		}
+		item := params.TextDocument
+		responseErr = server.updateDocument(newDocument(item.URI, item.Version, item.Text))
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if responseErr = unmarshalParams(request, &params); responseErr != nil {
+			return
+		}
+		doc, ok := server.documents[params.TextDocument.URI]
+		if !ok {
+			responseErr = &ResponseError{Code: invalidParamsCode, Message: "document not opened " + params.TextDocument.URI}
+			return
+		}
+		text := doc.text
+		for _, change := range params.ContentChanges {
+			text = applyContentChange(text, change)
+		}
+		responseErr = server.updateDocument(newDocument(doc.uri, params.TextDocument.Version, text))
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if responseErr = unmarshalParams(request, &params); responseErr != nil {
+			return
+		}
+		delete(server.documents, params.TextDocument.URI)
+		responseErr = server.publishDiagnostics(params.TextDocument.URI, 0, []Diagnostic{})
+	case "textDocument/hover", "textDocument/definition", "textDocument/completion":
+		var params TextDocumentPositionParams
+		if responseErr = unmarshalParams(request, &params); responseErr != nil {
+			return
+		}
+		doc, ok := server.documents[params.TextDocument.URI]
+		if !ok {
+			return
+		}
+		switch request.Method {
+		case "textDocument/hover":
+			if hover := doc.hover(params.Position); hover != nil {
+				result = hover
+			}
+		case "textDocument/definition":
+			if location := doc.definition(params.Position); location != nil {
+				result = location
+			}
+		default:
+			result = doc.completion(params.Position)
+		}
+	default:
+		if request.ID != nil {
+			responseErr = &ResponseError{Code: methodNotFoundCode, Message: "method not found " + request.Method}
+		}
+	}
+	return
+}
+
+func unmarshalParams(request *requestMessage, params interface{}) *ResponseError {
+	if err := json.Unmarshal(request.Params, params); err != nil {
+		return &ResponseError{Code: invalidParamsCode, Message: err.Error()}
+	}
+	return nil
+}
+
+// 保存重新编译后的文档并发送诊断信息
+func (server *Server) updateDocument(doc *document) *ResponseError {
+	server.documents[doc.uri] = doc
+	return server.publishDiagnostics(doc.uri, doc.version, doc.lspDiagnostics())
+}
+
+func (server *Server) publishDiagnostics(uri string, version int, diagnostics []Diagnostic) *ResponseError {
+	err := server.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+		URI:         uri,
+		Version:     version,
+		Diagnostics: diagnostics,
+	})
+	if err != nil {
+		return &ResponseError{Code: internalErrorCode, Message: err.Error()}
+	}
+	return nil
+}
+
+// 把一次修改应用到文档内容上，没有范围时是整个文档的新内容
+func applyContentChange(text string, change TextDocumentContentChangeEvent) string {
+	if change.Range == nil {
+		return change.Text
+	}
+	start := textOffset(text, change.Range.Start)
+	end := textOffset(text, change.Range.End)
+	if end < start {
+		end = start
+	}
+	return text[:start] + change.Text + text[end:]
+}
+
+// lsp位置在文档内容中的字节偏移
+func textOffset(text string, pos Position) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		index := strings.IndexByte(text[offset:], '\n')
+		if index < 0 {
+			return len(text)
+		}
+		offset += index + 1
+	}
+	lineText := text[offset:]
+	if index := strings.IndexByte(lineText, '\n'); index >= 0 {
+		lineText = lineText[:index]
+	}
+	return offset + byteColumn(lineText, pos.Character)
+}
@@ -0,0 +1,139 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testDocumentURI = "file:///tmp/test.lua"
+
+const testDocument = `type State = {
+    name: string,
+    age: int
+}
+let state: State = State()
+var count: int = 1
+function f(a: int)
+    return state.
+end
+let broken = (1
+`
+
+func writeTestMessage(t *testing.T, buffer *bytes.Buffer, id int, method string, params interface{}) {
+	message := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id > 0 {
+		message["id"] = id
+	}
+	if err := writeMessage(buffer, message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func positionParams(line int, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": testDocumentURI},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}
+}
+
+// 按顺序发送一组消息给server，返回server输出的所有消息
+func runTestSession(t *testing.T) []map[string]json.RawMessage {
+	input := new(bytes.Buffer)
+	writeTestMessage(t, input, 1, "initialize", map[string]interface{}{})
+	writeTestMessage(t, input, 0, "initialized", map[string]interface{}{})
+	writeTestMessage(t, input, 0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": testDocumentURI, "languageId": "glua", "version": 1, "text": testDocument},
+	})
+	writeTestMessage(t, input, 2, "textDocument/hover", positionParams(5, 5))
+	writeTestMessage(t, input, 3, "textDocument/definition", positionParams(7, 12))
+	writeTestMessage(t, input, 4, "textDocument/completion", positionParams(7, 17))
+	writeTestMessage(t, input, 5, "textDocument/hover", positionParams(1, 5))
+	writeTestMessage(t, input, 7, "textDocument/hover", positionParams(6, 11))
+	writeTestMessage(t, input, 6, "shutdown", nil)
+	writeTestMessage(t, input, 0, "exit", nil)
+
+	output := new(bytes.Buffer)
+	if err := NewServer(input, output).Run(); err != nil {
+		t.Fatal(err)
+	}
+	var messages []map[string]json.RawMessage
+	reader := bufio.NewReader(output)
+	for reader.Buffered() > 0 || output.Len() > 0 {
+		content, err := readMessage(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message map[string]json.RawMessage
+		if err = json.Unmarshal(content, &message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestServerSession(t *testing.T) {
+	messages := runTestSession(t)
+	results := make(map[string]string)
+	var diagnostics PublishDiagnosticsParams
+	for _, message := range messages {
+		if id, ok := message["id"]; ok {
+			results[string(id)] = string(message["result"])
+		} else if err := json.Unmarshal(message["params"], &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(diagnostics.Diagnostics) != 2 || diagnostics.Diagnostics[0].Range.Start.Line != 8 || diagnostics.Diagnostics[1].Range.Start.Line != 10 {
+		t.Errorf("unexpected diagnostics %v", diagnostics)
+	}
+	if !strings.Contains(results["2"], "var count: int") {
+		t.Errorf("unexpected hover %s", results["2"])
+	}
+	if !strings.Contains(results["7"], "(parameter) a: int") {
+		t.Errorf("unexpected parameter hover %s", results["7"])
+	}
+	var location Location
+	if err := json.Unmarshal([]byte(results["3"]), &location); err != nil {
+		t.Fatal(err)
+	}
+	expectedRange := Range{Start: Position{Line: 4, Character: 4}, End: Position{Line: 4, Character: 9}}
+	if location.URI != testDocumentURI || location.Range != expectedRange {
+		t.Errorf("unexpected definition %s", results["3"])
+	}
+	var completion CompletionList
+	if err := json.Unmarshal([]byte(results["4"]), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Items) != 2 || completion.Items[0].Label != "name" || completion.Items[1].Label != "age" {
+		t.Errorf("unexpected completion %s", results["4"])
+	}
+	if results["5"] != "null" || results["6"] != "null" {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+func TestApplyContentChange(t *testing.T) {
+	text := "let a = 1\nlet b = 2\n"
+	change := TextDocumentContentChangeEvent{
+		Range: &Range{Start: Position{Line: 1, Character: 4}, End: Position{Line: 1, Character: 5}},
+		Text:  "count",
+	}
+	if result := applyContentChange(text, change); result != "let a = 1\nlet count = 2\n" {
+		t.Errorf("unexpected text %q", result)
+	}
+}
+
+func TestHoverDeclareKeyword(t *testing.T) {
+	doc := newDocument(testDocumentURI, 1, "local total = 1\nvar count = total\nlet limit = count\n")
+	expected := []string{"local total", "var count", "let limit"}
+	for line, prefix := range expected {
+		// 光标放在变量名的最后一个字符上
+		hover := doc.hover(Position{Line: line, Character: len(prefix) - 1})
+		if hover == nil || !strings.Contains(hover.Contents.Value, prefix+":") {
+			t.Errorf("expect hover %s but got %v", prefix, hover)
+		}
+	}
+}
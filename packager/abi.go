@@ -0,0 +1,214 @@
+package packager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// 合约的ABI，比CodeInfo多了参数名称、返回值类型、event参数类型、storage结构和文档注释，给钱包和SDK生成工具使用
+type ContractAbi struct {
+	Methods []*AbiMethod          `json:"methods"`
+	Events  []*AbiEvent           `json:"events"`
+	Storage []*AbiStorageProperty `json:"storage"`
+}
+
+type AbiType struct {
+	Name   string        `json:"name"`             // 源码中的类型名称，比如 int, Array<string>, Person
+	Code   CodeValueType `json:"code"`             // LTI_*类型码
+	Items  *AbiType      `json:"items,omitempty"`  // Array和Map的元素类型
+	Fields []*AbiField   `json:"fields,omitempty"` // record的属性
+	Types  []*AbiType    `json:"types,omitempty"`  // 联合类型的各个类型
+	Value  interface{}   `json:"value,omitempty"`  // 字面量类型的值
+}
+
+type AbiField struct {
+	Name    string      `json:"name"`
+	Type    *AbiType    `json:"type"`
+	Default interface{} `json:"default,omitempty"`
+	Doc     string      `json:"doc,omitempty"`
+}
+
+type AbiParam struct {
+	Name string   `json:"name"`
+	Type *AbiType `json:"type"`
+}
+
+type AbiMethod struct {
+	Name    string      `json:"name"`
+	Offline bool        `json:"offline"`
+	Params  []*AbiParam `json:"params"`
+	Returns *AbiType    `json:"returns,omitempty"`
+	Doc     string      `json:"doc,omitempty"`
+}
+
+type AbiEvent struct {
+	Name   string      `json:"name"`
+	Params []*AbiParam `json:"params"` // 没有event申明时参数名称为空
+}
+
+type AbiStorageProperty struct {
+	Name        string           `json:"name"`
+	Type        *AbiType         `json:"type"`
+	StorageType StorageValueType `json:"storage_type"`
+	Doc         string           `json:"doc,omitempty"`
+}
+
+// 从类型信息生成合约ABI，源码没有返回合约record时返回nil
+func DumpContractAbi(checker *parser.TypeChecker) (abi *ContractAbi, err error) {
+	recordTypeInfo := contractRecordType(checker)
+	if recordTypeInfo == nil {
+		return
+	}
+	scope := checker.RootScope
+	result := &ContractAbi{
+		Methods: make([]*AbiMethod, 0),
+		Events:  make([]*AbiEvent, 0),
+		Storage: make([]*AbiStorageProperty, 0),
+	}
+	for _, prop := range recordTypeInfo.Props {
+		if !prop.PropType.IsFuncType() {
+			continue
+		}
+		method := &AbiMethod{
+			Name:    prop.PropName,
+			Offline: prop.Offline,
+			Params:  make([]*AbiParam, 0),
+			Doc:     prop.Doc,
+		}
+		for _, param := range apiParams(prop.PropType) {
+			if param.IsDynamicParams {
+				err = fmt.Errorf("api %s can't have variable arguments", prop.PropName)
+				return
+			}
+			// 没有申明类型的参数链上按字符串传入
+			paramType := param.TypeInfo
+			if paramType == nil || parser.IsObjectType(paramType) {
+				paramType, _, _, _ = scope.Lookup("string")
+			}
+			method.Params = append(method.Params, &AbiParam{Name: param.Name, Type: abiTypeOf(scope, paramType, nil)})
+		}
+		// 没有申明返回类型时使用从return语句推导出的类型，推导不出时是object，没有返回值时不导出
+		returnType := prop.PropType.FuncReturnType
+		if returnType == nil {
+			if funcScope := scope.FindFuncScope(prop.PropType); funcScope != nil {
+				returnType = funcScope.DerivedReturnType()
+			}
+		}
+		if returnType != nil && !returnType.IsNotDerivedType() {
+			method.Returns = abiTypeOf(scope, returnType, nil)
+		}
+		result.Methods = append(result.Methods, method)
+	}
+	// emit过的event，有event申明时使用申明的参数，否则使用从emit参数推导的类型. 然后是申明了但没有emit过的event
+	eventNames := append([]string{}, checker.Events...)
+	for _, declaration := range checker.EventDeclarations {
+		if !parser.ContainsString(eventNames, declaration.Name) {
+			eventNames = append(eventNames, declaration.Name)
+		}
+	}
+	for _, eventName := range eventNames {
+		event := &AbiEvent{Name: eventName, Params: make([]*AbiParam, 0)}
+		if declaration, ok := checker.FindEventDeclaration(eventName); ok {
+			for _, param := range declaration.Params {
+				if param.IsDynamicParams {
+					err = fmt.Errorf("event %s can't have variable arguments", eventName)
+					return
+				}
+				event.Params = append(event.Params, &AbiParam{Name: param.Name, Type: abiTypeOf(scope, param.TypeInfo, nil)})
+			}
+		} else {
+			for _, argType := range checker.EventArgTypes[eventName] {
+				event.Params = append(event.Params, &AbiParam{Type: abiTypeOf(scope, argType, nil)})
+			}
+		}
+		result.Events = append(result.Events, event)
+	}
+	storageProps, err := contractStorageProps(scope, recordTypeInfo)
+	if err != nil {
+		return
+	}
+	for _, p := range storageProps {
+		storageType, ok := storageValueTypeOf(scope, p.PropType)
+		if !ok {
+			err = fmt.Errorf("storage property %s has type %s which contract storage can't accept", p.PropName, p.PropType.String())
+			return
+		}
+		result.Storage = append(result.Storage, &AbiStorageProperty{
+			Name:        p.PropName,
+			Type:        abiTypeOf(scope, p.PropType, nil),
+			StorageType: storageType,
+			Doc:         p.Doc,
+		})
+	}
+	abi = result
+	return
+}
+
+// 类型在ABI中的名称，使用展开别名前的类型
+func abiTypeName(typeInfo *parser.TypeTreeItem) string {
+	switch {
+	case typeInfo.IsSimpleNameWithGenericTypesType():
+		paramNames := make([]string, 0, len(typeInfo.GenericTypeParams))
+		for _, param := range typeInfo.GenericTypeParams {
+			paramNames = append(paramNames, abiTypeName(param))
+		}
+		return fmt.Sprintf("%s<%s>", typeInfo.Name, strings.Join(paramNames, ", "))
+	case typeInfo.IsRecordType():
+		if typeInfo.RecordType != nil && len(typeInfo.RecordType.Name) > 0 {
+			return typeInfo.RecordType.Name
+		}
+		return "table"
+	case typeInfo.IsUnionType():
+		typeNames := make([]string, 0, len(typeInfo.UnionTypes))
+		for _, item := range typeInfo.UnionTypes {
+			typeNames = append(typeNames, abiTypeName(item))
+		}
+		return strings.Join(typeNames, " | ")
+	case typeInfo.IsFuncType():
+		return "function"
+	case typeInfo.IsNotDerivedType():
+		return "object"
+	}
+	return typeInfo.String()
+}
+
+// 类型的ABI描述. visiting是正在展开的record名称，避免递归的record无限展开
+func abiTypeOf(scope *parser.TypeInfoScope, typeInfo *parser.TypeTreeItem, visiting map[string]bool) *AbiType {
+	result := &AbiType{
+		Name: abiTypeName(typeInfo),
+		Code: TypeInfoCode(scope, typeInfo),
+	}
+	resolved := scope.Resolve(typeInfo)
+	switch result.Code {
+	case LTI_ARRAY, LTI_MAP:
+		if len(resolved.GenericTypeParams) > 0 {
+			result.Items = abiTypeOf(scope, resolved.GenericTypeParams[0], visiting)
+		}
+	case LTI_UNION:
+		for _, item := range resolved.UnionTypes {
+			result.Types = append(result.Types, abiTypeOf(scope, item, visiting))
+		}
+	case LTI_LITERIAL_TYPE:
+		result.Value = resolved.LiteralValue
+	case LTI_RECORD:
+		recordName := resolved.RecordType.Name
+		if visiting[recordName] {
+			break
+		}
+		innerVisiting := map[string]bool{recordName: true}
+		for name := range visiting {
+			innerVisiting[name] = true
+		}
+		for _, prop := range resolved.RecordType.Props {
+			result.Fields = append(result.Fields, &AbiField{
+				Name:    prop.PropName,
+				Type:    abiTypeOf(scope, prop.PropType, innerVisiting),
+				Default: prop.DefaultValue,
+				Doc:     prop.Doc,
+			})
+		}
+	}
+	return result
+}
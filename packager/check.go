@@ -0,0 +1,180 @@
+package packager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/glualang/gluac/parser"
+)
+
+// 把手写的合约元信息和从源码中生成的元信息对比.
+// 声明了但源码中从没emit过的event作为警告，其他不一致都是错误
+func CheckCodeInfo(declared *CodeInfo, compiled *CodeInfo) (warnings []error, errs []error) {
+	// apis
+	for _, api := range compiled.Apis {
+		if !parser.ContainsString(declared.Apis, api) {
+			errs = append(errs, fmt.Errorf("api %s is not declared in meta info", api))
+		} else if declared.IsOfflineApi(api) != compiled.IsOfflineApi(api) {
+			errs = append(errs, fmt.Errorf("api %s offline is %v in meta info but %v in contract", api, declared.IsOfflineApi(api), compiled.IsOfflineApi(api)))
+		}
+	}
+	for _, api := range declared.Apis {
+		if !parser.ContainsString(compiled.Apis, api) {
+			errs = append(errs, fmt.Errorf("api %s declared in meta info is not defined in contract", api))
+		}
+	}
+	for _, api := range declared.OfflineApis {
+		if !parser.ContainsString(declared.Apis, api) {
+			errs = append(errs, fmt.Errorf("offline api %s is not in api list of meta info", api))
+		}
+	}
+	// events
+	for _, event := range compiled.Events {
+		if !parser.ContainsString(declared.Events, event) {
+			errs = append(errs, fmt.Errorf("event %s is not declared in meta info", event))
+		}
+	}
+	for _, event := range declared.Events {
+		if !parser.ContainsString(compiled.Events, event) {
+			warnings = append(warnings, fmt.Errorf("event %s declared in meta info is never emitted", event))
+		}
+	}
+	// contract_storage_properties
+	declaredStorageTypes, err := storageTypesMap(declared.StoragePropertiesTypes)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid storage properties types in meta info: %s", err.Error()))
+		return
+	}
+	compiledStorageTypes, err := storageTypesMap(compiled.StoragePropertiesTypes)
+	if err != nil {
+		errs = append(errs, err)
+		return
+	}
+	for _, item := range compiled.StoragePropertiesTypes {
+		name := item[0].(string)
+		declaredType, ok := declaredStorageTypes[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("storage property %s is not declared in meta info", name))
+		} else if declaredType != compiledStorageTypes[name] {
+			errs = append(errs, fmt.Errorf("storage property %s type is %d in meta info but %d in contract", name, declaredType, compiledStorageTypes[name]))
+		}
+	}
+	for _, item := range declared.StoragePropertiesTypes {
+		name := item[0].(string)
+		if _, ok := compiledStorageTypes[name]; !ok {
+			errs = append(errs, fmt.Errorf("storage property %s declared in meta info is not in contract storage", name))
+		}
+	}
+	// contract_api_arg_types
+	declaredArgsTypes, err := apiArgsTypesMap(declared.ApiArgsTypes)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid api args types in meta info: %s", err.Error()))
+		return
+	}
+	compiledArgsTypes, err := apiArgsTypesMap(compiled.ApiArgsTypes)
+	if err != nil {
+		errs = append(errs, err)
+		return
+	}
+	for _, api := range compiled.Apis {
+		declaredArgs, ok := declaredArgsTypes[api]
+		if !ok {
+			if parser.ContainsString(declared.Apis, api) {
+				errs = append(errs, fmt.Errorf("argument types of api %s is not declared in meta info", api))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(declaredArgs, compiledArgsTypes[api]) {
+			errs = append(errs, fmt.Errorf("argument types of api %s is %v in meta info but %v in contract", api, declaredArgs, compiledArgsTypes[api]))
+		}
+	}
+	// event_args_types，旧的元信息文件中没有，这时不检查
+	if declared.EventArgsTypes == nil {
+		return
+	}
+	declaredEventArgsTypes, err := apiArgsTypesMap(declared.EventArgsTypes)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid event args types in meta info: %s", err.Error()))
+		return
+	}
+	compiledEventArgsTypes, err := apiArgsTypesMap(compiled.EventArgsTypes)
+	if err != nil {
+		errs = append(errs, err)
+		return
+	}
+	for _, item := range compiled.EventArgsTypes {
+		event := item[0].(string)
+		declaredArgs, ok := declaredEventArgsTypes[event]
+		if !ok {
+			errs = append(errs, fmt.Errorf("argument types of event %s is not declared in meta info", event))
+		} else if !reflect.DeepEqual(declaredArgs, compiledEventArgsTypes[event]) {
+			errs = append(errs, fmt.Errorf("argument types of event %s is %v in meta info but %v in contract", event, declaredArgs, compiledEventArgsTypes[event]))
+		}
+	}
+	for _, item := range declared.EventArgsTypes {
+		event := item[0].(string)
+		if _, ok := compiledEventArgsTypes[event]; !ok {
+			errs = append(errs, fmt.Errorf("event %s declared in meta info is not declared in contract", event))
+		}
+	}
+	return
+}
+
+func storageTypesMap(storagePropertiesTypes [][]interface{}) (result map[string]int, err error) {
+	result = make(map[string]int)
+	for _, storageInfoPair := range storagePropertiesTypes {
+		if len(storageInfoPair) != 2 {
+			err = errors.New("invalid storage info pairs")
+			return
+		}
+		storageName, ok := storageInfoPair[0].(string)
+		if !ok {
+			err = fmt.Errorf("invalid storage property name %v", storageInfoPair[0])
+			return
+		}
+		result[storageName], err = readMaybeInt(storageInfoPair[1])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func apiArgsTypesMap(apiArgsTypes [][]interface{}) (result map[string][]int, err error) {
+	result = make(map[string][]int)
+	for _, apiArgsInfo := range apiArgsTypes {
+		if len(apiArgsInfo) != 2 {
+			err = errors.New("invalid api args info pairs")
+			return
+		}
+		apiName, ok := apiArgsInfo[0].(string)
+		if !ok {
+			err = fmt.Errorf("invalid api name %v", apiArgsInfo[0])
+			return
+		}
+		// 参数类型可能是[]CodeValueType或者从json读取的[]interface{}
+		apiArgsJson, err2 := json.Marshal(apiArgsInfo[1])
+		if err2 != nil {
+			err = err2
+			return
+		}
+		var apiArgs []interface{}
+		err = json.Unmarshal(apiArgsJson, &apiArgs)
+		if err != nil {
+			return
+		}
+		argTypes := make([]int, 0)
+		for _, apiArg := range apiArgs {
+			argType, err2 := readMaybeInt(apiArg)
+			if err2 != nil {
+				err = err2
+				return
+			}
+			argTypes = append(argTypes, argType)
+		}
+		result[apiName] = argTypes
+	}
+	return
+}
@@ -51,8 +51,9 @@ type CodeInfo struct {
 	Apis                   []string        `json:"api"`
 	OfflineApis            []string        `json:"offline_api"`
 	Events                 []string        `json:"event"`
-	StoragePropertiesTypes [][]interface{} `json:"storage_properties_types"` // list of [storageName, storageTypeInt] pairs
-	ApiArgsTypes           [][]interface{} `json:"api_args_types"`           // list of [apiName, [list of apiArgumentTypes]] pairs
+	StoragePropertiesTypes [][]interface{} `json:"storage_properties_types"`   // list of [storageName, storageTypeInt] pairs
+	ApiArgsTypes           [][]interface{} `json:"api_args_types"`             // list of [apiName, [list of apiArgumentTypes]] pairs
+	EventArgsTypes         [][]interface{} `json:"event_args_types,omitempty"` // list of [eventName, [list of eventArgumentTypes]] pairs of declared events
 }
 
 func (info CodeInfo) IsOfflineApi(apiName string) bool {
@@ -0,0 +1,273 @@
+package packager
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/glualang/gluac/utils"
+)
+
+// 带版本号的.gpc格式:
+// magic(4字节) | 格式版本号(int) | section数量(int) | section...
+// 每个section: tag(int) | flags(1字节) | 数据长度(int) | 数据
+// 读取时跳过不认识的可选section，遇到不认识的必须section时报错，这样新增元信息不会破坏已有的读取方
+const (
+	PACKAGE_FORMAT_LEGACY = 0 // 没有magic和版本号的旧格式
+	PACKAGE_FORMAT_V1     = 1
+
+	CurrentPackageFormatVersion = PACKAGE_FORMAT_V1
+)
+
+var packageMagic = []byte{0x1b, 'G', 'P', 'C'}
+
+type PackageSectionTag int
+
+const (
+	SECTION_BYTECODE                 PackageSectionTag = 1 // 字节码的sha1摘要 + 字节码
+	SECTION_APIS                     PackageSectionTag = 2 // 包含offline apis
+	SECTION_OFFLINE_APIS             PackageSectionTag = 3
+	SECTION_EVENTS                   PackageSectionTag = 4
+	SECTION_STORAGE_PROPERTIES_TYPES PackageSectionTag = 5
+	SECTION_API_ARGS_TYPES           PackageSectionTag = 6
+	SECTION_SOURCE_DIGEST            PackageSectionTag = 7 // 可选，源码的sha1摘要
+	SECTION_COMPILER_VERSION         PackageSectionTag = 8 // 可选
+	SECTION_EVENT_ARGS_TYPES         PackageSectionTag = 9 // 可选，申明了参数类型的event
+)
+
+const (
+	SECTION_FLAG_REQUIRED = 1 // 读取方不认识这个section时不能忽略
+)
+
+func isVersionedPackage(data []byte) bool {
+	return bytes.HasPrefix(data, packageMagic)
+}
+
+func writeSectionToPackage(stream utils.ByteStream, tag PackageSectionTag, flags byte, data []byte) (err error) {
+	err = writeIntToPackage(stream, int(tag))
+	if err != nil {
+		return
+	}
+	err = stream.WriteByte(flags)
+	if err != nil {
+		return
+	}
+	err = writeIntToPackage(stream, len(data))
+	if err != nil {
+		return
+	}
+	_, err = stream.Write(data)
+	return
+}
+
+type packageSection struct {
+	tag   PackageSectionTag
+	flags byte
+	write func(stream utils.ByteStream) error
+}
+
+// 按带版本号的格式打包字节码和合约元信息，contract.Digest会根据字节码重新计算
+func PackageContract(contract *PackagedContract) (result []byte, err error) {
+	if contract.CodeInfo == nil {
+		err = errors.New("package contract need code info")
+		return
+	}
+	codeInfo := contract.CodeInfo
+	sections := []packageSection{
+		{SECTION_BYTECODE, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			bytecodeDigest := sha1.Sum(contract.Bytecode)
+			if _, err := stream.Write(bytecodeDigest[:]); err != nil {
+				return err
+			}
+			_, err := stream.Write(contract.Bytecode)
+			return err
+		}},
+		{SECTION_APIS, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			return writeStringsToPackage(stream, codeInfo.Apis)
+		}},
+		{SECTION_OFFLINE_APIS, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			return writeStringsToPackage(stream, codeInfo.OfflineApis)
+		}},
+		{SECTION_EVENTS, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			return writeStringsToPackage(stream, codeInfo.Events)
+		}},
+		{SECTION_STORAGE_PROPERTIES_TYPES, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			return writeStoragePropertiesTypesToPackage(stream, codeInfo.StoragePropertiesTypes)
+		}},
+		{SECTION_API_ARGS_TYPES, SECTION_FLAG_REQUIRED, func(stream utils.ByteStream) error {
+			return writeApiArgsTypesToPackage(stream, codeInfo.ApiArgsTypes)
+		}},
+	}
+	if len(codeInfo.EventArgsTypes) > 0 {
+		sections = append(sections, packageSection{SECTION_EVENT_ARGS_TYPES, 0, func(stream utils.ByteStream) error {
+			return writeApiArgsTypesToPackage(stream, codeInfo.EventArgsTypes)
+		}})
+	}
+	if len(contract.SourceDigest) > 0 {
+		sourceDigest, decodeErr := hex.DecodeString(contract.SourceDigest)
+		if decodeErr != nil {
+			err = decodeErr
+			return
+		}
+		sections = append(sections, packageSection{SECTION_SOURCE_DIGEST, 0, func(stream utils.ByteStream) error {
+			_, err := stream.Write(sourceDigest)
+			return err
+		}})
+	}
+	if len(contract.CompilerVersion) > 0 {
+		sections = append(sections, packageSection{SECTION_COMPILER_VERSION, 0, func(stream utils.ByteStream) error {
+			return stream.WriteString(contract.CompilerVersion)
+		}})
+	}
+
+	resultBuf := utils.NewSimpleByteStream()
+	_, err = resultBuf.Write(packageMagic)
+	if err != nil {
+		return
+	}
+	err = writeIntToPackage(resultBuf, CurrentPackageFormatVersion)
+	if err != nil {
+		return
+	}
+	err = writeIntToPackage(resultBuf, len(sections))
+	if err != nil {
+		return
+	}
+	for _, section := range sections {
+		sectionBuf := utils.NewSimpleByteStream()
+		err = section.write(sectionBuf)
+		if err != nil {
+			return
+		}
+		err = writeSectionToPackage(resultBuf, section.tag, section.flags, sectionBuf.ToBytes())
+		if err != nil {
+			return
+		}
+	}
+	result = resultBuf.ToBytes()
+	return
+}
+
+// 解析一个已知section的数据到contract中，不认识的tag返回ok=false
+func readPackageSection(contract *PackagedContract, tag PackageSectionTag, data []byte) (ok bool, err error) {
+	reader := &packageReader{data: data}
+	codeInfo := contract.CodeInfo
+	ok = true
+	switch tag {
+	case SECTION_BYTECODE:
+		var digest []byte
+		digest, err = reader.readBytes(sha1.Size)
+		if err != nil {
+			return
+		}
+		var bytecodeContract *PackagedContract
+		bytecodeContract, err = readBytecodeWithDigest(digest, data[sha1.Size:])
+		if err != nil {
+			return
+		}
+		contract.Digest = bytecodeContract.Digest
+		contract.Bytecode = bytecodeContract.Bytecode
+		return
+	case SECTION_APIS:
+		codeInfo.Apis, err = reader.readStrings()
+	case SECTION_OFFLINE_APIS:
+		codeInfo.OfflineApis, err = reader.readStrings()
+	case SECTION_EVENTS:
+		codeInfo.Events, err = reader.readStrings()
+	case SECTION_STORAGE_PROPERTIES_TYPES:
+		codeInfo.StoragePropertiesTypes, err = reader.readStoragePropertiesTypes()
+	case SECTION_API_ARGS_TYPES:
+		codeInfo.ApiArgsTypes, err = reader.readApiArgsTypes()
+	case SECTION_EVENT_ARGS_TYPES:
+		codeInfo.EventArgsTypes, err = reader.readApiArgsTypes()
+	case SECTION_SOURCE_DIGEST:
+		contract.SourceDigest = hex.EncodeToString(data)
+		return
+	case SECTION_COMPILER_VERSION:
+		contract.CompilerVersion = string(data)
+		return
+	default:
+		ok = false
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = reader.checkEnd()
+	return
+}
+
+func unpackageVersionedBytecode(data []byte) (result *PackagedContract, err error) {
+	reader := &packageReader{data: data}
+	_, err = reader.readBytes(len(packageMagic))
+	if err != nil {
+		return
+	}
+	version, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	if version < PACKAGE_FORMAT_V1 || version > CurrentPackageFormatVersion {
+		err = fmt.Errorf("unsupported package format version %d", version)
+		return
+	}
+	sectionsCount, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	contract := &PackagedContract{
+		FormatVersion: version,
+		CodeInfo:      &CodeInfo{},
+	}
+	seenTags := make(map[PackageSectionTag]bool)
+	for i := 0; i < sectionsCount; i++ {
+		var tagValue int
+		tagValue, err = reader.readInt()
+		if err != nil {
+			return
+		}
+		var flagsData []byte
+		flagsData, err = reader.readBytes(1)
+		if err != nil {
+			return
+		}
+		var sectionSize int
+		sectionSize, err = reader.readInt()
+		if err != nil {
+			return
+		}
+		var sectionData []byte
+		sectionData, err = reader.readBytes(sectionSize)
+		if err != nil {
+			return
+		}
+		tag := PackageSectionTag(tagValue)
+		if seenTags[tag] {
+			err = fmt.Errorf("duplicate package section %d", tag)
+			return
+		}
+		seenTags[tag] = true
+		var known bool
+		known, err = readPackageSection(contract, tag, sectionData)
+		if err != nil {
+			err = fmt.Errorf("invalid package section %d: %s", tag, err.Error())
+			return
+		}
+		if !known && flagsData[0]&SECTION_FLAG_REQUIRED != 0 {
+			err = fmt.Errorf("unsupported required package section %d", tag)
+			return
+		}
+	}
+	err = reader.checkEnd()
+	if err != nil {
+		return
+	}
+	if !seenTags[SECTION_BYTECODE] {
+		err = errors.New("package has no bytecode section")
+		return
+	}
+	result = contract
+	return
+}
@@ -1,29 +1,28 @@
 package packager
 
-import "github.com/glualang/gluac/parser"
+import (
+	"fmt"
+
+	"github.com/glualang/gluac/parser"
+)
 
 func DumpCodeInfoFromTypeChecker(checker *parser.TypeChecker) (info *CodeInfo, err error) {
 	rootScope := checker.RootScope
-	if rootScope == nil {
-		return
-	}
-	if len(rootScope.ReturnTypes) < 1 {
-		return
-	}
-	lastReturnType := rootScope.ReturnTypes[len(rootScope.ReturnTypes)-1]
-	if !lastReturnType.IsRecordType() || lastReturnType.RecordType == nil {
+	recordTypeInfo := contractRecordType(checker)
+	if recordTypeInfo == nil {
 		return
 	}
-	recordTypeInfo := lastReturnType.RecordType
 	props := recordTypeInfo.Props
 	apis := make([]string, 0)
 	offlineApis := make([]string, 0)
 	allApis := make([]string, 0)
+	apiTypes := make(map[string]*parser.TypeTreeItem)
 	for _, prop := range props {
 		if prop.PropType.IsFuncType() {
 			propName := prop.PropName
 			apis = append(apis, propName)
 			allApis = append(allApis, propName)
+			apiTypes[propName] = prop.PropType
 			// 如果是offline的方法属性，则也要加入offlineApis
 			if prop.Offline {
 				offlineApis = append(offlineApis, propName)
@@ -33,104 +32,22 @@ func DumpCodeInfoFromTypeChecker(checker *parser.TypeChecker) (info *CodeInfo, e
 	events := checker.Events
 
 	storagePropertiesTypes := make([][]interface{}, 0)
-	// find Storage type
-	storageType, ok := recordTypeInfo.FindProp("storage")
-	if !ok {
-		return
-	}
-	if !storageType.IsRecordType() {
+	storageProps, err := contractStorageProps(rootScope, recordTypeInfo)
+	if err != nil {
 		return
 	}
-	for _, p := range storageType.RecordType.Props {
+	for _, p := range storageProps {
 		// 把propType转换成codeInfo中的typeInt
-		var propTypeInt StorageValueType = SVT_NIL
-		// TODO: p.propType要在binding中进行apply
-		if !p.PropType.IsInnerType() && !p.PropType.IsSimpleNameType() && !p.PropType.IsSimpleNameWithGenericTypesType() {
-			continue
-		}
-		innerTypeName := p.PropType.Name
-		switch innerTypeName {
-		case "bool":
-			{
-				propTypeInt = SVT_BOOL
-			}
-		case "int":
-			{
-				propTypeInt = SVT_INT
-			}
-		case "number":
-			{
-				propTypeInt = SVT_NUMBER
-			}
-		case "string":
-			{
-				propTypeInt = SVT_STRING
-			}
-		case "Map":
-			{
-				if len(p.PropType.GenericTypeParams) < 1 {
-					return
-				}
-				mapParamType := p.PropType.GenericTypeParams[0]
-				switch mapParamType.Name {
-				case "bool":
-					{
-						propTypeInt = SVT_BOOL_TABLE
-					}
-				case "int":
-					{
-						propTypeInt = SVT_INT_TABLE
-					}
-				case "number":
-					{
-						propTypeInt = SVT_NUMBER_TABLE
-					}
-				case "string":
-					{
-						propTypeInt = SVT_STRING_TABLE
-					}
-				default:
-					return
-				}
-			}
-		case "Array":
-			{
-				if len(p.PropType.GenericTypeParams) < 1 {
-					return
-				}
-				mapParamType := p.PropType.GenericTypeParams[0]
-				switch mapParamType.Name {
-				case "bool":
-					{
-						propTypeInt = SVT_BOOL_ARRAY
-					}
-				case "int":
-					{
-						propTypeInt = SVT_INT_ARRAY
-					}
-				case "number":
-					{
-						propTypeInt = SVT_NUMBER_ARRAY
-					}
-				case "string":
-					{
-						propTypeInt = SVT_STRING_ARRAY
-					}
-				default:
-					return
-				}
-			}
-		default:
-			continue
-		}
-		if propTypeInt == SVT_NIL {
-			continue
+		propTypeInt, ok := storageValueTypeOf(rootScope, p.PropType)
+		if !ok {
+			err = fmt.Errorf("storage property %s has type %s which contract storage can't accept", p.PropName, p.PropType.String())
+			return
 		}
 		item := []interface{}{p.PropName, propTypeInt}
 		storagePropertiesTypes = append(storagePropertiesTypes, item)
 	}
 
-	//  set arg type. 并且init，on_deposit, on_deposit_asset, on_upgrade, on_destroy等特殊方法的参数需要特殊处理，其他的参数是字符串的类型
+	//  set arg type. 并且init，on_deposit, on_deposit_asset, on_upgrade, on_destroy等特殊方法的参数需要特殊处理，其他的参数按方法签名的类型
 	apiArgsTypes := make([][]interface{}, 0)
 	for _, api := range allApis {
 		if api == "init" || api == "on_destroy" || api == "on_upgrade" {
@@ -145,7 +62,26 @@ func DumpCodeInfoFromTypeChecker(checker *parser.TypeChecker) (info *CodeInfo, e
 			apiArgsTypes = append(apiArgsTypes, []interface{}{api, []interface{}{LTI_STRING, LTI_INT}})
 			continue
 		}
-		apiArgsTypes = append(apiArgsTypes, []interface{}{api, []interface{}{LTI_STRING}})
+		var argTypes []interface{}
+		argTypes, err = apiArgTypeCodes(rootScope, api, apiTypes[api])
+		if err != nil {
+			return
+		}
+		apiArgsTypes = append(apiArgsTypes, []interface{}{api, argTypes})
+	}
+
+	// event Name(params) 申明了参数类型的event
+	var eventArgsTypes [][]interface{}
+	for _, declaration := range checker.EventDeclarations {
+		if found, _ := checker.FindEventDeclaration(declaration.Name); found != declaration {
+			continue
+		}
+		var argTypes []interface{}
+		argTypes, err = eventArgTypeCodes(rootScope, declaration)
+		if err != nil {
+			return
+		}
+		eventArgsTypes = append(eventArgsTypes, []interface{}{declaration.Name, argTypes})
 	}
 
 	info = &CodeInfo{
@@ -154,6 +90,215 @@ func DumpCodeInfoFromTypeChecker(checker *parser.TypeChecker) (info *CodeInfo, e
 		Events:                 events,
 		StoragePropertiesTypes: storagePropertiesTypes,
 		ApiArgsTypes:           apiArgsTypes,
+		EventArgsTypes:         eventArgsTypes,
+	}
+	return
+}
+
+// 源码最后返回的合约record类型，没有返回record时返回nil
+func contractRecordType(checker *parser.TypeChecker) *parser.RecordTypeInfo {
+	rootScope := checker.RootScope
+	if rootScope == nil || len(rootScope.ReturnTypes) < 1 {
+		return nil
+	}
+	lastReturnType := rootScope.ReturnTypes[len(rootScope.ReturnTypes)-1]
+	if !lastReturnType.IsRecordType() || lastReturnType.RecordType == nil {
+		return nil
+	}
+	return lastReturnType.RecordType
+}
+
+// 合约storage的各个属性. 没有storage属性的合约没有存储字段
+func contractStorageProps(scope *parser.TypeInfoScope, recordTypeInfo *parser.RecordTypeInfo) (result []*parser.RecordTypePropInfo, err error) {
+	storageType, ok := recordTypeInfo.FindProp("storage")
+	if !ok {
+		return
+	}
+	// storage的类型可能是类型重命名或者带泛型参数的类型，展开成实际类型
+	resolvedStorageType := scope.Resolve(storageType)
+	if !resolvedStorageType.IsRecordType() {
+		err = fmt.Errorf("contract storage type %s is not a record", storageType.String())
+		return
+	}
+	result = resolvedStorageType.RecordType.Props
+	return
+}
+
+// storage属性类型的基础类型名称. 字面量类型和同一种基础类型的字面量组成的联合类型按基础类型存储
+func storageTypeName(propType *parser.TypeTreeItem) (name string, ok bool) {
+	switch {
+	case propType.IsInnerType(), propType.IsSimpleNameType(), propType.IsSimpleNameWithGenericTypesType(), propType.IsLiteralType():
+		return propType.Name, true
+	case propType.IsUnionType():
+		for _, item := range propType.UnionTypes {
+			if !item.IsLiteralType() || (len(name) > 0 && item.Name != name) {
+				return "", false
+			}
+			name = item.Name
+		}
+		return name, len(name) > 0
+	}
+	return
+}
+
+// 基础类型对应的storage类型
+func baseStorageValueType(typeName string) (result StorageValueType, ok bool) {
+	switch typeName {
+	case "bool":
+		return SVT_BOOL, true
+	case "int":
+		return SVT_INT, true
+	case "number":
+		return SVT_NUMBER, true
+	case "string":
+		return SVT_STRING, true
+	}
+	return
+}
+
+// storage属性类型对应的storage类型. 别名和泛型会先展开，record和table按未知元素类型的table存储，
+// Map/Array的元素是基础类型时使用对应的table/array类型，元素是嵌套的Map/Array/record时按未知元素类型存储
+func storageValueTypeOf(scope *parser.TypeInfoScope, propType *parser.TypeTreeItem) (result StorageValueType, ok bool) {
+	propType = scope.Resolve(propType)
+	typeName, named := storageTypeName(propType)
+	if !named {
+		if propType.IsRecordType() {
+			return SVT_UNKNOWN_TABLE, true
+		}
+		return
+	}
+	if result, ok = baseStorageValueType(typeName); ok {
+		return
+	}
+	switch typeName {
+	case "table":
+		return SVT_UNKNOWN_TABLE, true
+	case "Map", "Array":
+		unknownType := StorageValueType(SVT_UNKNOWN_TABLE)
+		if typeName == "Array" {
+			unknownType = SVT_UNKNOWN_ARRAY
+		}
+		if len(propType.GenericTypeParams) < 1 {
+			return unknownType, true
+		}
+		var elemType StorageValueType
+		elemType, ok = storageValueTypeOf(scope, propType.GenericTypeParams[0])
+		if !ok {
+			return
+		}
+		if elemType >= SVT_UNKNOWN_TABLE {
+			// 嵌套的table/array
+			return unknownType, true
+		}
+		return unknownType + elemType, true
+	}
+	if propType.IsRecordType() {
+		return SVT_UNKNOWN_TABLE, true
+	}
+	return
+}
+
+// 合约api参数可以使用的类型
+func isApiArgTypeCode(code CodeValueType) bool {
+	switch code {
+	case LTI_STRING, LTI_INT, LTI_NUMBER, LTI_BOOL, LTI_ARRAY, LTI_MAP, LTI_RECORD, LTI_UNION, LTI_LITERIAL_TYPE:
+		return true
+	}
+	return false
+}
+
+// 合约方法的参数，不包括方法隐含的self参数
+func apiParams(apiType *parser.TypeTreeItem) []*parser.FuncTypeParamInfo {
+	params := apiType.FuncTypeParams
+	if len(params) > 0 && params[0].Name == "self" {
+		params = params[1:]
+	}
+	return params
+}
+
+// 根据方法签名得到api参数的类型码. 跳过方法隐含的self参数，没有申明类型的参数当成字符串
+func apiArgTypeCodes(scope *parser.TypeInfoScope, api string, apiType *parser.TypeTreeItem) (result []interface{}, err error) {
+	result = make([]interface{}, 0)
+	for _, param := range apiParams(apiType) {
+		if param.IsDynamicParams {
+			err = fmt.Errorf("api %s can't have variable arguments", api)
+			return
+		}
+		if param.TypeInfo == nil || parser.IsObjectType(param.TypeInfo) {
+			result = append(result, CodeValueType(LTI_STRING))
+			continue
+		}
+		code := TypeInfoCode(scope, param.TypeInfo)
+		if !isApiArgTypeCode(code) {
+			err = fmt.Errorf("argument %s of api %s has type %s which contract api can't accept", param.Name, api, param.TypeInfo.String())
+			return
+		}
+		result = append(result, code)
+	}
+	return
+}
+
+// event申明的参数类型码，没有申明类型的参数是LTI_OBJECT
+func eventArgTypeCodes(scope *parser.TypeInfoScope, declaration *parser.EventDeclaration) (result []interface{}, err error) {
+	result = make([]interface{}, 0)
+	for _, param := range declaration.Params {
+		if param.IsDynamicParams {
+			err = fmt.Errorf("event %s can't have variable arguments", declaration.Name)
+			return
+		}
+		if param.TypeInfo == nil || parser.IsObjectType(param.TypeInfo) {
+			result = append(result, CodeValueType(LTI_OBJECT))
+			continue
+		}
+		result = append(result, TypeInfoCode(scope, param.TypeInfo))
 	}
 	return
 }
+
+// 类型对应的codeInfo中的类型码
+func TypeInfoCode(scope *parser.TypeInfoScope, typeInfo *parser.TypeTreeItem) CodeValueType {
+	typeInfo = scope.Resolve(typeInfo)
+	switch {
+	case typeInfo.IsUnionType():
+		return LTI_UNION
+	case typeInfo.IsLiteralType():
+		return LTI_LITERIAL_TYPE
+	case typeInfo.IsRecordType():
+		return LTI_RECORD
+	case typeInfo.IsFuncType():
+		return LTI_FUNCTION
+	case typeInfo.IsNilType():
+		return LTI_NIL
+	case typeInfo.IsSimpleNameType():
+		return LTI_GENERIC // 没有实例化的泛型参数
+	case typeInfo.IsSimpleNameWithGenericTypesType():
+		switch typeInfo.Name {
+		case "Array":
+			return LTI_ARRAY
+		case "Map":
+			return LTI_MAP
+		}
+	case typeInfo.IsInnerType():
+		switch typeInfo.Name {
+		case "object":
+			return LTI_OBJECT
+		case "string":
+			return LTI_STRING
+		case "int":
+			return LTI_INT
+		case "number":
+			return LTI_NUMBER
+		case "bool":
+			return LTI_BOOL
+		case "table":
+			return LTI_TABLE
+		case "function":
+			return LTI_FUNCTION
+		case "Array":
+			return LTI_ARRAY
+		case "Map":
+			return LTI_MAP
+		}
+	}
+	return LTI_UNDEFINED
+}
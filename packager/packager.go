@@ -44,6 +44,11 @@ func readMaybeInt(value interface{}) (result int, err error) {
 		result = intVal
 		return
 	}
+	storageTypeVal, ok := value.(StorageValueType)
+	if ok {
+		result = int(storageTypeVal)
+		return
+	}
 	int64Val, ok := value.(int64)
 	if ok {
 		result = int(int64Val)
@@ -73,71 +78,32 @@ func readMaybeInt(value interface{}) (result int, err error) {
 	return
 }
 
-// 把字节码和源码中的基本信息(各方法，各方法的参数，主类的各字段类型等)
-func PackageBytecodeWithCodeInfo(bytecode []byte, codeInfo *CodeInfo) (result []byte, err error) {
-	resultBuf := utils.NewSimpleByteStream()
-	// bytecode digest
-	bytecodeDigest := sha1.Sum(bytecode)
-	_, err = resultBuf.Write(bytecodeDigest[:])
-	if err != nil {
-		return
-	}
-	// bytecode
-	err = writeIntToPackage(resultBuf, len(bytecode))
-	if err != nil {
-		return
-	}
-	_, err = resultBuf.Write(bytecode)
-	if err != nil {
-		return
-	}
-	// apis
-	// apis要排除offline apis
-	nonOfflineApis := codeInfo.NonOfflineApis()
-	err = writeIntToPackage(resultBuf, len(nonOfflineApis))
+func writeStringsToPackage(stream utils.ByteStream, items []string) (err error) {
+	err = writeIntToPackage(stream, len(items))
 	if err != nil {
 		return
 	}
-	for _, api := range nonOfflineApis {
-		err = writeStringToPackage(resultBuf, api)
+	for _, item := range items {
+		err = writeStringToPackage(stream, item)
 		if err != nil {
 			return
 		}
 	}
-	// offline_apis
-	err = writeIntToPackage(resultBuf, len(codeInfo.OfflineApis))
-	if err != nil {
-		return
-	}
-	for _, api := range codeInfo.OfflineApis {
-		err = writeStringToPackage(resultBuf, api)
-		if err != nil {
-			return
-		}
-	}
-	// events
-	err = writeIntToPackage(resultBuf, len(codeInfo.Events))
-	if err != nil {
-		return
-	}
-	for _, eventName := range codeInfo.Events {
-		err = writeStringToPackage(resultBuf, eventName)
-		if err != nil {
-			return
-		}
-	}
-	// contract_storage_properties
-	err = writeIntToPackage(resultBuf, len(codeInfo.StoragePropertiesTypes))
+	return
+}
+
+func writeStoragePropertiesTypesToPackage(stream utils.ByteStream, storagePropertiesTypes [][]interface{}) (err error) {
+	err = writeIntToPackage(stream, len(storagePropertiesTypes))
 	if err != nil {
 		return
 	}
-	for _, storageInfoPair := range codeInfo.StoragePropertiesTypes {
+	for _, storageInfoPair := range storagePropertiesTypes {
 		if len(storageInfoPair) != 2 {
 			err = errors.New("invalid storage info pairs")
 			return
 		}
 		storageName := storageInfoPair[0].(string)
-		err = writeStringToPackage(resultBuf, storageName)
+		err = writeStringToPackage(stream, storageName)
 		if err != nil {
 			return
 		}
@@ -146,19 +112,22 @@ func PackageBytecodeWithCodeInfo(bytecode []byte, codeInfo *CodeInfo) (result []
 			err = err2
 			return
 		}
-		err = writeIntToPackage(resultBuf, int(storageType))
+		err = writeIntToPackage(stream, int(storageType))
 		if err != nil {
 			return
 		}
 	}
-	// contract_api_arg_types
-	err = writeIntToPackage(resultBuf, len(codeInfo.ApiArgsTypes))
+	return
+}
+
+func writeApiArgsTypesToPackage(stream utils.ByteStream, apiArgsTypes [][]interface{}) (err error) {
+	err = writeIntToPackage(stream, len(apiArgsTypes))
 	if err != nil {
 		return
 	}
-	for _, apiArgsInfo := range codeInfo.ApiArgsTypes {
+	for _, apiArgsInfo := range apiArgsTypes {
 		apiName := apiArgsInfo[0].(string)
-		err = writeStringToPackage(resultBuf, apiName)
+		err = writeStringToPackage(stream, apiName)
 		if err != nil {
 			return
 		}
@@ -172,7 +141,7 @@ func PackageBytecodeWithCodeInfo(bytecode []byte, codeInfo *CodeInfo) (result []
 		if err != nil {
 			return
 		}
-		err = writeIntToPackage(resultBuf, len(apiArgs))
+		err = writeIntToPackage(stream, len(apiArgs))
 		if err != nil {
 			return
 		}
@@ -182,12 +151,60 @@ func PackageBytecodeWithCodeInfo(bytecode []byte, codeInfo *CodeInfo) (result []
 				err = err2
 				return
 			}
-			err = writeIntToPackage(resultBuf, argInt)
+			err = writeIntToPackage(stream, argInt)
 			if err != nil {
 				return
 			}
 		}
 	}
+	return
+}
+
+// 把字节码和源码中的基本信息(各方法，各方法的参数，主类的各字段类型等)
+// 按旧的没有版本号的格式打包，给还只支持这种格式的链使用
+func PackageBytecodeWithCodeInfo(bytecode []byte, codeInfo *CodeInfo) (result []byte, err error) {
+	resultBuf := utils.NewSimpleByteStream()
+	// bytecode digest
+	bytecodeDigest := sha1.Sum(bytecode)
+	_, err = resultBuf.Write(bytecodeDigest[:])
+	if err != nil {
+		return
+	}
+	// bytecode
+	err = writeIntToPackage(resultBuf, len(bytecode))
+	if err != nil {
+		return
+	}
+	_, err = resultBuf.Write(bytecode)
+	if err != nil {
+		return
+	}
+	// apis
+	// apis要排除offline apis
+	err = writeStringsToPackage(resultBuf, codeInfo.NonOfflineApis())
+	if err != nil {
+		return
+	}
+	// offline_apis
+	err = writeStringsToPackage(resultBuf, codeInfo.OfflineApis)
+	if err != nil {
+		return
+	}
+	// events
+	err = writeStringsToPackage(resultBuf, codeInfo.Events)
+	if err != nil {
+		return
+	}
+	// contract_storage_properties
+	err = writeStoragePropertiesTypesToPackage(resultBuf, codeInfo.StoragePropertiesTypes)
+	if err != nil {
+		return
+	}
+	// contract_api_arg_types
+	err = writeApiArgsTypesToPackage(resultBuf, codeInfo.ApiArgsTypes)
+	if err != nil {
+		return
+	}
 	result = resultBuf.ToBytes()
 	return
 }
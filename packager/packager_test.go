@@ -1,10 +1,28 @@
 package packager
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"log"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/glualang/gluac/parser"
+	"github.com/glualang/gluac/utils"
 )
 
+// 编译合约源码，declarations中申明Storage等类型，methods中是M的方法
+func compileContract(t *testing.T, declarations string, methods string) *parser.TypeChecker {
+	source := "type Contract<T> = {\n    storage: T\n}\n" + declarations +
+		"\nvar M = Contract<Storage>()\n" + methods + "\nreturn M\n"
+	_, typeChecker, _, err := parser.Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typeChecker
+}
+
 func TestPackageBytecodeWithCodeInfo(t *testing.T)  {
 	bytecode := []byte {1,2,3}
 	codeInfo := &CodeInfo{
@@ -20,4 +38,359 @@ func TestPackageBytecodeWithCodeInfo(t *testing.T)  {
 		return
 	}
 	log.Printf("package result %x", result)
-}
\ No newline at end of file
+}
+
+func TestDumpGenericStorageTypes(t *testing.T) {
+	typeChecker := compileContract(t, `type GenericStorage<T> = {
+    name: T,
+    scores: Map<T>
+}
+type Storage = GenericStorage<int>`, `function M:init()
+end`)
+	info, err := DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil || info == nil {
+		t.Fatalf("dump code info failed %v", err)
+	}
+	expected := [][]interface{}{{"name", StorageValueType(SVT_INT)}, {"scores", StorageValueType(SVT_INT_TABLE)}}
+	if !reflect.DeepEqual(info.StoragePropertiesTypes, expected) {
+		t.Errorf("unexpected storage properties types %v", info.StoragePropertiesTypes)
+	}
+}
+
+func TestTypeInfoCode(t *testing.T) {
+	typeChecker := compileContract(t, `type Gender = "Male" | "Female"
+type Person = { name: string }
+type Storage = {
+    gender: Gender,
+    genders: Map<Gender>
+}`, "")
+	scope := typeChecker.RootScope
+	expected := map[string]CodeValueType{
+		"Gender": LTI_UNION,
+		"Person": LTI_RECORD,
+		"int":    LTI_INT,
+		"Map":    LTI_MAP,
+	}
+	for name, code := range expected {
+		typeInfo, _, _, _ := scope.Lookup(name)
+		if result := TypeInfoCode(scope, typeInfo); result != code {
+			t.Errorf("expected type code %d of %s but got %d", code, name, result)
+		}
+	}
+	info, err := DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil || info == nil {
+		t.Fatalf("dump code info failed %v", err)
+	}
+	storageTypes := [][]interface{}{{"gender", StorageValueType(SVT_STRING)}, {"genders", StorageValueType(SVT_STRING_TABLE)}}
+	if !reflect.DeepEqual(info.StoragePropertiesTypes, storageTypes) {
+		t.Errorf("unexpected storage properties types %v", info.StoragePropertiesTypes)
+	}
+}
+
+func TestDumpApiArgsTypes(t *testing.T) {
+	typeChecker := compileContract(t, `type Storage = {
+    name: string
+}`, `function M:init()
+end
+function M:transfer(to: string, amount: int, memo)
+end
+function M:vote(ok: bool, weight: number)
+end`)
+	info, err := DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil || info == nil {
+		t.Fatalf("dump code info failed %v", err)
+	}
+	expected := map[string][]CodeValueType{
+		"init":     {},
+		"transfer": {LTI_STRING, LTI_INT, LTI_STRING},
+		"vote":     {LTI_BOOL, LTI_NUMBER},
+	}
+	for _, item := range info.ApiArgsTypes {
+		name := item[0].(string)
+		var codes []CodeValueType
+		for _, code := range item[1].([]interface{}) {
+			codes = append(codes, code.(CodeValueType))
+		}
+		if len(codes) != len(expected[name]) || (len(codes) > 0 && !reflect.DeepEqual(codes, expected[name])) {
+			t.Errorf("unexpected args types of api %s: %v", name, codes)
+		}
+	}
+
+	typeChecker = compileContract(t, `type Storage = {
+    name: string
+}`, `function M:callback(f: (x: int) => int)
+end`)
+	_, err = DumpCodeInfoFromTypeChecker(typeChecker)
+	if err == nil || !strings.Contains(err.Error(), "callback") {
+		t.Errorf("expected api arg type error but got %v", err)
+	}
+}
+
+func TestUnpackageBytecode(t *testing.T) {
+	bytecode := []byte{1, 2, 3}
+	codeInfo := &CodeInfo{
+		Apis:                   []string{"init", "hello", "query"},
+		OfflineApis:            []string{"query"},
+		Events:                 []string{"Init", "Upgrade"},
+		StoragePropertiesTypes: [][]interface{}{{"name", SVT_STRING}},
+		ApiArgsTypes:           [][]interface{}{{"init", []CodeValueType{}}, {"query", []CodeValueType{LTI_STRING, LTI_INT}}},
+	}
+	packaged, err := PackageBytecodeWithCodeInfo(bytecode, codeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := UnpackageBytecode(packaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(contract.Bytecode, bytecode) {
+		t.Errorf("unexpected bytecode %v", contract.Bytecode)
+	}
+	if !reflect.DeepEqual(contract.CodeInfo.Apis, codeInfo.Apis) || !reflect.DeepEqual(contract.CodeInfo.OfflineApis, codeInfo.OfflineApis) {
+		t.Errorf("unexpected apis %v %v", contract.CodeInfo.Apis, contract.CodeInfo.OfflineApis)
+	}
+	if !reflect.DeepEqual(contract.CodeInfo.Events, codeInfo.Events) {
+		t.Errorf("unexpected events %v", contract.CodeInfo.Events)
+	}
+	if !reflect.DeepEqual(contract.CodeInfo.StoragePropertiesTypes, [][]interface{}{{"name", StorageValueType(SVT_STRING)}}) {
+		t.Errorf("unexpected storage properties types %v", contract.CodeInfo.StoragePropertiesTypes)
+	}
+	if !reflect.DeepEqual(contract.CodeInfo.ApiArgsTypes, codeInfo.ApiArgsTypes) {
+		t.Errorf("unexpected api args types %v", contract.CodeInfo.ApiArgsTypes)
+	}
+
+	if _, err = UnpackageBytecode(packaged[:len(packaged)-1]); err == nil {
+		t.Error("expected truncated package error")
+	}
+	// 字节码被篡改时摘要校验失败
+	packaged[sha1.Size+4]++
+	if _, err = UnpackageBytecode(packaged); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("expected digest mismatch error but got %v", err)
+	}
+}
+
+func TestPackageContractVersioned(t *testing.T) {
+	contract := &PackagedContract{
+		Bytecode: []byte{1, 2, 3},
+		CodeInfo: &CodeInfo{
+			Apis:                   []string{"init", "query"},
+			OfflineApis:            []string{"query"},
+			Events:                 []string{"Transfer"},
+			StoragePropertiesTypes: [][]interface{}{{"name", StorageValueType(SVT_STRING)}},
+			ApiArgsTypes:           [][]interface{}{{"init", []CodeValueType{}}, {"query", []CodeValueType{LTI_INT}}},
+		},
+		SourceDigest:    "0102030405060708090a0b0c0d0e0f1011121314",
+		CompilerVersion: "test",
+	}
+	packaged, err := PackageContract(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := UnpackageBytecode(packaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FormatVersion != CurrentPackageFormatVersion || result.SourceDigest != contract.SourceDigest || result.CompilerVersion != contract.CompilerVersion {
+		t.Errorf("unexpected package header info %v %s %s", result.FormatVersion, result.SourceDigest, result.CompilerVersion)
+	}
+	if !reflect.DeepEqual(result.Bytecode, contract.Bytecode) || !reflect.DeepEqual(result.CodeInfo, contract.CodeInfo) {
+		t.Errorf("unexpected unpackaged contract %v %v", result.Bytecode, result.CodeInfo)
+	}
+
+	// 读取时跳过不认识的可选section，不认识的必须section报错
+	withExtraSection := func(flags byte) []byte {
+		stream := utils.NewSimpleByteStream()
+		_, _ = stream.Write(packaged)
+		_ = writeSectionToPackage(stream, PackageSectionTag(100), flags, []byte("extra"))
+		data := stream.ToBytes()
+		data[len(packageMagic)+7]++ // section数量
+		return data
+	}
+	if _, err = UnpackageBytecode(withExtraSection(0)); err != nil {
+		t.Errorf("unknown optional section should be skipped but got %v", err)
+	}
+	if _, err = UnpackageBytecode(withExtraSection(SECTION_FLAG_REQUIRED)); err == nil {
+		t.Error("expected unsupported required section error")
+	}
+}
+
+func TestDumpNestedStorageTypes(t *testing.T) {
+	typeChecker := compileContract(t, `type Person = {
+    name: string
+}
+type Names = Array<string>
+type Storage = {
+    owner: Person,
+    names: Names,
+    groups: Map<Array<int>>,
+    people: Array<Person>,
+    config: table
+}`, "")
+	info, err := DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil || info == nil {
+		t.Fatalf("dump code info failed %v", err)
+	}
+	expected := [][]interface{}{
+		{"owner", StorageValueType(SVT_UNKNOWN_TABLE)},
+		{"names", StorageValueType(SVT_STRING_ARRAY)},
+		{"groups", StorageValueType(SVT_UNKNOWN_TABLE)},
+		{"people", StorageValueType(SVT_UNKNOWN_ARRAY)},
+		{"config", StorageValueType(SVT_UNKNOWN_TABLE)},
+	}
+	if !reflect.DeepEqual(info.StoragePropertiesTypes, expected) {
+		t.Errorf("unexpected storage properties types %v", info.StoragePropertiesTypes)
+	}
+
+	typeChecker = compileContract(t, `type Storage = {
+    name: string,
+    callback: (x: int) => int
+}`, "")
+	_, err = DumpCodeInfoFromTypeChecker(typeChecker)
+	if err == nil || !strings.Contains(err.Error(), "callback") {
+		t.Errorf("expected storage property type error but got %v", err)
+	}
+}
+
+func TestCheckCodeInfo(t *testing.T) {
+	compiled := &CodeInfo{
+		Apis:                   []string{"init", "setName", "query"},
+		OfflineApis:            []string{"query"},
+		Events:                 []string{"NameChanged"},
+		StoragePropertiesTypes: [][]interface{}{{"name", StorageValueType(SVT_STRING)}},
+		ApiArgsTypes:           [][]interface{}{{"init", []interface{}{}}, {"setName", []interface{}{CodeValueType(LTI_STRING)}}, {"query", []interface{}{CodeValueType(LTI_STRING)}}},
+	}
+	var declared CodeInfo
+	err := json.Unmarshal([]byte(`{
+  "api": ["init", "setName", "query"],
+  "offline_api": ["query"],
+  "event": ["NameChanged"],
+  "storage_properties_types": [["name", 4]],
+  "api_args_types": [["init", []], ["setName", [2]], ["query", [2]]]
+}`), &declared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, errs := CheckCodeInfo(&declared, compiled)
+	if len(warnings) > 0 || len(errs) > 0 {
+		t.Errorf("unexpected check result %v %v", warnings, errs)
+	}
+
+	err = json.Unmarshal([]byte(`{
+  "api": ["init", "setName", "query", "transfer"],
+  "offline_api": [],
+  "event": ["NameChanged", "Transfer"],
+  "storage_properties_types": [["name", 2]],
+  "api_args_types": [["init", []], ["setName", [3]], ["query", [2]]]
+}`), &declared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, errs = CheckCodeInfo(&declared, compiled)
+	expectedWarnings := []string{"event Transfer declared in meta info is never emitted"}
+	expectedErrs := []string{
+		"api query offline is false in meta info but true in contract",
+		"api transfer declared in meta info is not defined in contract",
+		"storage property name type is 2 in meta info but 4 in contract",
+		"argument types of api setName is [3] in meta info but [2] in contract",
+	}
+	if len(warnings) != len(expectedWarnings) || len(errs) != len(expectedErrs) {
+		t.Fatalf("unexpected check result %v %v", warnings, errs)
+	}
+	for i, warning := range warnings {
+		if warning.Error() != expectedWarnings[i] {
+			t.Errorf("expected warning %s but got %s", expectedWarnings[i], warning.Error())
+		}
+	}
+	for i, e := range errs {
+		if e.Error() != expectedErrs[i] {
+			t.Errorf("expected error %s but got %s", expectedErrs[i], e.Error())
+		}
+	}
+}
+
+func TestDumpContractAbi(t *testing.T) {
+	typeChecker := compileContract(t, `type Storage = {
+    -- 合约名称
+    name: string,
+    scores: Map<int>, -- 不是文档注释
+    count: int
+}
+event Cleared(by: string)`, `
+-- 设置名称
+-- 会emit NameChanged
+function M:setName(name: string, times: int)
+    self.storage.name = name
+    emit NameChanged(name, times)
+end
+
+local x = 1 -- 不是文档注释
+offline function M:query(key)
+    emit Queried(key, 1)
+    emit Queried(key, "a")
+    return self.storage.name
+end
+function M:size()
+    if self.storage.count > 1 then
+        return 2
+    end
+    return 0
+end
+function M:load()
+    return loadValue()
+end`)
+	abi, err := DumpContractAbi(typeChecker)
+	if err != nil || abi == nil {
+		t.Fatalf("dump abi failed %v", err)
+	}
+	abiJson, err := json.Marshal(abi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"methods":[` +
+		`{"name":"setName","offline":false,"params":[{"name":"name","type":{"name":"string","code":2}},{"name":"times","type":{"name":"int","code":3}}],"doc":"设置名称\n会emit NameChanged"},` +
+		`{"name":"query","offline":true,"params":[{"name":"key","type":{"name":"string","code":2}}],"returns":{"name":"string","code":2}},` +
+		`{"name":"size","offline":false,"params":[],"returns":{"name":"int","code":3}},` +
+		`{"name":"load","offline":false,"params":[],"returns":{"name":"object","code":0}}],` +
+		`"events":[{"name":"NameChanged","params":[{"name":"","type":{"name":"string","code":2}},{"name":"","type":{"name":"int","code":3}}]},` +
+		`{"name":"Queried","params":[{"name":"","type":{"name":"object","code":0}},{"name":"","type":{"name":"object","code":0}}]},` +
+		`{"name":"Cleared","params":[{"name":"by","type":{"name":"string","code":2}}]}],` +
+		`"storage":[{"name":"name","type":{"name":"string","code":2},"storage_type":4,"doc":"合约名称"},` +
+		`{"name":"scores","type":{"name":"Map\u003cint\u003e","code":12,"items":{"name":"int","code":3}},"storage_type":51},` +
+		`{"name":"count","type":{"name":"int","code":3},"storage_type":1}]}`
+	if string(abiJson) != expected {
+		t.Errorf("unexpected abi %s", string(abiJson))
+	}
+}
+
+func TestDumpEventArgsTypes(t *testing.T) {
+	typeChecker := compileContract(t, `type Storage = {
+    name: string
+}
+event Transfer(to: string, amount: int)
+event Paused()`, `function M:transfer(to: string, amount: int)
+    emit Transfer(to, amount)
+end`)
+	info, err := DumpCodeInfoFromTypeChecker(typeChecker)
+	if err != nil || info == nil {
+		t.Fatalf("dump code info failed %v", err)
+	}
+	expected := [][]interface{}{
+		{"Transfer", []interface{}{CodeValueType(LTI_STRING), CodeValueType(LTI_INT)}},
+		{"Paused", []interface{}{}},
+	}
+	if !reflect.DeepEqual(info.EventArgsTypes, expected) {
+		t.Errorf("unexpected event args types %v", info.EventArgsTypes)
+	}
+	packaged, err := PackageContract(&PackagedContract{Bytecode: []byte{1}, CodeInfo: info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := UnpackageBytecode(packaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, errs := CheckCodeInfo(contract.CodeInfo, info)
+	if len(warnings) > 0 || len(errs) > 0 {
+		t.Errorf("unpackaged code info doesn't match %v %v", warnings, errs)
+	}
+}
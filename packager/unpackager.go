@@ -0,0 +1,213 @@
+package packager
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// 从.gpc文件中解析出的字节码和合约元信息
+type PackagedContract struct {
+	FormatVersion   int       `json:"format_version"` // 旧格式是PACKAGE_FORMAT_LEGACY
+	Digest          string    `json:"digest"`         // 字节码的sha1摘要，hex格式
+	Bytecode        []byte    `json:"bytecode"`
+	CodeInfo        *CodeInfo `json:"code_info"`
+	SourceDigest    string    `json:"source_digest,omitempty"` // 源码的sha1摘要，hex格式，只有带版本号的格式有
+	CompilerVersion string    `json:"compiler_version,omitempty"`
+}
+
+// 按PackageBytecodeWithCodeInfo的格式顺序读取package内容
+type packageReader struct {
+	data     []byte
+	position int
+}
+
+func (reader *packageReader) readBytes(size int) (result []byte, err error) {
+	if size < 0 || reader.position+size > len(reader.data) {
+		err = fmt.Errorf("unexpected end of package at offset %d", reader.position)
+		return
+	}
+	result = reader.data[reader.position : reader.position+size]
+	reader.position += size
+	return
+}
+
+func (reader *packageReader) readInt() (result int, err error) {
+	// 高位在前,大端序
+	data, err := reader.readBytes(4)
+	if err != nil {
+		return
+	}
+	result = int(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3]))
+	return
+}
+
+func (reader *packageReader) readString() (result string, err error) {
+	size, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	data, err := reader.readBytes(size)
+	if err != nil {
+		return
+	}
+	result = string(data)
+	return
+}
+
+func (reader *packageReader) readStrings() (result []string, err error) {
+	count, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	result = make([]string, 0)
+	for i := 0; i < count; i++ {
+		var item string
+		item, err = reader.readString()
+		if err != nil {
+			return
+		}
+		result = append(result, item)
+	}
+	return
+}
+
+func (reader *packageReader) readStoragePropertiesTypes() (result [][]interface{}, err error) {
+	storageCount, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	result = make([][]interface{}, 0)
+	for i := 0; i < storageCount; i++ {
+		var storageName string
+		storageName, err = reader.readString()
+		if err != nil {
+			return
+		}
+		var storageType int
+		storageType, err = reader.readInt()
+		if err != nil {
+			return
+		}
+		result = append(result, []interface{}{storageName, StorageValueType(storageType)})
+	}
+	return
+}
+
+func (reader *packageReader) readApiArgsTypes() (result [][]interface{}, err error) {
+	apiCount, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	result = make([][]interface{}, 0)
+	for i := 0; i < apiCount; i++ {
+		var apiName string
+		apiName, err = reader.readString()
+		if err != nil {
+			return
+		}
+		var argsCount int
+		argsCount, err = reader.readInt()
+		if err != nil {
+			return
+		}
+		argTypes := make([]CodeValueType, 0)
+		for j := 0; j < argsCount; j++ {
+			var argType int
+			argType, err = reader.readInt()
+			if err != nil {
+				return
+			}
+			argTypes = append(argTypes, CodeValueType(argType))
+		}
+		result = append(result, []interface{}{apiName, argTypes})
+	}
+	return
+}
+
+func (reader *packageReader) checkEnd() error {
+	if reader.position != len(reader.data) {
+		return fmt.Errorf("unexpected %d trailing bytes in package", len(reader.data)-reader.position)
+	}
+	return nil
+}
+
+// 读取sha1摘要和字节码并校验摘要
+func readBytecodeWithDigest(digest []byte, bytecode []byte) (result *PackagedContract, err error) {
+	bytecodeDigest := sha1.Sum(bytecode)
+	if !bytes.Equal(digest, bytecodeDigest[:]) {
+		err = errors.New("bytecode digest mismatch")
+		return
+	}
+	result = &PackagedContract{
+		Digest:   hex.EncodeToString(digest),
+		Bytecode: bytecode,
+		CodeInfo: &CodeInfo{},
+	}
+	return
+}
+
+// 解析.gpc文件，以magic开头的是带版本号的格式，否则按PackageBytecodeWithCodeInfo生成的旧格式解析
+func UnpackageBytecode(data []byte) (result *PackagedContract, err error) {
+	if isVersionedPackage(data) {
+		return unpackageVersionedBytecode(data)
+	}
+	return unpackageLegacyBytecode(data)
+}
+
+// 旧格式的package中apis不包含offline apis，解析出的CodeInfo.Apis会把offline apis加回去
+func unpackageLegacyBytecode(data []byte) (result *PackagedContract, err error) {
+	reader := &packageReader{data: data}
+	digest, err := reader.readBytes(sha1.Size)
+	if err != nil {
+		return
+	}
+	bytecodeSize, err := reader.readInt()
+	if err != nil {
+		return
+	}
+	bytecode, err := reader.readBytes(bytecodeSize)
+	if err != nil {
+		return
+	}
+	contract, err := readBytecodeWithDigest(digest, bytecode)
+	if err != nil {
+		return
+	}
+	contract.FormatVersion = PACKAGE_FORMAT_LEGACY
+	codeInfo := contract.CodeInfo
+	// apis
+	codeInfo.Apis, err = reader.readStrings()
+	if err != nil {
+		return
+	}
+	// offline_apis
+	codeInfo.OfflineApis, err = reader.readStrings()
+	if err != nil {
+		return
+	}
+	codeInfo.Apis = append(codeInfo.Apis, codeInfo.OfflineApis...)
+	// events
+	codeInfo.Events, err = reader.readStrings()
+	if err != nil {
+		return
+	}
+	// contract_storage_properties
+	codeInfo.StoragePropertiesTypes, err = reader.readStoragePropertiesTypes()
+	if err != nil {
+		return
+	}
+	// contract_api_arg_types
+	codeInfo.ApiArgsTypes, err = reader.readApiArgsTypes()
+	if err != nil {
+		return
+	}
+	err = reader.checkEnd()
+	if err != nil {
+		return
+	}
+	result = contract
+	return
+}
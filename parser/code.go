@@ -96,7 +96,17 @@ type exprDesc struct {
 
 	symbol string // 当是单符号变量时用这个
 	fieldName string // 当是a.b或者a:b时的b是这个fieldName
+	fieldObjectType *TypeTreeItem // 当是a.b时a的类型
+	typeOfSymbol string // 当是type(x)的调用时的x
+	typeTest *typeTest // 当是type(x) == "string"这类条件时的类型判断
 	exprGuessType *TypeTreeItem // 此表达式推导时被标注的可能的编译器类型
+	sourceRange SourceRange // 表达式在源码中的范围
+}
+
+// if type(x) == "string" then 这类条件中对变量x的类型判断
+type typeTest struct {
+	symbol      string
+	luaTypeName string
 }
 
 func (e *exprDesc) isZero() bool {
@@ -1244,6 +1254,7 @@ func (f *function) SingleVariable(name string) (e exprDesc) {
 		e, found = singleVariableHelper(f, "_ENV", true)
 		f.assert(found && (e.kind == kindLocal || e.kind == kindUpValue))
 		e = f.Indexed(e, f.EncodeString(name))
+		e.symbol = name // 全局变量
 	}
 	return
 }
@@ -57,7 +57,82 @@ func (p *parser) genAnnoyRecordFunc(protoName string, line int) exprDesc {
 	return p.function.CloseFunction()
 }
 
-// 产生record的构造函数的指令
+// 产生record的构造函数的指令. 有属性默认值时，构造函数给参数table中没有的属性赋默认值
 func (p *parser) genRecordFunc(recordInfo *RecordTypeInfo, line int) exprDesc {
-	return p.genAnnoyRecordFunc(recordInfo.Name, line)
+	var defaultProps []*RecordTypePropInfo
+	for _, prop := range recordInfo.Props {
+		if prop.DefaultValue != nil {
+			defaultProps = append(defaultProps, prop)
+		}
+	}
+	if len(defaultProps) < 1 {
+		return p.genAnnoyRecordFunc(recordInfo.Name, line)
+	}
+	p.function.OpenFunction(line)
+	propsVarName := "props"
+	p.function.MakeLocalVariable(propsVarName)
+	p.function.AdjustLocalVariables(1)
+
+	p.function.f.parameterCount = 1
+	p.function.ReserveRegisters(p.function.f.parameterCount)
+
+	p.enterLevel() // enter record func body
+	f := p.function
+	f.f.name = recordInfo.Name
+	// 函数体逻辑是
+	// if not props then props = {} end
+	// if props.name == nil then props.name = defaultValue end
+	// return props
+	propsCheckE := f.GoIfFalse(f.SingleVariable(propsVarName))
+	f.EnterBlock(false)
+	f.StoreVariable(f.SingleVariable(propsVarName), p.genEmptyTable(), false)
+	f.LeaveBlock()
+	f.PatchToHere(propsCheckE.t)
+
+	for _, prop := range defaultProps {
+		propE := p.genPropsField(propsVarName, prop.PropName)
+		propE = f.Infix(oprEq, propE)
+		conditionE := f.Postfix(oprEq, propE, makeExpression(kindNil, 0), p.lineNumber)
+		conditionE = f.GoIfTrue(conditionE)
+		f.EnterBlock(false)
+		f.StoreVariable(p.genPropsField(propsVarName, prop.PropName), p.genLiteral(prop.DefaultValue), false)
+		f.LeaveBlock()
+		f.PatchToHere(conditionE.f)
+	}
+
+	f.Return(f.SingleVariable(propsVarName), 1)
+
+	p.leaveLevel() // end record func body
+
+	f.f.lastLineDefined = p.lineNumber
+	return f.CloseFunction()
+}
+
+// 生成 tableVarName.fieldName 的表达式
+func (p *parser) genPropsField(tableVarName string, fieldName string) exprDesc {
+	tableE := p.function.ExpressionToAnyRegisterOrUpValue(p.function.SingleVariable(tableVarName))
+	return p.function.Indexed(tableE, p.function.EncodeString(fieldName))
+}
+
+// 生成字面量的表达式，value的类型和RecordTypePropInfo.DefaultValue一致
+func (p *parser) genLiteral(value interface{}) (e exprDesc) {
+	switch v := value.(type) {
+	case int64:
+		e = makeExpression(kindInt, 0)
+		e.intValue = v
+	case float64:
+		e = makeExpression(kindNumber, 0)
+		e.value = v
+	case string:
+		e = p.function.EncodeString(v)
+	case bool:
+		if v {
+			e = makeExpression(kindTrue, 0)
+		} else {
+			e = makeExpression(kindFalse, 0)
+		}
+	default:
+		e = makeExpression(kindNil, 0)
+	}
+	return
 }
@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 执行record构造函数的字节码，只支持构造函数中用到的指令
+func runRecordConstructor(t *testing.T, proto *Prototype, props map[string]value) map[string]value {
+	registers := make([]value, proto.maxStackSize)
+	if props != nil {
+		registers[0] = props
+	}
+	rk := func(x int) value {
+		if isConstant(x) {
+			return proto.constants[constantIndex(x)]
+		}
+		return registers[x]
+	}
+	for pc := 0; pc < len(proto.code); pc++ {
+		i := proto.code[pc]
+		switch i.opCode() {
+		case opTest:
+			truthy := registers[i.a()] != nil && registers[i.a()] != false
+			if truthy != (i.c() != 0) {
+				pc++
+			}
+		case opJump:
+			pc += i.sbx()
+		case opNewTable:
+			registers[i.a()] = make(map[string]value)
+		case opMove:
+			registers[i.a()] = registers[i.b()]
+		case opGetTable:
+			registers[i.a()] = registers[i.b()].(map[string]value)[rk(i.c()).(string)]
+		case opEqual:
+			if (rk(i.b()) == rk(i.c())) != (i.a() != 0) {
+				pc++
+			}
+		case opSetTable:
+			registers[i.a()].(map[string]value)[rk(i.b()).(string)] = rk(i.c())
+		case opReturn:
+			return registers[i.a()].(map[string]value)
+		default:
+			t.Fatalf("unexpected instruction %s at pc %d of record constructor", OpNames[i.opCode()], pc)
+		}
+	}
+	t.Fatal("record constructor didn't return")
+	return nil
+}
+
+func TestRecordConstructorDefaults(t *testing.T) {
+	source := `type Person = {
+    name: string,
+    verified: bool default true,
+    age: int default 18,
+    rate: number default 1.5,
+    title: string default "member"
+}
+return Person
+`
+	proto, _, _, err := Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proto.prototypes) != 1 {
+		t.Fatalf("expected 1 record constructor but got %d functions", len(proto.prototypes))
+	}
+	constructor := &proto.prototypes[0]
+	defaults := map[string]value{"verified": true, "age": int64(18), "rate": 1.5, "title": "member"}
+
+	if result := runRecordConstructor(t, constructor, nil); !reflect.DeepEqual(result, defaults) {
+		t.Errorf("Person() expected %v but got %v", defaults, result)
+	}
+	result := runRecordConstructor(t, constructor, map[string]value{"name": "alice", "title": "admin"})
+	expected := map[string]value{"name": "alice", "verified": true, "age": int64(18), "rate": 1.5, "title": "admin"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Person with missing props expected %v but got %v", expected, result)
+	}
+	// 显式传入的false和0不能被默认值覆盖
+	result = runRecordConstructor(t, constructor, map[string]value{"verified": false, "age": int64(0), "rate": 0.0})
+	expected = map[string]value{"verified": false, "age": int64(0), "rate": 0.0, "title": "member"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Person with false and 0 props expected %v but got %v", expected, result)
+	}
+}
@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 编译诊断信息，parser/scanner/type checker中的错误和警告都用这个结构返回给调用方
+
+type DiagnosticSeverity int
+
+const (
+	SeverityError DiagnosticSeverity = iota
+	SeverityWarning
+)
+
+func (severity DiagnosticSeverity) String() string {
+	switch severity {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+type Diagnostic struct {
+	File      string             `json:"file"`
+	Line      int                `json:"line"`
+	Column    int                `json:"column"`
+	EndLine   int                `json:"end_line,omitempty"`   // 出错范围的结束位置，没有范围时为0
+	EndColumn int                `json:"end_column,omitempty"` // 结束列号，指向范围后的第一个字符
+	Token     string             `json:"token,omitempty"`      // 出错位置附近的token，没有时为空
+	Message   string             `json:"message"`
+	Severity  DiagnosticSeverity `json:"severity"`
+}
+
+func newRangeDiagnostic(file string, sourceRange SourceRange, message string, severity DiagnosticSeverity) *Diagnostic {
+	return &Diagnostic{
+		File:      file,
+		Line:      sourceRange.Start.Line,
+		Column:    sourceRange.Start.Column,
+		EndLine:   sourceRange.End.Line,
+		EndColumn: sourceRange.End.Column,
+		Message:   message,
+		Severity:  severity,
+	}
+}
+
+func (d *Diagnostic) Error() string {
+	message := d.Message
+	if len(d.Token) > 0 {
+		message = fmt.Sprintf("%s near %s", message, d.Token)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity.String(), message)
+}
+
+// 显示出错的源码行，并在出错范围下面用^~~~标出来. 找不到对应的源码行时返回空字符串
+func (d *Diagnostic) SourceExcerpt(source []byte) string {
+	lines := strings.Split(string(source), "\n")
+	if d.Line < 1 || d.Line > len(lines) {
+		return ""
+	}
+	line := strings.TrimRight(lines[d.Line-1], "\r")
+	if d.Column < 1 || d.Column > len(line)+1 {
+		return line
+	}
+	endColumn := d.Column + 1
+	if d.EndLine > d.Line {
+		endColumn = len(line) + 1
+	} else if d.EndLine == d.Line && d.EndColumn > d.Column {
+		endColumn = d.EndColumn
+	}
+	if endColumn > len(line)+1 {
+		endColumn = len(line) + 1
+	}
+	var marker strings.Builder
+	for _, c := range line[:d.Column-1] {
+		if c == '\t' {
+			marker.WriteRune('\t')
+		} else {
+			marker.WriteRune(' ')
+		}
+	}
+	marker.WriteRune('^')
+	for i := d.Column + 1; i < endColumn; i++ {
+		marker.WriteRune('~')
+	}
+	return line + "\n" + marker.String()
+}
+
+// 编译器内部错误(断言失败等)，和源码中的语法错误区分开
+var InternalCompilerError = errors.New("internal compiler error")
+
+// diagnostics中是否有error级别的诊断
+func HasErrorDiagnostic(diagnostics []*Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// 把parse过程中panic抛出的值转换成诊断信息
+func (p *parser) recoverDiagnostic(recovered interface{}) *Diagnostic {
+	if d, ok := recovered.(*Diagnostic); ok {
+		return d
+	}
+	var message string
+	if err, ok := recovered.(error); ok {
+		message = err.Error()
+	} else {
+		message = fmt.Sprintf("%v", recovered)
+	}
+	return &Diagnostic{
+		File:     p.source,
+		Line:     p.lineNumber,
+		Column:   p.currentColumn(),
+		Message:  InternalCompilerError.Error() + ": " + message,
+		Severity: SeverityError,
+	}
+}
+
+// Compile 把源码编译成Prototype和类型信息，语法错误不会退出进程，而是以Diagnostic列表返回.
+// 有error级别的诊断时err不为nil，这时返回的Prototype可能不完整
+func Compile(r io.ByteReader, name string) (proto *Prototype, typeChecker *TypeChecker, diagnostics []*Diagnostic, err error) {
+	p := newParser(r, name)
+	typeChecker = p.typeChecker
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				diagnostics = append(diagnostics, p.recoverDiagnostic(recovered))
+			}
+		}()
+		proto = p.parse()
+	}()
+	diagnostics = append(p.diagnostics, diagnostics...)
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			err = d
+			break
+		}
+	}
+	return
+}
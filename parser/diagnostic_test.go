@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileReturnsDiagnostic(t *testing.T) {
+	source := "var a = 1\nlocal b = (a\n"
+	_, _, diagnostics, err := Compile(strings.NewReader(source), "bad.lua")
+	if err == nil {
+		t.Fatal("expected compile error")
+	}
+	if len(diagnostics) != 1 {
+		t.Fatalf("expected 1 diagnostic but got %d", len(diagnostics))
+	}
+	d := diagnostics[0]
+	if d.File != "bad.lua" || d.Line != 3 || d.Severity != SeverityError {
+		t.Errorf("unexpected diagnostic %s", d.Error())
+	}
+}
+
+func TestCompileWithoutError(t *testing.T) {
+	source := "var a: int = 1\nprint(a)\n"
+	proto, typeChecker, diagnostics, err := Compile(strings.NewReader(source), "ok.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto == nil || typeChecker == nil {
+		t.Fatal("expected prototype and type checker")
+	}
+	if HasErrorDiagnostic(diagnostics) {
+		t.Errorf("unexpected error diagnostics %v", diagnostics)
+	}
+}
+
+func TestCompileRecoversFromSyntaxErrors(t *testing.T) {
+	source := "local b = (1\nfunction f(x)\n  x = = 2\n  return x\nend\nlet c = )\nvar d = 1\n"
+	_, typeChecker, diagnostics, err := Compile(strings.NewReader(source), "multi.lua")
+	if err == nil {
+		t.Fatal("expected compile error")
+	}
+	expectedLines := []int{2, 3, 6}
+	if len(diagnostics) != len(expectedLines) {
+		t.Fatalf("expected %d diagnostics but got %v", len(expectedLines), diagnostics)
+	}
+	for i, line := range expectedLines {
+		if diagnostics[i].Line != line {
+			t.Errorf("expected diagnostic at line %d but got %s", line, diagnostics[i].Error())
+		}
+	}
+	if !typeChecker.Contains("d") {
+		t.Error("statements after syntax errors should still be type checked")
+	}
+}
+
+func TestConstraintSourceRange(t *testing.T) {
+	source := "var a: int = 1\nlocal b: string = (\"x\" ..\n  \"y\")\na = a  +  2\n"
+	_, typeChecker, _, err := Compile(strings.NewReader(source), "range.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := typeChecker.RootScope
+	if len(scope.Constraints) != 2 || len(scope.AssignConstraints) != 1 {
+		t.Fatalf("unexpected constraints %v %v", scope.Constraints, scope.AssignConstraints)
+	}
+	expected := SourceRange{Start: SourcePosition{2, 19, 33}, End: SourcePosition{3, 7, 47}}
+	if r := scope.Constraints[1].Range; r != expected {
+		t.Errorf("expected constraint range %s but got %s", expected, r)
+	}
+	expected = SourceRange{Start: SourcePosition{4, 5, 52}, End: SourcePosition{4, 12, 59}}
+	if r := scope.AssignConstraints[0].Range; r != expected {
+		t.Errorf("expected assign constraint range %s but got %s", expected, r)
+	}
+}
+
+func TestDiagnosticSourceExcerpt(t *testing.T) {
+	source := []byte("local a = 1\n\tlocal b: int = \"s\"\n")
+	d := &Diagnostic{Line: 2, Column: 17, EndLine: 2, EndColumn: 20}
+	expected := "\tlocal b: int = \"s\"\n\t               ^~~"
+	if excerpt := d.SourceExcerpt(source); excerpt != expected {
+		t.Errorf("unexpected source excerpt\n%s", excerpt)
+	}
+}
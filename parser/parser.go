@@ -19,12 +19,18 @@ type parser struct {
 
 	typeChecker *TypeChecker
 
+	diagnostics []*Diagnostic // 已经恢复过的语法错误
+
 	// 采集到的表达式列表，可以start多次采集表达式列表（压栈）。stop采集的时候移除顶层。push新采集值时每层采集列表都要增加这个值
 	capturingExprListStack [][]exprDesc
+	capturingExprLevels    []int // 每层采集开始时的nestedGoCallCount，只采集这一层的表达式，不采集其中嵌套的子表达式
 }
 
 func (p *parser) captureExprValue(value exprDesc) {
 	for i := 0; i < len(p.capturingExprListStack); i++ {
+		if p.capturingExprLevels[i] != p.nestedGoCallCount {
+			continue
+		}
 		p.capturingExprListStack[i] = append(p.capturingExprListStack[i], value)
 	}
 }
@@ -36,6 +42,7 @@ func (p *parser) isCapturingExprList() bool {
 func (p *parser) startCaptureExprList() {
 	// 开始新的一层capturingExprList
 	p.capturingExprListStack = append(p.capturingExprListStack, make([]exprDesc, 0))
+	p.capturingExprLevels = append(p.capturingExprLevels, p.nestedGoCallCount)
 }
 
 func (p *parser) StopCaptureExprList() []exprDesc {
@@ -45,6 +52,7 @@ func (p *parser) StopCaptureExprList() []exprDesc {
 	stackSize := len(p.capturingExprListStack)
 	saved := p.capturingExprListStack[stackSize-1]
 	p.capturingExprListStack = p.capturingExprListStack[0:(stackSize - 1)]
+	p.capturingExprLevels = p.capturingExprLevels[0:(stackSize - 1)]
 	return saved
 }
 
@@ -63,7 +71,7 @@ func (p *parser) checkName() string {
 
 func (p *parser) checkNameOrError() (result string, err error) {
 	if p.t != tkName {
-		err = errors.New(p.tokenToString(tkName) + " expected")
+		err = errors.New(tokenName(tkName) + " expected")
 		return
 	}
 	result = p.s
@@ -88,7 +96,7 @@ func (p *parser) checkNext(t rune) {
 
 func (p *parser) checkNextOrError(t rune) (err error) {
 	if p.t != t {
-		err = errors.New(p.tokenToString(t) + " expected")
+		err = errors.New(tokenName(t) + " expected")
 		return
 	}
 	p.next()
@@ -174,26 +182,46 @@ func (p *parser) arrayConstructor() exprDesc {
 	return t
 }
 
-func (p *parser) functionArguments(f exprDesc, line int) exprDesc {
+// 函数调用表达式中被调用的函数，用于调用处的参数类型检查
+type calleeInfo struct {
+	symbol       string // 被调用的变量名，a.b(...)或者a:b(...)时是a
+	fieldName    string // a.b(...)或者a:b(...)时的b
+	isMethodCall bool
+}
+
+func calleeOf(e exprDesc) calleeInfo {
+	return calleeInfo{symbol: e.symbol, fieldName: e.fieldName}
+}
+
+func (p *parser) functionArguments(f exprDesc, callee calleeInfo, line int) exprDesc {
+	start := p.sourceRange.Start
 	var args exprDesc
+	var argList []exprDesc
 	switch p.t {
 	case '(':
 		p.next()
 		if p.t == ')' {
 			args.kind = kindVoid
 		} else {
+			p.startCaptureExprList()
 			args, _ = p.expressionList()
+			argList = p.StopCaptureExprList()
 			p.function.SetMultipleReturns(args)
 		}
 		p.checkMatch(')', '(', line)
 	case '{':
 		args = p.constructor()
+		args.sourceRange = SourceRange{Start: start, End: p.lastTokenEnd}
+		argList = []exprDesc{args}
 	case tkString:
 		args = p.function.EncodeString(p.s)
+		args.sourceRange = p.sourceRange
+		argList = []exprDesc{args}
 		p.next()
 	default:
 		p.syntaxError("function arguments expected")
 	}
+	calleeType := p.addCallConstraint(callee, argList, args.hasMultipleReturns(), line, SourceRange{Start: start, End: p.lastTokenEnd})
 	base, parameterCount := f.info, MultipleReturns
 	if !args.hasMultipleReturns() {
 		if args.kind != kindVoid {
@@ -204,9 +232,38 @@ func (p *parser) functionArguments(f exprDesc, line int) exprDesc {
 	e := makeExpression(kindCall, p.function.EncodeABC(opCall, base, parameterCount+1, 2))
 	p.function.FixLine(line)
 	p.function.freeRegisterCount = base + 1 // call removed function and args & leaves (unless changed) one result
+	if calleeType != nil && calleeType.FuncReturnType != nil {
+		e.exprGuessType = calleeType.FuncReturnType
+	}
+	if callee.symbol == "type" && len(callee.fieldName) < 1 && len(argList) == 1 {
+		if arg := argList[0]; (arg.kind == kindLocal || arg.kind == kindUpValue) && len(arg.symbol) > 0 {
+			e.typeOfSymbol = arg.symbol
+		}
+	}
 	return e
 }
 
+// 记录函数调用的参数类型约束，返回parse到这里时能找到的被调用函数的签名类型
+func (p *parser) addCallConstraint(callee calleeInfo, argList []exprDesc, hasMultipleArgs bool, line int, argsRange SourceRange) *TypeTreeItem {
+	if len(callee.symbol) < 1 {
+		return nil
+	}
+	constraint := &CallConstraint{
+		FuncName:        callee.symbol,
+		FieldName:       callee.fieldName,
+		IsMethodCall:    callee.isMethodCall,
+		Line:            line,
+		Range:           argsRange,
+		HasMultipleArgs: hasMultipleArgs,
+	}
+	for _, arg := range argList {
+		constraint.ArgTypes = append(constraint.ArgTypes, p.typeChecker.deriveExprType(arg))
+		constraint.ArgRanges = append(constraint.ArgRanges, arg.sourceRange)
+	}
+	p.typeChecker.AddCallConstraint(constraint)
+	return p.typeChecker.CurrentProtoScope.findCalleeType(callee.symbol, callee.fieldName)
+}
+
 func (p *parser) primaryExpression() (e exprDesc) {
 	switch p.t {
 	case '(':
@@ -217,6 +274,10 @@ func (p *parser) primaryExpression() (e exprDesc) {
 		e = p.function.DischargeVariables(e)
 	case tkName:
 		e = p.singleVariable()
+	case tkType:
+		// type是关键字，但是表达式中可以调用Lua的内置函数type(x)
+		p.next()
+		e = p.function.SingleVariable("type")
 	default:
 		p.syntaxError("unexpected symbol")
 	}
@@ -240,7 +301,7 @@ func (p *parser) checkGenericTypeParams() (result []*TypeTreeItem, err error) {
 		}
 		result = append(result, typeParam)
 		if !p.testNext(',') {
-			err = p.checkNextOrError('>')
+			err = p.checkGenericTypeParamsEndOrError()
 			if err != nil {
 				return
 			}
@@ -250,26 +311,30 @@ func (p *parser) checkGenericTypeParams() (result []*TypeTreeItem, err error) {
 	return
 }
 
+// 泛型参数结尾的 > . 嵌套泛型的 >> 会被扫描成一个右移token，这里拆开只消耗其中一个 >
+func (p *parser) checkGenericTypeParamsEndOrError() (err error) {
+	if p.t == tkShr {
+		p.t = '>'
+		return
+	}
+	return p.checkNextOrError('>')
+}
+
 // 如果是调用record类型的构造函数，e需要标记record类型(e在类型推导时得到此record类型)
 func (p *parser) addTypeTagWhenExprIsRecordConstructCallType(e *exprDesc, primarySymbol string, genericTypes []*TypeTreeItem) {
 	primarySymbolType, _,  _, ok := p.typeChecker.CurrentProtoScope.get(primarySymbol)
 	if !ok {
 		return
 	}
-	_ = primarySymbolType
+	if primarySymbolType.ItemType == simpleAliasType {
+		// type P2 = P1<int> 的构造函数P2()得到展开后的record类型
+		primarySymbolType = p.typeChecker.CurrentProtoScope.resolve(primarySymbolType)
+	}
 	if primarySymbolType.IsRecordType() {
 		// 如果是有泛型类型参数，则需要实例化新类型
 		derivedGenericTypes := make([]*TypeTreeItem, 0)
 		for _, item := range genericTypes {
-			if item.ItemType == simpleNameType {
-				var ok bool
-				var itemType *TypeTreeItem
-				itemType, _, _, ok = p.typeChecker.CurrentProtoScope.get(item.Name)
-				if ok {
-					item = itemType
-				}
-			}
-			derivedGenericTypes = append(derivedGenericTypes, item)
+			derivedGenericTypes = append(derivedGenericTypes, p.typeChecker.CurrentProtoScope.resolve(item))
 		}
 		recordType, err := primarySymbolType.ApplyRecordGenericTypeParams(derivedGenericTypes)
 		if err != nil {
@@ -280,22 +345,33 @@ func (p *parser) addTypeTagWhenExprIsRecordConstructCallType(e *exprDesc, primar
 }
 
 // 可能有后缀的表达式的解析
-func (p *parser) suffixedExpression() exprDesc {
+func (p *parser) suffixedExpression() (e exprDesc) {
 	line := p.lineNumber
-	e := p.primaryExpression()
+	start := p.sourceRange.Start
+	defer func() {
+		e.sourceRange = SourceRange{Start: start, End: p.lastTokenEnd}
+	}()
+	e = p.primaryExpression()
 	primaryESymbol := e.symbol
 	for {
 		switch p.t {
 		case '.':
 			e = p.fieldSelector(e)
+			p.typeChecker.AddFieldConstraint(e.fieldObjectType, e.fieldName, nil, line, SourceRange{Start: start, End: p.lastTokenEnd})
 		case '[':
 			e = p.function.Indexed(p.function.ExpressionToAnyRegisterOrUpValue(e), p.index())
 		case ':':
 			p.next()
 			// a:b(args) 的表达式，相当于a.b(a, args). 其中a需要是symbol
-			e = p.functionArguments(p.function.Self(e, p.checkNameAsExpression()), line)
+			callee := calleeInfo{isMethodCall: true}
+			if len(e.fieldName) < 1 {
+				callee.symbol = e.symbol
+			}
+			callee.fieldName = p.checkName()
+			e = p.functionArguments(p.function.Self(e, p.function.EncodeString(callee.fieldName)), callee, line)
 		case '(', tkString, '{':
-			e = p.functionArguments(p.function.ExpressionToNextRegister(e), line)
+			callee := calleeOf(e)
+			e = p.functionArguments(p.function.ExpressionToNextRegister(e), callee, line)
 			p.addTypeTagWhenExprIsRecordConstructCallType(&e, primaryESymbol, nil)
 		case '<':
 			// 保存scanner状态，向前尝试checkGenericTypeParams，失败则回溯并当成小于号 < 处理
@@ -303,6 +379,10 @@ func (p *parser) suffixedExpression() exprDesc {
 			scannerReaderPosition := scannerSnapshot.r.Position()
 			// TypeName<GenericTypes, ... > (...)
 			typeParams, err := p.checkGenericTypeParams()
+			if err == nil && p.t != '(' && p.t != '{' && p.t != tkString {
+				// 后面不是函数调用参数，比如 a < b >> c ，当成比较表达式
+				err = errors.New("not a generic type construct call")
+			}
 			if err != nil {
 				// 回退scanner状态然后return e
 				p.scanner = scannerSnapshot
@@ -313,13 +393,13 @@ func (p *parser) suffixedExpression() exprDesc {
 				return e
 			}
 			// 因为是编译期泛型，调用带泛型参数的类型的构造函数可以忽略泛型参数
-			e = p.functionArguments(p.function.ExpressionToNextRegister(e), line)
+			callee := calleeOf(e)
+			e = p.functionArguments(p.function.ExpressionToNextRegister(e), callee, line)
 			p.addTypeTagWhenExprIsRecordConstructCallType(&e, primaryESymbol, typeParams)
 		default:
 			return e
 		}
 	}
-	panic("unreachable")
 }
 
 func (p *parser) simpleExpression() (e exprDesc) {
@@ -332,6 +412,7 @@ func (p *parser) simpleExpression() (e exprDesc) {
 		e.value = p.n
 	case tkString:
 		e = p.function.EncodeString(p.s)
+		e.exprGuessType = newLiteralValueType(p.s)
 	case tkNil:
 		e = makeExpression(kindNil, 0)
 	case tkTrue:
@@ -349,7 +430,7 @@ func (p *parser) simpleExpression() (e exprDesc) {
 		return
 	case tkFunction:
 		p.next()
-		e = p.body(false, p.lineNumber)
+		e = p.body(nil, p.lineNumber)
 		return
 	default:
 		e = p.suffixedExpression()
@@ -447,9 +528,18 @@ func (p *parser) subExpression(limit int) (e exprDesc, op int) {
 	for op != oprNoBinary && priority[op].left > limit {
 		line := p.lineNumber
 		p.next()
+		typeOfSymbol := e.typeOfSymbol
 		e = p.function.Infix(op, e)
 		e2, next := p.subExpression(priority[op].right)
 		e = p.function.Postfix(op, e, e2, line)
+		e.typeOfSymbol = ""
+		e.typeTest = nil
+		// type(x) == "string" 可以在if语句中收窄x的类型
+		if op == oprEq && len(typeOfSymbol) > 0 && e2.kind == kindConstant && e2.exprGuessType != nil {
+			if luaTypeName, ok := e2.exprGuessType.LiteralValue.(string); ok {
+				e.typeTest = &typeTest{symbol: typeOfSymbol, luaTypeName: luaTypeName}
+			}
+		}
 		op = next
 	}
 	p.leaveLevel()
@@ -457,7 +547,9 @@ func (p *parser) subExpression(limit int) (e exprDesc, op int) {
 }
 
 func (p *parser) expression() (e exprDesc) {
+	start := p.sourceRange.Start
 	e, _ = p.subExpression(0)
+	e.sourceRange = SourceRange{Start: start, End: p.lastTokenEnd}
 	if p.isCapturingExprList() {
 		p.captureExprValue(e)
 	}
@@ -477,15 +569,24 @@ func (p *parser) blockFollow(withUntil bool) bool {
 func (p *parser) statementList() {
 	for !p.blockFollow(true) {
 		if p.t == tkReturn {
-			p.statement()
-			return
+			if p.protectedStatement() {
+				return
+			}
+			continue
 		}
-		p.statement()
+		p.protectedStatement()
 	}
 }
 
 func (p *parser) fieldSelector(e exprDesc) exprDesc {
 	eSymbol := e.symbol
+	if len(e.fieldName) > 0 {
+		eSymbol = "" // a.b.c这种表达式不是单个符号的成员
+	}
+	var objectType *TypeTreeItem
+	if len(eSymbol) < 1 || !p.typeChecker.CurrentProtoScope.isTypeName(eSymbol) {
+		objectType = p.typeChecker.deriveExprType(e) // 类型名称不是record的实例，不检查属性
+	}
 	e = p.function.ExpressionToAnyRegisterOrUpValue(e)
 	e.symbol = eSymbol
 	p.next() // skip dot or colon
@@ -497,13 +598,68 @@ func (p *parser) fieldSelector(e exprDesc) exprDesc {
 		}
 	}
 	resultExpr := p.function.Indexed(e, fieldExpr)
-	if len(e.symbol) > 0 && len(e.fieldName)>0 {
+	if len(e.symbol) > 0 {
 		resultExpr.symbol = e.symbol
-		resultExpr.fieldName = e.fieldName
+	}
+	resultExpr.fieldName = e.fieldName
+	// a是record类型时，a.b的类型是record中b属性的类型
+	resultExpr.fieldObjectType = objectType
+	if propType := p.typeChecker.CurrentProtoScope.findPropType(objectType, e.fieldName); propType != nil {
+		resultExpr.exprGuessType = propType
 	}
 	return resultExpr
 }
 
+// typeInfo是否是genericTypeParams中的泛型参数
+func isGenericTypeParam(genericTypeParams []*TypeTreeItem, typeInfo *TypeTreeItem) bool {
+	if typeInfo.ItemType != simpleNameType {
+		return false
+	}
+	for _, item := range genericTypeParams {
+		if item.Name == typeInfo.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// record属性的默认值，只能是字面量. 默认值在构造函数中赋值，所以这里不生成指令
+func (p *parser) recordPropDefaultValue() (value interface{}, valueType *TypeTreeItem) {
+	negative := p.testNext('-')
+	switch p.t {
+	case tkInt:
+		if negative {
+			value = -p.i
+		} else {
+			value = p.i
+		}
+		valueType = intTypeTreeItem
+	case tkNumber:
+		if negative {
+			value = -p.n
+		} else {
+			value = p.n
+		}
+		valueType = numberTypeTreeItem
+	case tkString, tkTrue, tkFalse:
+		if negative {
+			p.syntaxError("record prop default value must be a literal")
+		}
+		switch p.t {
+		case tkString:
+			value = p.s
+			valueType = stringTypeTreeItem
+		default:
+			value = p.t == tkTrue
+			valueType = boolTypeTreeItem
+		}
+	default:
+		p.syntaxError("record prop default value must be a literal")
+	}
+	p.next()
+	return
+}
+
 func (p *parser) index() exprDesc {
 	p.next() // skip '['
 	e := p.function.ExpressionToValue(p.expression())
@@ -526,19 +682,33 @@ func (p *parser) assignment(t *assignmentTarget, variableCount int) {
 			// variableCount个变量的赋值语句，需要调用typeChecker.AddAssignConstraint
 			targetList := t.exprList()
 			for i, nameExpr := range targetList {
-				// 暂时只处理左侧是单符号局部变量或者自由变量的情况
-				if (nameExpr.kind != kindLocal && nameExpr.kind != kindUpValue) || len(nameExpr.symbol) < 1 {
+				symbol := nameExpr.symbol
+				if nameExpr.kind == kindIndexed && len(nameExpr.fieldName) > 0 && i < len(capturedExprList) {
+					// a.b = value 要检查value的类型和record中b属性的类型是否兼容
+					rightValue := capturedExprList[i]
+					p.typeChecker.AddFieldConstraint(nameExpr.fieldObjectType, nameExpr.fieldName,
+						p.typeChecker.deriveExprType(rightValue), p.lineNumber, rightValue.sourceRange)
+				}
+				if len(symbol) < 1 {
+					continue
+				}
+				if nameExpr.kind == kindIndexed {
+					// 全局变量或者a.b，检查是否修改了let变量或者类型
+					p.typeChecker.AddGlobalAssignConstraint(symbol, nameExpr.fieldName, p.lineNumber, nameExpr.sourceRange)
+					continue
+				}
+				// 暂时只检查左侧是单符号局部变量或者自由变量的值的类型
+				if nameExpr.kind != kindLocal && nameExpr.kind != kindUpValue {
 					continue
 				}
-				symbol := nameExpr.symbol
 				if i >= len(capturedExprList) {
 					// 暂时不考虑右侧值比赋值的变量少的情况
 					continue
 				}
 				rightValue := capturedExprList[i]
 				rightValueMaybeType := p.typeChecker.deriveExprType(rightValue)
-				p.typeChecker.AddAssignConstraint(symbol, rightValueMaybeType, p.lineNumber)
-				p.typeChecker.SetVariableType(symbol, rightValueMaybeType)
+				// 赋值不改变变量申明或者初始化时推导出的类型，否则Validate时无法检查出类型不匹配
+				p.typeChecker.AddAssignConstraint(symbol, rightValueMaybeType, p.lineNumber, rightValue.sourceRange)
 			}
 		}
 		p.startCaptureExprList()
@@ -623,6 +793,7 @@ func (p *parser) testThenBlock(escapes int) int {
 	var jumpFalse int
 	p.next()
 	e := p.expression()
+	test := e.typeTest
 	p.checkNext(tkThen)
 	if p.t == tkGoto || p.t == tkBreak {
 		e = p.function.GoIfFalse(e)
@@ -639,7 +810,11 @@ func (p *parser) testThenBlock(escapes int) int {
 		p.function.EnterBlock(false)
 		jumpFalse = e.f
 	}
+	narrowed := test != nil && p.typeChecker.pushNarrowedType(test.symbol, test.luaTypeName)
 	p.statementList()
+	if narrowed {
+		p.typeChecker.popNarrowedType()
+	}
 	p.function.LeaveBlock()
 	if p.t == tkElse || p.t == tkElseif {
 		escapes = p.function.Concatenate(escapes, p.function.Jump())
@@ -771,7 +946,7 @@ func (p *parser) checkParameterList() (result []*FuncTypeParamInfo) {
 	return
 }
 
-func (p *parser) parameterList() {
+func (p *parser) parameterList() (params []*FuncTypeParamInfo) {
 	n, isVarArg := 0, false
 	if p.t != ')' {
 		for first := true; first || (!isVarArg && p.testNext(',')); first = false {
@@ -787,10 +962,12 @@ func (p *parser) parameterList() {
 				} else {
 					paramType = objectTypeTreeItem
 				}
-				p.typeChecker.AddVariable(paramName, paramType, p.lineNumber, VAR_VARIABLE)
+				p.typeChecker.AddVariable(paramName, paramType, p.lineNumber, PARAM_VARIABLE)
+				params = append(params, &FuncTypeParamInfo{Name: paramName, TypeInfo: paramType})
 			case tkDots:
 				p.next()
 				isVarArg = true
+				params = append(params, &FuncTypeParamInfo{IsDynamicParams: true})
 			default:
 				p.syntaxError("<Name> or '...' expected")
 			}
@@ -801,9 +978,12 @@ func (p *parser) parameterList() {
 	p.function.AdjustLocalVariables(n)
 	p.function.f.parameterCount = p.function.activeVariableCount
 	p.function.ReserveRegisters(p.function.activeVariableCount)
+	return
 }
 
-func (p *parser) body(isMethod bool, line int) exprDesc {
+// 解析函数的参数列表、可选的返回类型和函数体. 返回的表达式标注了函数的签名类型.
+// selfType不为空时是方法，self的类型是方法所属对象的类型
+func (p *parser) body(selfType *TypeTreeItem, line int) exprDesc {
 	p.typeChecker.enterLevel(p.lineNumber)
 	defer func() {
 		p.typeChecker.leaveLevel(p.lineNumber)
@@ -811,16 +991,26 @@ func (p *parser) body(isMethod bool, line int) exprDesc {
 
 	p.function.OpenFunction(line)
 	p.checkNext('(')
-	if isMethod {
+	funcType := &TypeTreeItem{ItemType: simpleFuncType}
+	if selfType != nil {
 		p.function.MakeLocalVariable("self")
 		p.function.AdjustLocalVariables(1)
+		p.typeChecker.AddVariable("self", selfType, line, PARAM_VARIABLE)
+		funcType.FuncTypeParams = append(funcType.FuncTypeParams, &FuncTypeParamInfo{Name: "self", TypeInfo: objectTypeTreeItem})
 	}
-	p.parameterList()
+	funcType.FuncTypeParams = append(funcType.FuncTypeParams, p.parameterList()...)
 	p.checkNext(')')
+	if p.testNext(':') {
+		// 可选的 : returnType
+		funcType.FuncReturnType = p.checkType()
+	}
+	p.typeChecker.SetCurrentFuncType(funcType)
 	p.statementList()
 	p.function.f.lastLineDefined = p.lineNumber
 	p.checkMatch(tkEnd, tkFunction, line)
-	return p.function.CloseFunction()
+	e := p.function.CloseFunction()
+	e.exprGuessType = funcType
+	return e
 }
 
 func (p *parser) functionName() (e exprDesc, isMethod bool) {
@@ -833,8 +1023,9 @@ func (p *parser) functionName() (e exprDesc, isMethod bool) {
 }
 
 func (p *parser) offlineFunctionStatement(line int) {
+	doc := p.docComment
 	p.checkNext(tkOffline)
-	p.functionStatement(line, true)
+	p.functionStatement(line, true, doc)
 	p.function.offline = true
 }
 
@@ -850,12 +1041,19 @@ func (p *parser) emitStatement(line int) {
 	eventNameExpr := p.function.EncodeString(eventName)
 	eventNameExpr = p.function.ExpressionToNextRegister(eventNameExpr)
 
+	argsStart := p.sourceRange.Start
 	p.checkNext('(')
-	eventArgs, eventArgsCount := p.expressionList()
-	eventArgs = p.function.ExpressionToNextRegister(eventArgs)
+	eventArgsCount := 0
+	var eventArgList []exprDesc
+	if p.t != ')' {
+		p.startCaptureExprList()
+		var eventArgs exprDesc
+		eventArgs, eventArgsCount = p.expressionList()
+		eventArgList = p.StopCaptureExprList()
+		_ = p.function.ExpressionToNextRegister(eventArgs)
+	}
 	p.checkMatch(')', '(', line)
 
-	_ = eventArgs
 	// 调用emit函数
 	parameterCount := 1 + eventArgsCount
 	statementExpr := makeExpression(kindCall, p.function.EncodeABC(opCall, base, parameterCount+1, 2))
@@ -864,31 +1062,106 @@ func (p *parser) emitStatement(line int) {
 	p.function.freeRegisterCount = base
 
 	p.typeChecker.AddEventName(eventName)
+	var eventArgTypes []*TypeTreeItem
+	for _, arg := range eventArgList {
+		eventArgTypes = append(eventArgTypes, p.typeChecker.deriveExprType(arg).widen())
+	}
+	p.typeChecker.AddEventArgTypes(eventName, eventArgTypes)
+	constraint := &EmitConstraint{
+		EventName: eventName,
+		Line:      line,
+		Range:     SourceRange{Start: argsStart, End: p.lastTokenEnd},
+	}
+	for _, arg := range eventArgList {
+		constraint.ArgTypes = append(constraint.ArgTypes, p.typeChecker.deriveExprType(arg))
+		constraint.ArgRanges = append(constraint.ArgRanges, arg.sourceRange)
+	}
+	p.typeChecker.AddEmitConstraint(constraint)
+}
+
+// event Name(param: type, ...) 申明event的参数类型，emit时检查参数. 只是类型申明，不生成代码
+func (p *parser) eventStatement(line int) {
+	p.next()
+	start := p.sourceRange.Start
+	eventName := p.checkName()
+	nameRange := SourceRange{Start: start, End: p.lastTokenEnd}
+	p.checkNext('(')
+	params := p.checkParameterList()
+	p.checkMatch(')', '(', line)
+	p.typeChecker.AddEventDeclaration(&EventDeclaration{
+		Name:   eventName,
+		Params: params,
+		Line:   line,
+		Range:  nameRange,
+	})
 }
 
-func (p *parser) functionStatement(line int, offline bool) {
+// doc是函数前面的文档注释，函数是record的方法时记录到record属性中
+func (p *parser) functionStatement(line int, offline bool, doc string) {
 	p.next()
+	start := p.sourceRange.Start
 	v, m := p.functionName()
-	p.function.StoreVariable(v, p.body(m, line), offline)
+	nameRange := SourceRange{Start: start, End: p.lastTokenEnd}
+	// function a() 或者 function a.b() 也是赋值，不能修改let变量和类型
+	if len(v.symbol) > 0 {
+		if v.kind == kindIndexed {
+			p.typeChecker.AddGlobalAssignConstraint(v.symbol, v.fieldName, line, nameRange)
+		} else {
+			p.typeChecker.AddAssignConstraint(v.symbol, nil, line, nameRange)
+		}
+	}
+	var selfType *TypeTreeItem
+	if m {
+		selfType = v.fieldObjectType
+		if selfType == nil || selfType.IsNotDerivedType() {
+			selfType = objectTypeTreeItem
+		}
+	}
+	b := p.body(selfType, line)
+	funcType := b.exprGuessType
+	if len(v.fieldName) > 0 {
+		funcType.Name = v.fieldName
+	} else if len(v.symbol) > 0 {
+		funcType.Name = v.symbol
+		// 记录函数变量的签名类型，调用处根据它检查参数
+		if v.kind == kindIndexed {
+			p.typeChecker.AddGlobalType(v.symbol, funcType, line)
+		} else {
+			p.typeChecker.SetVariableType(v.symbol, funcType)
+		}
+	}
+	p.function.StoreVariable(v, b, offline)
 	p.function.FixLine(line)
+	if len(doc) > 0 && v.kind == kindIndexed {
+		p.typeChecker.SetLocalRecordPropDoc(v.symbol, v.fieldName, doc)
+	}
 }
 
-func (p *parser) localFunction() {
-	p.function.MakeLocalVariable(p.checkName())
+func (p *parser) localFunction(varDeclareType VariableType) {
+	line := p.lineNumber
+	name := p.checkName()
+	p.function.MakeLocalVariable(name)
 	p.function.AdjustLocalVariables(1)
-	p.function.LocalVariable(p.body(false, p.lineNumber).info).startPC = pc(len(p.function.f.code))
+	// 函数体中可以递归调用自己，这时签名类型还没有解析出来
+	p.typeChecker.AddVariable(name, notDerivedTypeTreeItem, line, varDeclareType)
+	b := p.body(nil, p.lineNumber)
+	b.exprGuessType.Name = name
+	p.typeChecker.SetVariableType(name, b.exprGuessType)
+	p.function.LocalVariable(b.info).startPC = pc(len(p.function.f.code))
 }
 
 func (p *parser) localStatement(varDeclareType VariableType) {
 	v := 0
 	var varNameList []string = make([]string, 0)
 	var varNameLines = make(map[string]int)
+	var varTypeDeclared = make(map[string]bool) // 是否有显式申明的类型
 	for first := true; first || p.testNext(','); v++ {
 		varName := p.checkName()
 		varNameLine := p.lineNumber
 		varType := objectTypeTreeItem
 		if p.testNext(':') {
 			varType = p.checkType()
+			varTypeDeclared[varName] = true
 		}
 		p.typeChecker.AddVariable(varName, varType, varNameLine, varDeclareType)
 		p.function.MakeLocalVariable(varName)
@@ -910,8 +1183,15 @@ func (p *parser) localStatement(varDeclareType VariableType) {
 		for i := 0; i < checkParamsCount; i++ {
 			varName := varNameList[i]
 			exprTypeDerived := p.typeChecker.deriveExprType(assignedExprList[i])
-			p.typeChecker.AddConstraint(varName, exprTypeDerived, varNameLines[varName])
-			p.typeChecker.SetVariableType(varName, exprTypeDerived)
+			p.typeChecker.AddConstraint(varName, exprTypeDerived, varNameLines[varName], assignedExprList[i].sourceRange)
+			if !varTypeDeclared[varName] {
+				// 没有申明类型的变量使用初始值推导出的类型，只有let变量保留字面量类型，
+				// var和local变量之后可以赋其他值，使用字面量对应的基本类型
+				if varDeclareType != CONST_VARIABLE {
+					exprTypeDerived = exprTypeDerived.widen()
+				}
+				p.typeChecker.SetVariableType(varName, exprTypeDerived)
+			}
 		}
 	} else {
 		var e exprDesc
@@ -929,12 +1209,15 @@ func (p *parser) expressionStatement() {
 	}
 }
 
-func (p *parser) returnStatement() {
+func (p *parser) returnStatement(returnRange SourceRange) {
 	if f := p.function; p.blockFollow(true) || p.t == ';' {
 		f.ReturnNone()
 		p.typeChecker.CurrentProtoScope.addReturnType(&TypeTreeItem{ItemType: simpleNilType})
+		p.typeChecker.AddReturnConstraint(&ReturnConstraint{Line: returnRange.Start.Line, Range: returnRange, Missing: true})
 	} else {
+		p.startCaptureExprList()
 		returnExpr, exprCount := p.expressionList()
+		returnExprList := p.StopCaptureExprList()
 		var returnType *TypeTreeItem
 		if exprCount > 0 {
 			returnType = p.typeChecker.deriveExprType(returnExpr)
@@ -942,6 +1225,15 @@ func (p *parser) returnStatement() {
 			returnType = &TypeTreeItem{ItemType: simpleNilType}
 		}
 		p.typeChecker.CurrentProtoScope.addReturnType(returnType)
+		// 每个返回值都要和申明的返回类型兼容
+		for i, expr := range returnExprList {
+			p.typeChecker.AddReturnConstraint(&ReturnConstraint{
+				Line:          p.lineNumber,
+				Range:         expr.sourceRange,
+				ValueTypeInfo: p.typeChecker.deriveExprType(expr),
+				Index:         i,
+			})
+		}
 		f.Return(returnExpr, exprCount)
 	}
 	p.testNext(';')
@@ -950,12 +1242,51 @@ func (p *parser) returnStatement() {
 func (p *parser) checkType() *TypeTreeItem {
 	result, err := p.checkTypeOrError()
 	if err != nil {
-		panic(err)
+		p.syntaxError(err.Error())
 	}
 	return result
 }
 
+// 类型可能是用 | 连接的多个类型组成的联合类型，比如 int | string 或者 "Male" | "Female"
 func (p *parser) checkTypeOrError() (result *TypeTreeItem, err error) {
+	result, err = p.checkSingleTypeOrError()
+	if err != nil || p.t != '|' {
+		return
+	}
+	unionTypes := []*TypeTreeItem{result}
+	for p.testNext('|') {
+		var item *TypeTreeItem
+		item, err = p.checkSingleTypeOrError()
+		if err != nil {
+			return
+		}
+		unionTypes = append(unionTypes, item)
+	}
+	result = &TypeTreeItem{
+		ItemType:   simpleUnionType,
+		UnionTypes: unionTypes,
+	}
+	return
+}
+
+func (p *parser) checkSingleTypeOrError() (result *TypeTreeItem, err error) {
+	// 字面量类型，比如 "Male", 1, true
+	switch p.t {
+	case tkString:
+		result = newLiteralType(p.s)
+	case tkInt:
+		result = newLiteralType(p.i)
+	case tkNumber:
+		result = newLiteralType(p.n)
+	case tkTrue, tkFalse:
+		result = newLiteralType(p.t == tkTrue)
+	case tkNil:
+		result = nilTypeTreeItem
+	}
+	if result != nil {
+		p.next()
+		return
+	}
 	// 类型可能是 symbol或者带泛型参数的类型，或者函数表达式 (...) => <type>
 	if p.testNext('(') {
 		// 函数签名类型 (...) => <type>
@@ -1030,7 +1361,7 @@ func (p *parser) statement() {
 	case tkRepeat:
 		p.repeatStatement(line)
 	case tkFunction:
-		p.functionStatement(line, false)
+		p.functionStatement(line, false, p.docComment)
 	case tkOffline:
 		p.offlineFunctionStatement(line)
 	case tkEmit:
@@ -1038,21 +1369,21 @@ func (p *parser) statement() {
 	case tkLocal:
 		p.next()
 		if p.testNext(tkFunction) {
-			p.localFunction()
+			p.localFunction(LOCAL_VARIABLE)
 		} else {
-			p.localStatement(VAR_VARIABLE)
+			p.localStatement(LOCAL_VARIABLE)
 		}
 	case tkVar:
 		p.next()
 		if p.testNext(tkFunction) {
-			p.localFunction()
+			p.localFunction(VAR_VARIABLE)
 		} else {
 			p.localStatement(VAR_VARIABLE)
 		}
 	case tkLet:
 		p.next()
 		if p.testNext(tkFunction) {
-			p.localFunction()
+			p.localFunction(VAR_VARIABLE)
 		} else {
 			p.localStatement(CONST_VARIABLE)
 		}
@@ -1060,11 +1391,17 @@ func (p *parser) statement() {
 		p.next()
 		p.labelStatement(p.checkName(), line)
 	case tkReturn:
+		returnRange := p.sourceRange
 		p.next()
-		p.returnStatement()
+		p.returnStatement(returnRange)
 	case tkBreak, tkGoto:
 		p.gotoStatement(p.function.Jump())
 	case tkType:
+		if p.lookAhead() == '(' {
+			// type(x) 这类调用内置函数type的语句
+			p.expressionStatement()
+			break
+		}
 		// type definition
 		/*
 
@@ -1087,7 +1424,7 @@ func (p *parser) statement() {
 			var err error
 			typeGenericNameList, err = p.checkGenericTypeParams()
 			if err != nil {
-				panic(err)
+				p.syntaxError(err.Error())
 			}
 			p.checkNext('=')
 		} else {
@@ -1103,20 +1440,28 @@ func (p *parser) statement() {
 				if p.testNext('}') {
 					break
 				}
+				propDoc := p.docComment
 				propName := p.checkName()
 				p.checkNext(':')
 				propType := p.checkType()
 
-				if p.s == "default" {
+				var defaultValue interface{}
+				if p.t == tkName && p.s == "default" {
 					p.next()
-					defaultExpr := p.expression()
-					_ = defaultExpr // TODO: record prop类型的初始化值的处理
-					log.Println("warning: record prop default value not supported yet")
+					start, defaultLine := p.sourceRange.Start, p.lineNumber
+					var defaultValueType *TypeTreeItem
+					defaultValue, defaultValueType = p.recordPropDefaultValue()
+					if !isGenericTypeParam(typeGenericNameList, propType) {
+						p.typeChecker.AddPropDefaultConstraint(typeNameToken, propName, propType, defaultValueType,
+							defaultLine, SourceRange{Start: start, End: p.lastTokenEnd})
+					}
 				}
 
 				recordInfo.Props = append(recordInfo.Props, &RecordTypePropInfo{
-					PropName: propName,
-					PropType: propType,
+					PropName:     propName,
+					PropType:     propType,
+					DefaultValue: defaultValue,
+					Doc:          propDoc,
 				})
 				if p.testNext('}') {
 					break
@@ -1125,7 +1470,7 @@ func (p *parser) statement() {
 			}
 			log.Printf("= record {%s}\n", recordInfo.String())
 			// record类型定义，除了要把新类型加入到parser类型系统外，还要创建构造函数的指令
-			p.typeChecker.AddGlobalType(typeNameToken, &TypeTreeItem{
+			p.typeChecker.AddTypeDefinition(typeNameToken, &TypeTreeItem{
 				ItemType:          simpleRecordType,
 				Name:              typeNameToken,
 				GenericTypeParams: typeGenericNameList,
@@ -1140,21 +1485,33 @@ func (p *parser) statement() {
 			p.function.StoreVariable(typeNameExp, p.genRecordFunc(recordInfo, line), false) // 手动构造函数body
 			p.function.FixLine(line)
 		} else {
-			// 可能是 Name {‘<’ { Name [‘,’ Name ] } ‘>’}
-			rightTypeName := p.checkName()
-			var rightTypeNameList []string
-			if p.testNext('<') {
-				rightTypeNameList = p.nameList()
-				p.checkNext('>')
+			// 可能是 Name {‘<’ { Name [‘,’ Name ] } ‘>’}，或者联合类型、字面量类型和函数类型
+			rightType := p.checkType()
+			if !rightType.IsSimpleNameType() && !rightType.IsSimpleNameWithGenericTypesType() {
+				definedType := new(TypeTreeItem)
+				*definedType = *rightType
+				definedType.GenericTypeParams = typeGenericNameList
+				if definedType.IsUnionType() || definedType.IsFuncType() {
+					definedType.Name = typeNameToken
+				}
+				log.Printf("= %s\n", definedType.String())
+				p.typeChecker.AddTypeDefinition(typeNameToken, definedType, line)
+				break
+			}
+			rightTypeName := rightType.Name
+			rightTypeParams := rightType.GenericTypeParams
+			rightTypeParamNames := make([]string, 0, len(rightTypeParams))
+			for _, item := range rightTypeParams {
+				rightTypeParamNames = append(rightTypeParamNames, item.String())
 			}
-			log.Printf("= %s<%s>\n", rightTypeName, strings.Join(rightTypeNameList, ","))
+			log.Printf("= %s<%s>\n", rightTypeName, strings.Join(rightTypeParamNames, ","))
 			// 类型重命名除了把新类型加入到parser的namespace中，如果右侧是record类型，还要创建新的构造函数
-			p.typeChecker.AddGlobalType(typeNameToken, &TypeTreeItem{
+			p.typeChecker.AddTypeDefinition(typeNameToken, &TypeTreeItem{
 				ItemType:          simpleAliasType,
 				Name:              typeNameToken,
 				GenericTypeParams: typeGenericNameList,
 				AliasTypeName:     rightTypeName,
-				AliasTypeParams:   rightTypeNameList,
+				AliasTypeParams:   rightTypeParams,
 			}, line)
 			if p.typeChecker.Contains(rightTypeName) && p.typeChecker.IsRecordType(rightTypeName) {
 				// type alias右侧是record类型，则新类型需要有构造函数
@@ -1168,12 +1525,19 @@ func (p *parser) statement() {
 				p.function.FixLine(line)
 			}
 		}
+	case tkName:
+		if p.s == "event" && p.lookAhead() == tkName {
+			// event不是关键字，event后面跟着名称时才是event申明
+			p.eventStatement(line)
+			break
+		}
+		p.expressionStatement()
 	default:
 		p.expressionStatement()
 	}
 	if p.function.f.maxStackSize < p.function.freeRegisterCount || p.function.freeRegisterCount < p.function.activeVariableCount {
 		// TODO: for test
-		fmt.Printf("p maxStackSize: %d, freeRegisterCount: %d, activeVariableCount: %d\n", p.function.f.maxStackSize, p.function.freeRegisterCount, p.function.activeVariableCount)
+		log.Printf("p maxStackSize: %d, freeRegisterCount: %d, activeVariableCount: %d\n", p.function.f.maxStackSize, p.function.freeRegisterCount, p.function.activeVariableCount)
 	}
 	p.assert(p.function.f.maxStackSize >= p.function.freeRegisterCount && p.function.freeRegisterCount >= p.function.activeVariableCount)
 	p.function.freeRegisterCount = p.function.activeVariableCount
@@ -1184,21 +1548,39 @@ func (p *parser) mainFunction() {
 	p.function.OpenMainFunction()
 	p.next()
 	p.statementList()
-	p.check(tkEOS)
+	for p.t != tkEOS {
+		// 顶层多余的end/else/until等. 如果前面已经有错误，多半是错误恢复跳过了块的开始，不再重复报告
+		if len(p.diagnostics) == 0 {
+			p.addDiagnostic(p.diagnostic("'<eof>' expected", p.t, p.sourceRange))
+		}
+		p.skipToken()
+		p.statementList()
+	}
 	p.function = p.function.CloseMainFunction()
 }
 
-func ParseToPrototype(r io.ByteReader, name string) (*Prototype, *TypeChecker) {
+func newParser(r io.ByteReader, name string) *parser {
 	p := &parser{
 		scanner:     scanner{r: utils.ByteReaderToRepeatable(r), lineNumber: 1, lastLine: 1, lookAheadToken: token{t: tkEOS}, source: name},
 		typeChecker: NewTypeChecker(),
 	}
-	f := &function{f: &Prototype{source: name, maxStackSize: 2, isVarArg: true, extra: NewPrototypeExtra(), name: "main"}, constantLookup: make(map[value]int), p: p, jumpPC: noJump}
-	p.function = f
+	p.typeChecker.SourceName = name
+	p.function = &function{f: &Prototype{source: name, maxStackSize: 2, isVarArg: true, extra: NewPrototypeExtra(), name: "main"}, constantLookup: make(map[value]int), p: p, jumpPC: noJump}
+	return p
+}
+
+func (p *parser) parse() *Prototype {
+	f := p.function
 	p.mainFunction()
 
 	p.typeChecker.RootScope.StartLine = 1
 	p.typeChecker.RootScope.EndLine = p.lineNumber
 
-	return f.f, p.typeChecker
+	return f.f
+}
+
+// ParseToPrototype 编译源码，遇到语法错误时返回第一个错误. 需要全部诊断信息时使用Compile
+func ParseToPrototype(r io.ByteReader, name string) (*Prototype, *TypeChecker, error) {
+	proto, typeChecker, _, err := Compile(r, name)
+	return proto, typeChecker, err
 }
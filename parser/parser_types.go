@@ -3,6 +3,7 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -20,12 +21,17 @@ const (
 	simpleNilType                                      // nil类型
 
 	simpleNotDerivedType // 暂未推导出的类型
+
+	simpleUnionType   // int | string 这类联合类型
+	simpleLiteralType // "Male" 这类字面量类型，Name是字面量的基础类型
 )
 
 type RecordTypePropInfo struct {
-	PropName string
-	PropType *TypeTreeItem
-	Offline  bool
+	PropName     string
+	PropType     *TypeTreeItem
+	Offline      bool
+	DefaultValue interface{} // 属性的默认值，只支持int64, float64, string, bool类型的字面量，nil表示没有默认值
+	Doc          string      // 属性或方法前面的文档注释
 }
 
 type RecordTypeInfo struct {
@@ -74,11 +80,13 @@ type FuncTypeParamInfo struct {
 }
 
 func (info *FuncTypeParamInfo) String() string {
-	dotsStr := ""
 	if info.IsDynamicParams {
-		dotsStr = ", ..."
+		return "..."
+	}
+	if info.TypeInfo == nil {
+		return info.Name
 	}
-	return fmt.Sprintf("func %s(%s%s)", info.Name, info.TypeInfo.String(), dotsStr)
+	return fmt.Sprintf("%s: %s", info.Name, info.TypeInfo.String())
 }
 
 type TypeTreeItem struct {
@@ -86,26 +94,167 @@ type TypeTreeItem struct {
 	Name              string
 	GenericTypeParams []*TypeTreeItem `json:"GenericTypeParams,omitempty"`
 	AliasTypeName     string          `json:"AliasTypeName,omitempty"`
-	AliasTypeParams   []string        `json:"AliasTypeParams,omitempty"`
+	AliasTypeParams   []*TypeTreeItem `json:"AliasTypeParams,omitempty"`
 
 	RecordType *RecordTypeInfo `json:"RecordType,omitempty"`
 
 	FuncTypeParams []*FuncTypeParamInfo `json:"FuncTypeParams,omitempty"`
 	FuncReturnType *TypeTreeItem        `json:"FuncReturnType,omitempty"`
+
+	UnionTypes []*TypeTreeItem `json:"UnionTypes,omitempty"`
+	// 字面量类型的值，只支持int64, float64, string, bool. 字面量表达式推导出的内置类型也会带上值
+	LiteralValue interface{} `json:"LiteralValue,omitempty"`
+}
+
+// 字面量值的基础类型名称
+func literalBaseTypeName(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	default:
+		return "string"
+	}
+}
+
+// 申明的字面量类型，比如 type Gender = "Male" | "Female" 中的"Male"
+func newLiteralType(value interface{}) *TypeTreeItem {
+	return &TypeTreeItem{ItemType: simpleLiteralType, Name: literalBaseTypeName(value), LiteralValue: value}
 }
 
-// 某个TypeTreeItem在某个name-type binding(链表，多层)下apply得到实际类型的函数
+// 字面量表达式推导出的类型，是带有值的内置类型
+func newLiteralValueType(value interface{}) *TypeTreeItem {
+	return &TypeTreeItem{ItemType: simpleInnerType, Name: literalBaseTypeName(value), LiteralValue: value}
+}
+
+// 去掉推导出的类型上的字面量值
+func (item *TypeTreeItem) widen() *TypeTreeItem {
+	if item.ItemType != simpleInnerType || item.LiteralValue == nil {
+		return item
+	}
+	return &TypeTreeItem{ItemType: simpleInnerType, Name: item.Name}
+}
+
+// 类型的值在Lua中用type(x)得到的类型名称，不知道时返回空字符串
+func (item *TypeTreeItem) luaTypeName() string {
+	switch item.ItemType {
+	case simpleInnerType, simpleLiteralType:
+		switch item.Name {
+		case "int", "number":
+			return "number"
+		case "bool":
+			return "boolean"
+		case "string", "function", "table":
+			return item.Name
+		case "Array", "Map":
+			return "table"
+		}
+	case simpleRecordType:
+		return "table"
+	case simpleFuncType:
+		return "function"
+	case simpleNilType:
+		return "nil"
+	}
+	return ""
+}
+
+// 某个TypeTreeItem在某个name-type binding(链表，多层)下apply得到实际类型的函数.
+// 递归替换record属性、函数参数和返回值、泛型参数中的类型，不修改item本身
 func (item *TypeTreeItem) ApplyBinding(binding *Binding) (result *TypeTreeItem, err error) {
 	switch item.ItemType {
 	case simpleNameType:
-		{
-			result = binding.getOrElse(item.Name, item)
+		result = binding.getOrElse(item.Name, item)
+	case simpleNameWithGenericTypesType, simpleInnerType:
+		// P<T1, T2>或者Array<T>这类类型替换泛型参数
+		if len(item.GenericTypeParams) < 1 {
+			result = item
 			return
 		}
+		result = new(TypeTreeItem)
+		*result = *item
+		result.GenericTypeParams, err = applyBindingToItems(item.GenericTypeParams, binding)
+	case simpleRecordType:
+		// record自己的泛型参数会遮盖外层的同名binding
+		result, err = item.applyBindingToRecord(shadowBinding(binding, item.GenericTypeParams))
+	case simpleAliasType:
+		result = new(TypeTreeItem)
+		*result = *item
+		result.AliasTypeParams, err = applyBindingToItems(item.AliasTypeParams, shadowBinding(binding, item.GenericTypeParams))
+	case simpleUnionType:
+		result = new(TypeTreeItem)
+		*result = *item
+		result.UnionTypes, err = applyBindingToItems(item.UnionTypes, shadowBinding(binding, item.GenericTypeParams))
+	case simpleFuncType:
+		result = new(TypeTreeItem)
+		*result = *item
+		result.FuncTypeParams = make([]*FuncTypeParamInfo, 0, len(item.FuncTypeParams))
+		for _, param := range item.FuncTypeParams {
+			newParam := *param
+			if param.TypeInfo != nil {
+				newParam.TypeInfo, err = param.TypeInfo.ApplyBinding(binding)
+				if err != nil {
+					return
+				}
+			}
+			result.FuncTypeParams = append(result.FuncTypeParams, &newParam)
+		}
+		if item.FuncReturnType != nil {
+			result.FuncReturnType, err = item.FuncReturnType.ApplyBinding(binding)
+		}
+	default:
+		result = item
+	}
+	return
+}
 
+func applyBindingToItems(items []*TypeTreeItem, binding *Binding) (result []*TypeTreeItem, err error) {
+	result = make([]*TypeTreeItem, 0, len(items))
+	for _, item := range items {
+		var applied *TypeTreeItem
+		applied, err = item.ApplyBinding(binding)
+		if err != nil {
+			return
+		}
+		result = append(result, applied)
+	}
+	return
+}
+
+// 泛型参数名称在新的binding中绑定到自身，避免被外层binding替换
+func shadowBinding(binding *Binding, genericTypeParams []*TypeTreeItem) *Binding {
+	if len(genericTypeParams) < 1 {
+		return binding
+	}
+	result := newBinding(binding)
+	for _, param := range genericTypeParams {
+		result.bind(param.Name, &TypeTreeItem{ItemType: simpleNameType, Name: param.Name})
+	}
+	return result
+}
+
+// 复制record类型并替换所有属性的类型
+func (item *TypeTreeItem) applyBindingToRecord(binding *Binding) (result *TypeTreeItem, err error) {
+	result = new(TypeTreeItem)
+	*result = *item
+	if item.RecordType == nil {
+		return
+	}
+	result.RecordType = &RecordTypeInfo{
+		Name:  item.RecordType.Name,
+		Props: make([]*RecordTypePropInfo, 0, len(item.RecordType.Props)),
+	}
+	for _, p := range item.RecordType.Props {
+		newProp := *p
+		newProp.PropType, err = p.PropType.ApplyBinding(binding)
+		if err != nil {
+			return
+		}
+		result.RecordType.Props = append(result.RecordType.Props, &newProp)
 	}
-	// TODO: 其他itemType类型的处理，需要递归处理成员的类型
-	result = item
 	return
 }
 
@@ -119,37 +268,21 @@ func (item *TypeTreeItem) ApplyRecordGenericTypeParams(genericTypeParams []*Type
 		result = item
 		return
 	}
-	result = new(TypeTreeItem)
-	*result = *item
-	result.RecordType = new(RecordTypeInfo)
-	result.GenericTypeParams = item.GenericTypeParams[:]
-	*(result.RecordType) = *item.RecordType
-	result.RecordType.Props = item.RecordType.Props[:]
-	// TODO: 在result.genericTypeParams中应用前len(genericTypeParams)个.需要递归apply类型的props中的类型
-	// 目前简单处理只处理record prop的声明的类型
+	// 在item.GenericTypeParams中应用前len(genericTypeParams)个，剩下的泛型参数仍然保留在结果类型中
 	b := newBinding(nil)
-	applyGenericCount := len(result.GenericTypeParams)
+	applyGenericCount := len(item.GenericTypeParams)
 	if len(genericTypeParams) < applyGenericCount {
 		applyGenericCount = len(genericTypeParams)
 	}
 	for i := 0; i < applyGenericCount; i++ {
-		name := result.GenericTypeParams[i].Name
-		valueType := genericTypeParams[i]
-		b.bind(name, valueType)
-	}
-	// 替换成员的类型
-	for i, p := range result.RecordType.Props {
-		if p.PropType.ItemType == simpleNameType && b.get(p.PropType.Name) != nil {
-			newPType := b.get(p.PropType.Name)
-			result.RecordType.Props[i] = &RecordTypePropInfo{
-				PropName: p.PropName,
-				PropType: newPType,
-				Offline:  p.Offline,
-			}
-		}
+		b.bind(item.GenericTypeParams[i].Name, genericTypeParams[i])
+	}
+	result, err = item.applyBindingToRecord(shadowBinding(b, item.GenericTypeParams[applyGenericCount:]))
+	if err != nil {
+		return
 	}
 	// 移除已经被apply的泛型类型
-	result.GenericTypeParams = result.GenericTypeParams[applyGenericCount:]
+	result.GenericTypeParams = item.GenericTypeParams[applyGenericCount:]
 	return
 }
 
@@ -161,6 +294,23 @@ func (item *TypeTreeItem) IsFuncType() bool {
 	return item.ItemType == simpleFuncType
 }
 
+// 是否是没有申明类型时的object类型
+func IsObjectType(item *TypeTreeItem) bool {
+	return item.ItemType == simpleInnerType && item.Name == "object"
+}
+
+func (item *TypeTreeItem) IsNilType() bool {
+	return item.ItemType == simpleNilType
+}
+
+func (item *TypeTreeItem) IsUnionType() bool {
+	return item.ItemType == simpleUnionType
+}
+
+func (item *TypeTreeItem) IsLiteralType() bool {
+	return item.ItemType == simpleLiteralType
+}
+
 func (item *TypeTreeItem) IsInnerType() bool {
 	return item.ItemType == simpleInnerType
 }
@@ -173,6 +323,10 @@ func (item *TypeTreeItem) IsSimpleNameWithGenericTypesType() bool {
 	return item.ItemType == simpleNameWithGenericTypesType
 }
 
+func (item *TypeTreeItem) IsNotDerivedType() bool {
+	return item.ItemType == simpleNotDerivedType
+}
+
 func (item *TypeTreeItem) String() string {
 	switch item.ItemType {
 	case simpleNameType:
@@ -184,7 +338,11 @@ func (item *TypeTreeItem) String() string {
 		for _, p := range item.FuncTypeParams {
 			paramsStr = append(paramsStr, p.String())
 		}
-		return fmt.Sprintf("<func %s(%s)%s>", item.Name, strings.Join(paramsStr, ","), item.FuncReturnType.String())
+		returnTypeStr := ""
+		if item.FuncReturnType != nil {
+			returnTypeStr = ": " + item.FuncReturnType.String()
+		}
+		return fmt.Sprintf("<func %s(%s)%s>", item.Name, strings.Join(paramsStr, ", "), returnTypeStr)
 	case simpleRecordType:
 		return fmt.Sprintf("<record (%s)>", item.RecordType.String())
 	case simpleNameWithGenericTypesType:
@@ -197,6 +355,17 @@ func (item *TypeTreeItem) String() string {
 		return "<not_derived>"
 	case simpleNilType:
 		return "nil"
+	case simpleUnionType:
+		typesStrs := make([]string, 0, len(item.UnionTypes))
+		for _, unionItem := range item.UnionTypes {
+			typesStrs = append(typesStrs, unionItem.String())
+		}
+		return strings.Join(typesStrs, " | ")
+	case simpleLiteralType:
+		if value, ok := item.LiteralValue.(string); ok {
+			return strconv.Quote(value)
+		}
+		return fmt.Sprintf("%v", item.LiteralValue)
 	default:
 		return "uknown type"
 	}
@@ -0,0 +1,37 @@
+package parser
+
+import "fmt"
+
+// 源码中的一个位置. Line和Column从1开始，Column按字节计算；Offset是从0开始的字节偏移量
+type SourcePosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Offset int `json:"offset"`
+}
+
+func (pos SourcePosition) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+func (pos SourcePosition) IsValid() bool {
+	return pos.Line > 0
+}
+
+// 源码中的一段范围，End是范围结束后的第一个字符的位置
+type SourceRange struct {
+	Start SourcePosition `json:"start"`
+	End   SourcePosition `json:"end"`
+}
+
+func (r SourceRange) String() string {
+	return fmt.Sprintf("%s-%s", r.Start.String(), r.End.String())
+}
+
+func (r SourceRange) IsValid() bool {
+	return r.Start.IsValid()
+}
+
+// 包含pos位置的范围
+func (r SourceRange) Contains(pos SourcePosition) bool {
+	return r.IsValid() && r.Start.Offset <= pos.Offset && pos.Offset < r.End.Offset
+}
@@ -0,0 +1,75 @@
+package parser
+
+// 以下导出Prototype的内容，assembler直接从Prototype生成字节码时使用，不需要经过asm文本
+
+type ProtoUpValue struct {
+	Name    string
+	IsLocal bool // 为true时引用外层函数的局部变量，否则引用外层函数的upvalue
+	Index   int
+}
+
+type ProtoLocalVariable struct {
+	Name           string
+	StartPC, EndPC int
+}
+
+func (p *Prototype) Name() string {
+	return p.name
+}
+
+func (p *Prototype) MaxStackSize() int {
+	return p.maxStackSize
+}
+
+func (p *Prototype) ParameterCount() int {
+	return p.parameterCount
+}
+
+func (p *Prototype) Code() []uint32 {
+	result := make([]uint32, len(p.code))
+	for i, ins := range p.code {
+		result[i] = uint32(ins)
+	}
+	return result
+}
+
+// Constants 返回的常量是string, int64, float64, bool或nil
+func (p *Prototype) Constants() []interface{} {
+	result := make([]interface{}, len(p.constants))
+	for i, constant := range p.constants {
+		result[i] = constant
+	}
+	return result
+}
+
+func (p *Prototype) UpValues() []ProtoUpValue {
+	result := make([]ProtoUpValue, len(p.upValues))
+	for i, upvalue := range p.upValues {
+		result[i] = ProtoUpValue{Name: upvalue.name, IsLocal: upvalue.isLocal, Index: upvalue.index}
+	}
+	return result
+}
+
+func (p *Prototype) Prototypes() []*Prototype {
+	result := make([]*Prototype, len(p.prototypes))
+	for i := range p.prototypes {
+		result[i] = &p.prototypes[i]
+	}
+	return result
+}
+
+func (p *Prototype) LineInfo() []int {
+	result := make([]int, len(p.lineInfo))
+	for i, line := range p.lineInfo {
+		result[i] = int(line)
+	}
+	return result
+}
+
+func (p *Prototype) LocalVariables() []ProtoLocalVariable {
+	result := make([]ProtoLocalVariable, len(p.localVariables))
+	for i, local := range p.localVariables {
+		result[i] = ProtoLocalVariable{Name: local.name, StartPC: int(local.startPC), EndPC: int(local.endPC)}
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package parser
+
+// 语法错误恢复(panic-mode). 一条语句出错后，记录诊断信息，恢复语句开始前的parser状态，
+// 然后跳过token直到下一个语句边界继续解析，这样一次编译可以报告文件中所有的语法错误
+
+const maxDiagnostics = 100 // 超过这个数量的错误后不再恢复，直接中止编译
+
+// 语句开始前需要保存的parser和代码生成状态
+type statementState struct {
+	function            *function
+	block               *block
+	freeRegisterCount   int
+	activeVariableCount int
+	codeCount           int
+	jumpPC, lastTarget  int
+	activeVariables     int
+	pendingGotos        int
+	activeLabels        int
+	nestedGoCallCount   int
+	captureStackSize    int
+	typeScope           *TypeInfoScope
+	readerPosition      int
+	lineNumber          int
+}
+
+func (p *parser) saveStatementState() statementState {
+	f := p.function
+	return statementState{
+		function:            f,
+		block:               f.block,
+		freeRegisterCount:   f.freeRegisterCount,
+		activeVariableCount: f.activeVariableCount,
+		codeCount:           len(f.f.code),
+		jumpPC:              f.jumpPC,
+		lastTarget:          f.lastTarget,
+		activeVariables:     len(p.activeVariables),
+		pendingGotos:        len(p.pendingGotos),
+		activeLabels:        len(p.activeLabels),
+		nestedGoCallCount:   p.nestedGoCallCount,
+		captureStackSize:    len(p.capturingExprListStack),
+		typeScope:           p.typeChecker.CurrentProtoScope,
+		readerPosition:      p.r.Position(),
+		lineNumber:          p.lineNumber,
+	}
+}
+
+// 回到语句开始前的状态，出错语句已经生成的指令也会被丢弃
+func (p *parser) restoreStatementState(state statementState) {
+	p.function = state.function
+	f := p.function
+	f.block = state.block
+	f.freeRegisterCount = state.freeRegisterCount
+	f.activeVariableCount = state.activeVariableCount
+	if len(f.f.code) > state.codeCount {
+		f.f.code = f.f.code[:state.codeCount]
+		f.f.lineInfo = f.f.lineInfo[:state.codeCount]
+	}
+	f.jumpPC = state.jumpPC
+	f.lastTarget = state.lastTarget
+	p.activeVariables = p.activeVariables[:state.activeVariables]
+	p.pendingGotos = p.pendingGotos[:state.pendingGotos]
+	p.activeLabels = p.activeLabels[:state.activeLabels]
+	p.nestedGoCallCount = state.nestedGoCallCount
+	p.capturingExprListStack = p.capturingExprListStack[:state.captureStackSize]
+	p.capturingExprLevels = p.capturingExprLevels[:state.captureStackSize]
+	p.typeChecker.CurrentProtoScope = state.typeScope
+}
+
+// 记录一个已恢复的诊断信息. 错误过多时中止编译，外层的恢复点不会再处理这个panic
+func (p *parser) addDiagnostic(d *Diagnostic) {
+	if len(p.diagnostics) >= maxDiagnostics {
+		panic(d)
+	}
+	p.diagnostics = append(p.diagnostics, d)
+	if len(p.diagnostics) >= maxDiagnostics {
+		lua_throw_error(&Diagnostic{
+			File:     p.source,
+			Line:     d.Line,
+			Column:   d.Column,
+			Message:  "too many errors",
+			Severity: SeverityError,
+		})
+	}
+}
+
+// 解析一条语句，出现语法错误时记录诊断信息并同步到下一个语句边界. 返回语句是否解析成功
+func (p *parser) protectedStatement() (ok bool) {
+	state := p.saveStatementState()
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				d, isDiagnostic := recovered.(*Diagnostic)
+				if !isDiagnostic {
+					panic(recovered) // 编译器内部错误不做恢复
+				}
+				p.addDiagnostic(d)
+				p.restoreStatementState(state)
+				p.buffer.Reset()
+				p.synchronize(state)
+			}
+		}()
+		p.statement()
+		ok = true
+	}()
+	return
+}
+
+// 是否是可以作为恢复点的语句开始或者块结束的token
+func isStatementBoundary(t rune) bool {
+	switch t {
+	case tkEnd, tkElse, tkElseif, tkUntil, tkLocal, tkVar, tkLet, tkFunction, tkOffline, tkType, tkEmit, tkReturn, tkEOS:
+		return true
+	}
+	return false
+}
+
+// 跳过token直到语句边界. 如果出错的语句一个字符都没有消耗，至少跳过当前token，避免死循环
+func (p *parser) synchronize(state statementState) {
+	if p.r.Position() == state.readerPosition && p.lineNumber == state.lineNumber && p.t != tkEOS {
+		p.skipToken()
+	}
+	for !isStatementBoundary(p.t) {
+		p.skipToken()
+	}
+}
+
+// 跳过一个token，跳过过程中的词法错误也记录下来
+func (p *parser) skipToken() {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			d, isDiagnostic := recovered.(*Diagnostic)
+			if !isDiagnostic {
+				panic(recovered)
+			}
+			p.addDiagnostic(d)
+			p.buffer.Reset()
+		}
+	}()
+	p.next()
+}
@@ -74,8 +74,8 @@ var tokens []string = []string{
 
 	"nil", "not", "or", "repeat",
 	"return", "then", "true", "until", "while",
-	"..", "...", "==", ">=", "<=", "~=", "::", "//", "<eof>",
-	"<number>", "<Name>", "<string>",
+	"..", "...", "==", ">=", "<=", "~=", "::", "//", "<<", ">>", "<eof>",
+	"<integer>", "<number>", "<Name>", "<string>",
 }
 
 type token struct {
@@ -83,6 +83,9 @@ type token struct {
 	i int64
 	n float64
 	s string
+
+	sourceRange SourceRange // token在源码中的范围
+	docComment  string      // 紧挨在token前面单独成行的 -- 注释，多行用换行连接
 }
 
 type scanner struct {
@@ -91,19 +94,36 @@ type scanner struct {
 	r                    utils.RepeatableByteReader
 	current              rune
 	lineNumber, lastLine int
+	lineStartOffset      int            // 当前行第一个字符在源码中的偏移量，用来计算列号
+	tokenStart           SourcePosition // 正在扫描的token的开始位置
+	lastTokenEnd         SourcePosition // 上一个token的结束位置，用来计算表达式的结束位置
 	source               string
+	docComments          []string // 正在收集的连续单独成行的注释
+	lastCommentLine      int      // 上一行注释所在行
+	lastTokenLine        int      // 上一个扫描出的token结束的行，同一行后面的注释不是文档注释
 	lookAheadToken       token
 	token
 }
 
 func (s *scanner) assert(cond bool)           { lua_assert(cond) }
-func (s *scanner) syntaxError(message string) { s.scanError(message, s.t) }
-func (s *scanner) errorExpected(t rune)       { s.syntaxError(s.tokenToString(t) + " expected") }
+func (s *scanner) syntaxError(message string) { s.rangeError(message, s.t, s.sourceRange) }
+func (s *scanner) errorExpected(t rune)       { s.syntaxError(tokenName(t) + " expected") }
 func (s *scanner) numberError()               { s.scanError("malformed number", tkNumber) }
 func (s *scanner) intError()                  { s.scanError("malformed integer", tkInt) }
 func isNewLine(c rune) bool                   { return c == '\n' || c == '\r' }
 func isDecimal(c rune) bool                   { return '0' <= c && c <= '9' }
 
+// token类型的名称，和tokenToString不同，不使用当前token的值
+func tokenName(t rune) string {
+	switch {
+	case t < firstReserved:
+		return fmt.Sprintf("'%c'", t)
+	case t < tkEOS:
+		return fmt.Sprintf("'%s'", tokens[t-firstReserved])
+	}
+	return tokens[t-firstReserved]
+}
+
 func (s *scanner) tokenToString(t rune) string {
 	switch {
 	case t == tkName || t == tkString:
@@ -120,14 +140,47 @@ func (s *scanner) tokenToString(t rune) string {
 	return tokens[t-firstReserved]
 }
 
+// 当前读取到的字符所在的列号，从1开始
+func (s *scanner) currentColumn() int {
+	return s.currentPosition().Column
+}
+
+// 当前读取到的字符在源码中的偏移量. 读到结尾时reader的偏移量不再增加
+func (s *scanner) currentOffset() int {
+	if s.current == endOfStream {
+		return s.r.Position()
+	}
+	return s.r.Position() - 1
+}
+
+// 当前读取到的(还没有被token使用的)字符的位置
+func (s *scanner) currentPosition() SourcePosition {
+	if s.r == nil {
+		return SourcePosition{}
+	}
+	offset := s.currentOffset()
+	return SourcePosition{Line: s.lineNumber, Column: offset - s.lineStartOffset + 1, Offset: offset}
+}
+
+// 词法错误，范围是从正在扫描的token开始到当前字符
 func (s *scanner) scanError(message string, token rune) {
-	buff := chunkID(s.source)
+	s.rangeError(message, token, SourceRange{Start: s.tokenStart, End: s.currentPosition()})
+}
+
+func (s *scanner) rangeError(message string, token rune, sourceRange SourceRange) {
+	lua_throw_error(s.diagnostic(message, token, sourceRange))
+}
+
+func (s *scanner) diagnostic(message string, token rune, sourceRange SourceRange) *Diagnostic {
+	d := newRangeDiagnostic(s.source, sourceRange, message, SeverityError)
+	if !sourceRange.IsValid() {
+		d.Line = s.lineNumber
+		d.Column = s.currentColumn()
+	}
 	if token != 0 {
-		message = fmt.Sprintf("%s:%d: %s near %s", buff, s.lineNumber, message, s.tokenToString(token))
-	} else {
-		message = fmt.Sprintf("%s:%d: %s", buff, s.lineNumber, message)
+		d.Token = s.tokenToString(token)
 	}
-	lua_throw_error(SyntaxError, message)
+	return d
 }
 
 func (s *scanner) incrementLineNumber() {
@@ -136,6 +189,7 @@ func (s *scanner) incrementLineNumber() {
 	if s.advance(); isNewLine(s.current) && s.current != old {
 		s.advance()
 	}
+	s.lineStartOffset = s.currentOffset()
 	if s.lineNumber++; s.lineNumber >= maxInt {
 		s.syntaxError("chunk has too many lines")
 	}
@@ -449,6 +503,7 @@ func (s *scanner) reservedOrName() token {
 func (s *scanner) scan() token {
 	const comment, str = true, false
 	for {
+		s.tokenStart = s.currentPosition()
 		switch c := s.current; c {
 		case '\n', '\r':
 			s.incrementLineNumber()
@@ -465,9 +520,13 @@ func (s *scanner) scan() token {
 				}
 				s.buffer.Reset()
 			}
+			commentLine := s.lineNumber
+			var commentText bytes.Buffer
 			for !isNewLine(s.current) && s.current != endOfStream {
+				commentText.WriteByte(byte(s.current))
 				s.advance()
 			}
+			s.addDocComment(commentLine, commentText.String())
 		case '[':
 			if sep := s.skipSeparator(); sep >= 0 {
 				return token{t: tkString, s: s.readMultiLine(str, sep)}
@@ -554,22 +613,47 @@ func (s *scanner) scan() token {
 			return token{t: c}
 		}
 	}
-	panic("unreachable")
+}
+
+// 记录一行 -- 注释. 连续单独成行的注释合并成下一个token的文档注释，代码后面的注释会打断文档注释
+func (s *scanner) addDocComment(line int, text string) {
+	if line <= s.lastTokenLine {
+		s.docComments = nil
+		return
+	}
+	if line != s.lastCommentLine+1 {
+		s.docComments = nil
+	}
+	s.docComments = append(s.docComments, strings.TrimSpace(strings.TrimLeft(text, "-")))
+	s.lastCommentLine = line
+}
+
+// 扫描下一个token并记录它在源码中的范围
+func (s *scanner) scanToken() token {
+	t := s.scan()
+	t.sourceRange = SourceRange{Start: s.tokenStart, End: s.currentPosition()}
+	if len(s.docComments) > 0 && s.lastCommentLine == t.sourceRange.Start.Line-1 {
+		t.docComment = strings.Join(s.docComments, "\n")
+	}
+	s.docComments = nil
+	s.lastTokenLine = t.sourceRange.End.Line
+	return t
 }
 
 func (s *scanner) next() {
 	s.lastLine = s.lineNumber
+	s.lastTokenEnd = s.sourceRange.End
 	if s.lookAheadToken.t != tkEOS {
 		s.token = s.lookAheadToken
 		s.lookAheadToken.t = tkEOS
 	} else {
-		s.token = s.scan()
+		s.token = s.scanToken()
 	}
 }
 
 func (s *scanner) lookAhead() rune {
 	s.assert(s.lookAheadToken.t == tkEOS)
-	s.lookAheadToken = s.scan()
+	s.lookAheadToken = s.scanToken()
 	return s.lookAheadToken.t
 }
 
@@ -591,7 +675,7 @@ func (s *scanner) checkMatch(what, who rune, where int) {
 		if where == s.lineNumber {
 			s.errorExpected(what)
 		} else {
-			s.syntaxError(fmt.Sprintf("%s expected (to close %s at Line %d)", s.tokenToString(what), s.tokenToString(who), where))
+			s.syntaxError(fmt.Sprintf("%s expected (to close %s at Line %d)", tokenName(what), tokenName(who), where))
 		}
 	}
 }
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"github.com/glualang/gluac/utils"
 	"strings"
 	"testing"
 )
@@ -43,7 +44,7 @@ func TestScanner(t *testing.T) {
 }
 
 func testScanner(t *testing.T, n int, source string, tokens []token) {
-	s := scanner{r: strings.NewReader(source)}
+	s := scanner{r: utils.ByteReaderToRepeatable(strings.NewReader(source))}
 	for i, expected := range tokens {
 		if result := s.scan(); result != expected {
 			println("source", source)
@@ -63,3 +64,26 @@ func (t token) String() string {
 	}
 	return fmt.Sprintf("{t:%s, n:%f, s:%q}", tok, t.n, t.s)
 }
+
+func TestScannerTokenRange(t *testing.T) {
+	source := "local a\n  = \"hi\" --c\n\t..b"
+	expected := []SourceRange{
+		{Start: SourcePosition{1, 1, 0}, End: SourcePosition{1, 6, 5}},
+		{Start: SourcePosition{1, 7, 6}, End: SourcePosition{1, 8, 7}},
+		{Start: SourcePosition{2, 3, 10}, End: SourcePosition{2, 4, 11}},
+		{Start: SourcePosition{2, 5, 12}, End: SourcePosition{2, 9, 16}},
+		{Start: SourcePosition{3, 2, 22}, End: SourcePosition{3, 4, 24}},
+		{Start: SourcePosition{3, 4, 24}, End: SourcePosition{3, 5, 25}},
+		{Start: SourcePosition{3, 5, 25}, End: SourcePosition{3, 5, 25}},
+	}
+	s := scanner{r: utils.ByteReaderToRepeatable(strings.NewReader(source)), lineNumber: 1, lookAheadToken: token{t: tkEOS}}
+	for i, r := range expected {
+		s.next()
+		if s.sourceRange != r {
+			t.Errorf("[%d] expected token %s at %s but found %s", i, s.token, r, s.sourceRange)
+		}
+	}
+	if s.t != tkEOS {
+		t.Errorf("expected token <eof> but found %s", s.token)
+	}
+}
@@ -2,8 +2,8 @@ package parser
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 )
 
 // glua compile-time static type system
@@ -12,11 +12,22 @@ type TypeChecker struct {
 	CurrentProtoScope *TypeInfoScope `json:"-"`         // 当前parse的proto的类型信息作用域
 	RootScope         *TypeInfoScope `json:"RootScope"` // 根类型信息作用域
 	Events            []string // emit出的eventName列表
+	EventArgTypes     map[string][]*TypeTreeItem `json:"-"` // 各event的参数类型，从emit的参数表达式推导
+	EventDeclarations []*EventDeclaration        `json:"-"` // event Name(params) 申明的event
+	SourceName        string   `json:"-"` // 源码文件名，用于类型检查的诊断信息
+	Strict            bool     `json:"-"` // 严格模式，类型检查的问题作为错误而不是警告
+
+	narrowedTypes []*narrowedType // parse到的if type(x) == "..." then 代码块中收窄后的变量类型，内层的在后面
+}
+
+type narrowedType struct {
+	name     string
+	typeInfo *TypeTreeItem
 }
 
 func NewTypeChecker() *TypeChecker {
 	rootScope := NewTypeInfoScope()
-	globalTypes := []string{"int", "string", "Array", "Map", "table", "function"}
+	globalTypes := []string{"int", "number", "bool", "string", "Array", "Map", "table", "function"}
 	for _, t := range globalTypes {
 		rootScope.add(t, &TypeTreeItem{
 			ItemType: simpleInnerType,
@@ -28,6 +39,7 @@ func NewTypeChecker() *TypeChecker {
 		RootScope:         rootScope,
 		CurrentProtoScope: rootScope,
 		Events: make([]string, 0),
+		EventArgTypes: make(map[string][]*TypeTreeItem),
 	}
 }
 
@@ -37,6 +49,57 @@ func (checker *TypeChecker) AddEventName(eventName string) {
 	}
 }
 
+// 记录emit eventName(args)的参数类型. 多处emit同一个event时，参数类型不一致的位置当成object类型
+func (checker *TypeChecker) AddEventArgTypes(eventName string, argTypes []*TypeTreeItem) {
+	oldArgTypes, ok := checker.EventArgTypes[eventName]
+	if !ok {
+		checker.EventArgTypes[eventName] = argTypes
+		return
+	}
+	if len(argTypes) > len(oldArgTypes) {
+		oldArgTypes, argTypes = argTypes, oldArgTypes
+	}
+	result := make([]*TypeTreeItem, 0, len(oldArgTypes))
+	for i, argType := range oldArgTypes {
+		if i >= len(argTypes) || argTypes[i].String() != argType.String() {
+			argType = objectTypeTreeItem
+		}
+		result = append(result, argType)
+	}
+	checker.EventArgTypes[eventName] = result
+}
+
+func (checker *TypeChecker) AddEventDeclaration(declaration *EventDeclaration) {
+	checker.EventDeclarations = append(checker.EventDeclarations, declaration)
+}
+
+// 找到event的申明，同名的多次申明时使用第一次的
+func (checker *TypeChecker) FindEventDeclaration(eventName string) (result *EventDeclaration, ok bool) {
+	for _, declaration := range checker.EventDeclarations {
+		if declaration.Name == eventName {
+			return declaration, true
+		}
+	}
+	return
+}
+
+func (checker *TypeChecker) AddEmitConstraint(constraint *EmitConstraint) {
+	checker.CurrentProtoScope.EmitConstraints = append(checker.CurrentProtoScope.EmitConstraints, constraint)
+}
+
+// 记录local record变量的方法的文档注释
+func (checker *TypeChecker) SetLocalRecordPropDoc(name string, propName string, doc string) {
+	localVarValue, ok := checker.CurrentProtoScope.VariableTypeInfos[name]
+	if !ok || localVarValue.ItemType != simpleRecordType {
+		return
+	}
+	for _, prop := range localVarValue.RecordType.Props {
+		if prop.PropName == propName {
+			prop.Doc = doc
+		}
+	}
+}
+
 // parser进入一个新的词法作用域的时候需要调用enterLevel
 func (checker *TypeChecker) enterLevel(line int) {
 	newScope := NewTypeInfoScope()
@@ -49,8 +112,7 @@ func (checker *TypeChecker) enterLevel(line int) {
 // parser离开一个词法作用域的时候需要调用leaveLevel
 func (checker *TypeChecker) leaveLevel(line int) {
 	if checker.CurrentProtoScope.Parent == nil {
-		log.Fatalln("invalid scope level when TypeChecker::leaveLevel")
-		return
+		panic(errors.New("invalid scope level when TypeChecker::leaveLevel"))
 	}
 	checker.CurrentProtoScope.EndLine = line
 	checker.CurrentProtoScope = checker.CurrentProtoScope.Parent
@@ -60,37 +122,152 @@ func (checker *TypeChecker) AddGlobalType(name string, item *TypeTreeItem, line
 	checker.RootScope.add(name, item, line, VAR_VARIABLE) // 目前把全局变量当成可变变量
 }
 
+// 增加record类型或者类型重命名，类型名称和内置类型一样不可修改
+func (checker *TypeChecker) AddTypeDefinition(name string, item *TypeTreeItem, line int) {
+	checker.RootScope.add(name, item, line, CONST_VARIABLE)
+}
+
 func (checker *TypeChecker) AddVariable(name string, item *TypeTreeItem, line int, varType VariableType) {
 	checker.CurrentProtoScope.add(name, item, line, varType)
 }
 
-func (checker *TypeChecker) AddConstraint(name string, usingAsTypeInfo *TypeTreeItem, line int) {
+func (checker *TypeChecker) AddConstraint(name string, usingAsTypeInfo *TypeTreeItem, line int, sourceRange SourceRange) {
 	checker.CurrentProtoScope.Constraints = append(checker.CurrentProtoScope.Constraints, &TypeInfoConstraint{
 		Name:            name,
 		Line:            line,
+		Range:           sourceRange,
 		UsingAsTypeInfo: usingAsTypeInfo,
 	})
 }
 
-func (checker *TypeChecker) AddAssignConstraint(name string, valueTypeInfo *TypeTreeItem, line int) {
-	checker.CurrentProtoScope.AssignConstraints = append(checker.CurrentProtoScope.AssignConstraints, &AssignConstraint{
+func (checker *TypeChecker) AddAssignConstraint(name string, valueTypeInfo *TypeTreeItem, line int, sourceRange SourceRange) {
+	checker.addAssignConstraint(&AssignConstraint{
 		Name:          name,
 		Line:          line,
+		Range:         sourceRange,
+		ValueTypeInfo: valueTypeInfo,
+	})
+}
+
+// 给全局变量name或者a.b形式的成员赋值(fieldName不为空时)，只检查是否修改了let变量或者类型
+func (checker *TypeChecker) AddGlobalAssignConstraint(name string, fieldName string, line int, sourceRange SourceRange) {
+	checker.addAssignConstraint(&AssignConstraint{
+		Name:      name,
+		FieldName: fieldName,
+		Global:    true,
+		Line:      line,
+		Range:     sourceRange,
+	})
+}
+
+func (checker *TypeChecker) addAssignConstraint(constraint *AssignConstraint) {
+	scope := checker.CurrentProtoScope
+	if _, _, varType, ok := scope.get(constraint.Name); ok && varType == CONST_VARIABLE {
+		constraint.IsConst = true
+		constraint.IsTypeName = scope.isTypeName(constraint.Name)
+	}
+	scope.AssignConstraints = append(scope.AssignConstraints, constraint)
+}
+
+func (checker *TypeChecker) AddCallConstraint(constraint *CallConstraint) {
+	checker.CurrentProtoScope.CallConstraints = append(checker.CurrentProtoScope.CallConstraints, constraint)
+}
+
+func (checker *TypeChecker) AddReturnConstraint(constraint *ReturnConstraint) {
+	checker.CurrentProtoScope.ReturnConstraints = append(checker.CurrentProtoScope.ReturnConstraints, constraint)
+}
+
+// 增加record属性访问的约束，objectType为空时不检查
+func (checker *TypeChecker) AddFieldConstraint(objectType *TypeTreeItem, fieldName string, valueTypeInfo *TypeTreeItem,
+	line int, sourceRange SourceRange) {
+	if objectType == nil || len(fieldName) < 1 {
+		return
+	}
+	checker.CurrentProtoScope.FieldConstraints = append(checker.CurrentProtoScope.FieldConstraints, &FieldConstraint{
+		ObjectType:    objectType,
+		FieldName:     fieldName,
+		Line:          line,
+		Range:         sourceRange,
+		ValueTypeInfo: valueTypeInfo,
+	})
+}
+
+// 增加record属性默认值的约束，默认值要和属性类型兼容
+func (checker *TypeChecker) AddPropDefaultConstraint(recordName string, propName string, propType *TypeTreeItem,
+	valueTypeInfo *TypeTreeItem, line int, sourceRange SourceRange) {
+	checker.CurrentProtoScope.PropDefaultConstraints = append(checker.CurrentProtoScope.PropDefaultConstraints, &PropDefaultConstraint{
+		RecordName:    recordName,
+		PropName:      propName,
+		PropType:      propType,
+		Line:          line,
+		Range:         sourceRange,
 		ValueTypeInfo: valueTypeInfo,
 	})
 }
 
+// 设置当前正在parse的函数的签名类型，函数体中的返回语句要和它的返回类型兼容
+func (checker *TypeChecker) SetCurrentFuncType(funcType *TypeTreeItem) {
+	checker.CurrentProtoScope.FuncType = funcType
+}
+
 // 给局部变量指向的record类型增加新的成员函数
 func (checker *TypeChecker) AddMethodToLocalRecord(name string, methodName string, methodExpr exprDesc, offline bool) {
 	localVarValue, ok := checker.CurrentProtoScope.VariableTypeInfos[name]
 	if !ok {
 		return
 	}
-	if localVarValue.ItemType == simpleRecordType {
-		localVarValue.RecordType.AddProp(methodName, &TypeTreeItem{ItemType: simpleFuncType}, offline)
+	// 只有赋值函数时才是增加方法，其他值的赋值要在Validate时检查属性是否存在
+	methodType := methodExpr.exprGuessType
+	if localVarValue.ItemType == simpleRecordType && methodType != nil && methodType.IsFuncType() {
+		localVarValue.RecordType.AddProp(methodName, methodType, offline)
 	}
 }
 
+// 进入if type(name) == luaTypeName then的代码块时，把联合类型的变量name收窄到对应的类型.
+// 没有收窄时返回false，不需要popNarrowedType
+func (checker *TypeChecker) pushNarrowedType(name string, luaTypeName string) bool {
+	declareType, _, _, ok := checker.CurrentProtoScope.get(name)
+	if !ok || declareType == nil {
+		return false
+	}
+	if narrowed := checker.narrowedTypeOf(name); narrowed != nil {
+		declareType = narrowed
+	}
+	declareType = checker.CurrentProtoScope.resolve(declareType)
+	if !declareType.IsUnionType() {
+		return false
+	}
+	var matchedTypes []*TypeTreeItem
+	for _, item := range declareType.UnionTypes {
+		if checker.CurrentProtoScope.resolve(item).luaTypeName() == luaTypeName {
+			matchedTypes = append(matchedTypes, item)
+		}
+	}
+	if len(matchedTypes) < 1 {
+		return false
+	}
+	result := matchedTypes[0]
+	if len(matchedTypes) > 1 {
+		result = &TypeTreeItem{ItemType: simpleUnionType, UnionTypes: matchedTypes}
+	}
+	checker.narrowedTypes = append(checker.narrowedTypes, &narrowedType{name: name, typeInfo: result})
+	return true
+}
+
+func (checker *TypeChecker) popNarrowedType() {
+	checker.narrowedTypes = checker.narrowedTypes[:len(checker.narrowedTypes)-1]
+}
+
+// 当前parse位置变量name收窄后的类型，没有收窄时返回nil
+func (checker *TypeChecker) narrowedTypeOf(name string) *TypeTreeItem {
+	for i := len(checker.narrowedTypes) - 1; i >= 0; i-- {
+		if checker.narrowedTypes[i].name == name {
+			return checker.narrowedTypes[i].typeInfo
+		}
+	}
+	return nil
+}
+
 func (checker *TypeChecker) SetVariableType(name string, valueTypeInfo *TypeTreeItem) {
 	checker.CurrentProtoScope.VariableTypeInfos[name] = valueTypeInfo
 }
@@ -119,52 +296,361 @@ func (checker *TypeChecker) ToTreeString() (result string, err error) {
 	return
 }
 
+// 类型检查的诊断信息，有表达式范围时指向表达式，否则指向所在代码行
+func typeDiagnostic(line int, sourceRange SourceRange, severity DiagnosticSeverity, format string, args ...interface{}) *Diagnostic {
+	if !sourceRange.IsValid() {
+		sourceRange.Start.Line = line
+	}
+	return newRangeDiagnostic("", sourceRange, fmt.Sprintf(format, args...), severity)
+}
+
+// 一次类型检查的上下文. strict模式下类型不匹配、给let变量赋值、找不到的名称都是错误，否则是警告
+type typeValidator struct {
+	strict   bool
+	warnings []error
+	errs     []error
+}
+
+func (v *typeValidator) typeError(line int, sourceRange SourceRange, format string, args ...interface{}) {
+	if v.strict {
+		v.errs = append(v.errs, typeDiagnostic(line, sourceRange, SeverityError, format, args...))
+	} else {
+		v.warnings = append(v.warnings, typeDiagnostic(line, sourceRange, SeverityWarning, format, args...))
+	}
+}
+
+// 不受严格模式影响，总是作为错误
+func (v *typeValidator) error(line int, sourceRange SourceRange, format string, args ...interface{}) {
+	v.errs = append(v.errs, typeDiagnostic(line, sourceRange, SeverityError, format, args...))
+}
+
 // 验证整个类型信息树是否正确，包括其中有根据名字引用其他类型暂时还没resolve的也这时候resolve出来验证
 func (scope *TypeInfoScope) Validate() (warnings []error, errs []error) {
+	v := &typeValidator{}
+	scope.validate(v)
+	return v.warnings, v.errs
+}
+
+func (scope *TypeInfoScope) validate(v *typeValidator) {
 	for _, constraint := range scope.Constraints {
 		varName := constraint.Name
 		varDeclareType, _, _, ok := scope.get(varName)
 		usingAsTypeInfo := constraint.UsingAsTypeInfo
 		if !ok {
-			warnings = append(warnings, fmt.Errorf("can't find variable %s at line %d", varName, constraint.Line))
+			v.typeError(constraint.Line, constraint.Range, "can't find variable %s", varName)
+			continue
+		}
+		if !scope.checkTypeResolved(v, varDeclareType, constraint.Line, constraint.Range) {
 			continue
 		}
 		varDeclareType = scope.resolve(varDeclareType)
 		usingAsTypeInfo = scope.resolve(usingAsTypeInfo)
 
-		if !IsTypeAssignable(usingAsTypeInfo, varDeclareType) {
-			warnings = append(warnings, fmt.Errorf("variable %s declared as %s but got %s at line %d",
-				varName, varDeclareType.String(), usingAsTypeInfo.String(), constraint.Line))
+		if !scope.isTypeAssignable(usingAsTypeInfo, varDeclareType) {
+			v.typeError(constraint.Line, constraint.Range, "variable %s declared as %s but got %s",
+				varName, varDeclareType.String(), usingAsTypeInfo.String())
 			continue
 		}
 	}
-	// 找出对变量重新赋值的语句，检查类型和是否const变量
+	// 找出对变量重新赋值的语句，检查类型和是否修改了let变量或者类型
 	for _, constraint := range scope.AssignConstraints {
 		varName := constraint.Name
+		if len(constraint.FieldName) > 0 {
+			// 可以修改let变量的成员，但是不能修改类型的成员
+			if constraint.IsTypeName {
+				v.typeError(constraint.Line, constraint.Range, "can't modify type %s", varName)
+			}
+			continue
+		}
+		if constraint.IsTypeName {
+			v.typeError(constraint.Line, constraint.Range, "can't assign to type %s", varName)
+			continue
+		}
+		if constraint.IsConst {
+			v.typeError(constraint.Line, constraint.Range, "can't assign to let variable %s", varName)
+			continue
+		}
+		if constraint.Global || constraint.ValueTypeInfo == nil {
+			continue
+		}
 		varDeclareType, _, _, ok := scope.get(varName)
 		usingAsTypeInfo := constraint.ValueTypeInfo
 		if !ok {
-			warnings = append(warnings, fmt.Errorf("can't find variable %s at line %d", varName, constraint.Line))
+			v.typeError(constraint.Line, constraint.Range, "can't find variable %s", varName)
 			continue
 		}
 		varDeclareType = scope.resolve(varDeclareType)
 		usingAsTypeInfo = scope.resolve(usingAsTypeInfo)
 
-		if !IsTypeAssignable(usingAsTypeInfo, varDeclareType) {
-			warnings = append(warnings, fmt.Errorf("variable %s declared as %s but got %s at line %d",
-				varName, varDeclareType.String(), usingAsTypeInfo.String(), constraint.Line))
+		if !scope.isTypeAssignable(usingAsTypeInfo, varDeclareType) {
+			v.typeError(constraint.Line, constraint.Range, "variable %s declared as %s but got %s",
+				varName, varDeclareType.String(), usingAsTypeInfo.String())
+			continue
+		}
+	}
+
+	for _, constraint := range scope.PropDefaultConstraints {
+		if !scope.checkTypeResolved(v, constraint.PropType, constraint.Line, constraint.Range) {
 			continue
 		}
+		propType := scope.resolve(constraint.PropType)
+		if !scope.isTypeAssignable(constraint.ValueTypeInfo, propType) {
+			v.typeError(constraint.Line, constraint.Range, "default value of %s.%s declared as %s but got %s",
+				constraint.RecordName, constraint.PropName, propType.String(), constraint.ValueTypeInfo.String())
+		}
 	}
 
+	scope.validateFields(v)
+	scope.validateCalls(v)
+	scope.validateReturns(v)
+
 	for _, child := range scope.Children {
-		subWarnings, subErrors := child.Validate()
-		warnings = append(warnings, subWarnings...)
-		errs = append(errs, subErrors...)
+		child.validate(v)
+	}
+}
+
+// 检查申明的类型中引用的类型名称是否存在，包括泛型参数、函数参数和返回值以及record属性的类型
+func (scope *TypeInfoScope) checkTypeResolved(v *typeValidator, typeInfo *TypeTreeItem, line int, sourceRange SourceRange) bool {
+	if name := scope.unresolvedTypeName(typeInfo, nil, make(map[*RecordTypeInfo]bool)); len(name) > 0 {
+		v.typeError(line, sourceRange, "can't resolve type %s", name)
+		return false
+	}
+	return true
+}
+
+// 类型中第一个找不到的类型名称，都能找到时返回空. genericNames是外层record申明的泛型参数名称
+func (scope *TypeInfoScope) unresolvedTypeName(typeInfo *TypeTreeItem, genericNames map[string]bool,
+	visited map[*RecordTypeInfo]bool) string {
+	if typeInfo == nil {
+		return ""
+	}
+	var items []*TypeTreeItem
+	switch typeInfo.ItemType {
+	case simpleNameType, simpleNameWithGenericTypesType:
+		if !genericNames[typeInfo.Name] {
+			if _, _, _, ok := scope.get(typeInfo.Name); !ok {
+				return typeInfo.Name
+			}
+		}
+		items = typeInfo.GenericTypeParams
+	case simpleUnionType:
+		items = typeInfo.UnionTypes
+	case simpleFuncType:
+		for _, param := range typeInfo.FuncTypeParams {
+			items = append(items, param.TypeInfo)
+		}
+		items = append(items, typeInfo.FuncReturnType)
+	case simpleRecordType:
+		if typeInfo.RecordType == nil || visited[typeInfo.RecordType] {
+			return ""
+		}
+		visited[typeInfo.RecordType] = true
+		if len(typeInfo.GenericTypeParams) > 0 {
+			recordGenericNames := make(map[string]bool)
+			for name := range genericNames {
+				recordGenericNames[name] = true
+			}
+			for _, param := range typeInfo.GenericTypeParams {
+				recordGenericNames[param.Name] = true
+			}
+			genericNames = recordGenericNames
+		}
+		for _, prop := range typeInfo.RecordType.Props {
+			items = append(items, prop.PropType)
+		}
+	}
+	for _, item := range items {
+		if name := scope.unresolvedTypeName(item, genericNames, visited); len(name) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// 检查record属性是否存在，以及给属性赋值的类型是否和属性类型兼容
+func (scope *TypeInfoScope) validateFields(v *typeValidator) {
+	for _, constraint := range scope.FieldConstraints {
+		objectType := scope.resolve(constraint.ObjectType)
+		if !objectType.IsRecordType() || objectType.RecordType == nil {
+			continue
+		}
+		propType, ok := objectType.RecordType.FindProp(constraint.FieldName)
+		if !ok {
+			// 赋值时属性不存在的错误在读取a.b时已经报告过
+			if constraint.ValueTypeInfo == nil {
+				v.typeError(constraint.Line, constraint.Range, "record %s has no prop %s",
+					objectType.RecordType.Name, constraint.FieldName)
+			}
+			continue
+		}
+		if constraint.ValueTypeInfo == nil {
+			continue
+		}
+		propType = scope.resolve(propType)
+		if propType.IsSimpleNameType() || propType.IsSimpleNameWithGenericTypesType() {
+			continue // 没有实例化的泛型参数
+		}
+		valueType := scope.resolve(constraint.ValueTypeInfo)
+		if !scope.isTypeAssignable(valueType, propType) {
+			v.typeError(constraint.Line, constraint.Range, "prop %s.%s declared as %s but got %s",
+				objectType.RecordType.Name, constraint.FieldName, propType.String(), valueType.String())
+		}
+	}
+}
+
+// 检查函数调用的参数个数和类型是否和函数签名匹配
+func (scope *TypeInfoScope) validateCalls(v *typeValidator) {
+	for _, constraint := range scope.CallConstraints {
+		funcType := scope.findCalleeType(constraint.FuncName, constraint.FieldName)
+		if funcType == nil {
+			continue
+		}
+		funcName := constraint.funcDisplayName()
+		params := funcType.FuncTypeParams
+		if constraint.IsMethodCall && len(params) > 0 {
+			params = params[1:]
+		}
+		scope.validateArgs(v, "function", funcName, params, constraint.Line, constraint.Range,
+			constraint.ArgTypes, constraint.ArgRanges, constraint.HasMultipleArgs)
+	}
+}
+
+// 检查函数调用或者emit的参数个数和类型是否和申明的参数匹配，kind是function或者event
+func (scope *TypeInfoScope) validateArgs(v *typeValidator, kind string, name string, params []*FuncTypeParamInfo,
+	line int, sourceRange SourceRange, argTypes []*TypeTreeItem, argRanges []SourceRange, hasMultipleArgs bool) {
+	fixedParams := make([]*FuncTypeParamInfo, 0, len(params))
+	isVarArg := false
+	for _, param := range params {
+		if param.IsDynamicParams {
+			isVarArg = true
+		} else {
+			fixedParams = append(fixedParams, param)
+		}
+	}
+	argCount := len(argTypes)
+	if argCount > len(fixedParams) && !isVarArg {
+		v.typeError(line, sourceRange, "%s %s expects %d arguments but got %d",
+			kind, name, len(fixedParams), argCount)
+	} else if argCount < len(fixedParams) && !hasMultipleArgs {
+		// 没有申明类型的参数可以不传
+		for _, param := range fixedParams[argCount:] {
+			if param.TypeInfo != nil && param.TypeInfo != objectTypeTreeItem {
+				v.typeError(line, sourceRange, "%s %s expects %d arguments but got %d",
+					kind, name, len(fixedParams), argCount)
+				break
+			}
+		}
+	}
+	for i, param := range fixedParams {
+		if i >= argCount {
+			break
+		}
+		if param.TypeInfo == nil || argTypes[i] == nil {
+			continue
+		}
+		if !scope.checkTypeResolved(v, param.TypeInfo, line, argRanges[i]) {
+			continue
+		}
+		paramType := scope.resolve(param.TypeInfo)
+		argType := scope.resolve(argTypes[i])
+		if !scope.isTypeAssignable(argType, paramType) {
+			v.typeError(line, argRanges[i], "argument %s of %s %s declared as %s but got %s",
+				param.Name, kind, name, paramType.String(), argType.String())
+		}
 	}
-	return
 }
 
+// 检查event申明的参数类型和各个emit语句的参数
+func (checker *TypeChecker) validateEvents(v *typeValidator) {
+	declaredNames := make(map[string]bool)
+	for _, declaration := range checker.EventDeclarations {
+		if declaredNames[declaration.Name] {
+			v.typeError(declaration.Line, declaration.Range, "event %s already declared", declaration.Name)
+			continue
+		}
+		declaredNames[declaration.Name] = true
+		for _, param := range declaration.Params {
+			checker.RootScope.checkTypeResolved(v, param.TypeInfo, declaration.Line, declaration.Range)
+		}
+	}
+	checker.validateEmits(v, checker.RootScope)
+}
+
+func (checker *TypeChecker) validateEmits(v *typeValidator, scope *TypeInfoScope) {
+	for _, constraint := range scope.EmitConstraints {
+		declaration, ok := checker.FindEventDeclaration(constraint.EventName)
+		if !ok {
+			v.typeError(constraint.Line, constraint.Range, "event %s is not declared", constraint.EventName)
+			continue
+		}
+		scope.validateArgs(v, "event", constraint.EventName, declaration.Params, constraint.Line, constraint.Range,
+			constraint.ArgTypes, constraint.ArgRanges, false)
+	}
+	for _, child := range scope.Children {
+		checker.validateEmits(v, child)
+	}
+}
+
+// 检查返回语句的值类型是否和函数申明的返回类型兼容
+func (scope *TypeInfoScope) validateReturns(v *typeValidator) {
+	if scope.FuncType == nil || scope.FuncType.FuncReturnType == nil {
+		return
+	}
+	declaredReturnType := scope.resolve(scope.FuncType.FuncReturnType)
+	for _, constraint := range scope.ReturnConstraints {
+		if !scope.checkTypeResolved(v, scope.FuncType.FuncReturnType, constraint.Line, constraint.Range) {
+			continue
+		}
+		if constraint.Missing {
+			if !scope.acceptsNil(declaredReturnType) {
+				v.typeError(constraint.Line, constraint.Range, "missing return value, declared as %s", declaredReturnType.String())
+			}
+			continue
+		}
+		if constraint.ValueTypeInfo == nil {
+			continue
+		}
+		valueType := scope.resolve(constraint.ValueTypeInfo)
+		if !scope.isTypeAssignable(valueType, declaredReturnType) {
+			v.typeError(constraint.Line, constraint.Range, "return value declared as %s but got %s",
+				declaredReturnType.String(), valueType.String())
+		}
+	}
+}
+
+// 申明的类型是否明确允许nil值，比如nil、object或者包含它们的联合类型.
+// isTypeAssignable总是允许赋值nil，不能用来检查缺少的返回值
+func (scope *TypeInfoScope) acceptsNil(declareType *TypeTreeItem) bool {
+	declareType = scope.resolve(declareType)
+	switch {
+	case declareType.ItemType == simpleNilType:
+		return true
+	case declareType.ItemType == simpleInnerType && declareType.Name == "object":
+		return true
+	case declareType.ItemType == simpleUnionType:
+		for _, item := range declareType.UnionTypes {
+			if scope.acceptsNil(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 验证类型信息，返回的警告和错误都是*Diagnostic，带有源码文件名和表达式范围.
+// Strict为true时类型错误放在errs中，调用方应该中止生成代码
 func (checker *TypeChecker) Validate() (warnings []error, errs []error) {
-	return checker.RootScope.Validate()
+	v := &typeValidator{strict: checker.Strict}
+	checker.RootScope.validate(v)
+	checker.validateEvents(v)
+	checker.validateContract(v)
+	warnings, errs = v.warnings, v.errs
+	for _, items := range [][]error{warnings, errs} {
+		for _, item := range items {
+			if d, ok := item.(*Diagnostic); ok && len(d.File) == 0 {
+				d.File = checker.SourceName
+			}
+		}
+	}
+	return
 }
@@ -0,0 +1,488 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// 编译并验证类型，返回类型检查的警告和错误信息
+func validateSource(t *testing.T, source string) (warnings []string, errs []string) {
+	_, typeChecker, _, err := Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warningItems, errItems := typeChecker.Validate()
+	for _, item := range warningItems {
+		warnings = append(warnings, item.Error())
+	}
+	for _, item := range errItems {
+		errs = append(errs, item.Error())
+	}
+	return
+}
+
+func checkMessages(t *testing.T, kind string, messages []string, expected []string) {
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d %s but got %d: %s", len(expected), kind, len(messages), strings.Join(messages, "\n"))
+	}
+	for i, message := range messages {
+		if !strings.HasSuffix(message, expected[i]) {
+			t.Errorf("expected %s %q but got %q", kind, expected[i], message)
+		}
+	}
+}
+
+func TestFunctionSignatureCheck(t *testing.T) {
+	source := `function f(a: int, b: string): string
+    if a > 1 then
+        return 1
+    end
+    return b
+end
+local function g(x: int, ...): int
+    return x
+end
+let s: string = f(1, "x")
+let n: int = f(2, "y")
+f(1)
+f(1, 2)
+f(1, "a", 3)
+g(1, 2, 3)
+g("s")
+type Contract<T> = {
+    storage: T
+}
+type Storage = { name: string }
+var M = Contract<Storage>()
+function M:setName(data: string)
+    self.storage.name = data
+end
+M:setName("a")
+M:setName(1)
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:11:14: warning: variable n declared as int but got string",
+		"test.lua:12:2: warning: function f expects 2 arguments but got 1",
+		"test.lua:13:6: warning: argument b of function f declared as string but got int",
+		"test.lua:14:2: warning: function f expects 2 arguments but got 3",
+		"test.lua:16:3: warning: argument x of function g declared as int but got string",
+		"test.lua:26:11: warning: argument data of function M:setName declared as string but got int",
+		"test.lua:3:16: warning: return value declared as string but got int",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestReturnValuesCheck(t *testing.T) {
+	source := `function f(a: int): string
+    if a > 1 then
+        return "a", 2
+    end
+    if a > 2 then
+        return
+    end
+    return "b"
+end
+function g(): string | nil
+    return
+end
+function h()
+    return
+end
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:3:21: warning: return value declared as string but got int",
+		"test.lua:6:9: warning: missing return value, declared as string",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestStrictTypeCheck(t *testing.T) {
+	source := `let a: int = 1
+a = 2
+var b: int = "b"
+var c: Unknown = 1
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:3:14: warning: variable b declared as int but got string",
+		"test.lua:4:18: warning: can't resolve type Unknown",
+		"test.lua:2:5: warning: can't assign to let variable a",
+	})
+	checkMessages(t, "errors", errs, nil)
+
+	_, typeChecker, _, err := Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeChecker.Strict = true
+	warningItems, errItems := typeChecker.Validate()
+	if len(warningItems) != 0 || len(errItems) != 3 {
+		t.Fatalf("expected 3 errors in strict mode but got %v %v", warningItems, errItems)
+	}
+	if !strings.HasSuffix(errItems[2].Error(), "test.lua:2:5: error: can't assign to let variable a") {
+		t.Errorf("unexpected error %s", errItems[2].Error())
+	}
+}
+
+func TestNestedTypeResolved(t *testing.T) {
+	source := `var a: Array<Foo> = []
+var m: Map<Array<Baz>> = {}
+var f: (x: Qux) => int = nil
+var g: (int) => Bar = nil
+type P = { f: Foo }
+var p = P()
+type Contract<T> = { storage: T }
+type S = { n: string }
+var c: Contract<S> = Contract<S>()
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:1:21: warning: can't resolve type Foo",
+		"test.lua:2:26: warning: can't resolve type Baz",
+		"test.lua:3:26: warning: can't resolve type Qux",
+		"test.lua:4:23: warning: can't resolve type Bar",
+		"test.lua:6:9: warning: can't resolve type Foo",
+	})
+	checkMessages(t, "errors", errs, nil)
+
+	_, typeChecker, _, err := Compile(strings.NewReader("var a: Array<Foo> = []\n"), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeChecker.Strict = true
+	_, errItems := typeChecker.Validate()
+	if len(errItems) != 1 || !strings.HasSuffix(errItems[0].Error(), "error: can't resolve type Foo") {
+		t.Errorf("expected unresolved generic param error in strict mode but got %v", errItems)
+	}
+}
+
+func TestLetImmutability(t *testing.T) {
+	source := `let b = 1
+b = 2
+local function f()
+    b = 3
+end
+let t = {}
+t.name = "t"
+function t.get()
+end
+type Person = { name: string }
+Person = 1
+Person.create = 1
+function Person.new()
+end
+int = 1
+string.x = 1
+function table()
+end
+var c = 1
+c = 2
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:2:5: warning: can't assign to let variable b",
+		"test.lua:11:10: warning: can't assign to type Person",
+		"test.lua:12:1: warning: can't modify type Person",
+		"test.lua:13:10: warning: can't modify type Person",
+		"test.lua:15:1: warning: can't assign to type int",
+		"test.lua:16:1: warning: can't modify type string",
+		"test.lua:17:10: warning: can't assign to type table",
+		"test.lua:4:9: warning: can't assign to let variable b",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestRecordPropDefaultValue(t *testing.T) {
+	source := `type State = {
+    name: string default "none",
+    age: int default -1,
+    score: number default 1.5,
+    active: bool default true,
+    count: int default "x"
+}
+type Box<T> = {
+    value: T default 0
+}
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:6:24: warning: default value of State.count declared as int but got string",
+	})
+	checkMessages(t, "errors", errs, nil)
+
+	_, typeChecker, _, err := Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateType, _, _, _ := typeChecker.RootScope.Lookup("State")
+	expected := []interface{}{"none", int64(-1), 1.5, true, "x"}
+	for i, prop := range stateType.RecordType.Props {
+		if prop.DefaultValue != expected[i] {
+			t.Errorf("expected default value %v of %s but got %v", expected[i], prop.PropName, prop.DefaultValue)
+		}
+	}
+
+	_, _, diagnostics, err := Compile(strings.NewReader("type A = { a: int default b }\n"), "test.lua")
+	if err == nil || len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, "record prop default value must be a literal") {
+		t.Errorf("expected syntax error of non-literal default value but got %v", diagnostics)
+	}
+}
+
+func TestRecordFieldCheck(t *testing.T) {
+	source := `type Person = {
+    name: string,
+    age: int
+}
+local c: Person = Person()
+c.name = 'x'
+c.nme = 'x'
+c.age = "18"
+let n: int = c.name
+local p = Person()
+function p.hello()
+end
+p.hello()
+p.unknown = 1
+print(p.age)
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:9:14: warning: variable n declared as int but got string",
+		"test.lua:7:1: warning: record Person has no prop nme",
+		"test.lua:8:9: warning: prop Person.age declared as int but got string",
+		"test.lua:14:1: warning: record Person has no prop unknown",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestGenericTypeSubstitution(t *testing.T) {
+	source := `type Person1<T1, T2> = {
+    name: string,
+    age: T1,
+    country: T2,
+    tags: Array<T2>,
+    format: (x: T1) => T2
+}
+type Person12<T> = Person1<int, T>
+type Person2 = Person12<string>
+type Pair<K, V> = {
+    key: K,
+    value: V
+}
+type Box<T> = {
+    pair: Pair<string, T>
+}
+local p: Person2 = Person2()
+let age: string = p.age
+let country: int = p.country
+local b: Box<int> = Box<int>()
+let v: string = b.pair.value
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:18:19: warning: variable age declared as string but got int",
+		"test.lua:19:20: warning: variable country declared as int but got string",
+		"test.lua:21:17: warning: variable v declared as string but got int",
+	})
+	checkMessages(t, "errors", errs, nil)
+
+	_, typeChecker, _, err := Compile(strings.NewReader(source), "test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := typeChecker.RootScope
+	person2, _, _, _ := scope.Lookup("Person2")
+	person2 = scope.Resolve(person2)
+	if !person2.IsRecordType() || len(person2.GenericTypeParams) != 0 {
+		t.Fatalf("unexpected resolved type %s", person2.String())
+	}
+	expected := map[string]string{
+		"age":     "int",
+		"country": "string",
+		"tags":    "<record Array<string>>",
+	}
+	for propName, typeName := range expected {
+		propType, ok := person2.RecordType.FindProp(propName)
+		if !ok || propType.String() != typeName {
+			t.Errorf("expected prop %s as %s but got %v", propName, typeName, propType)
+		}
+	}
+	format, _ := person2.RecordType.FindProp("format")
+	if format.FuncTypeParams[0].TypeInfo.String() != "int" || format.FuncReturnType.String() != "string" {
+		t.Errorf("unexpected prop format %s", format.String())
+	}
+	person1, _, _, _ := scope.Lookup("Person1")
+	if propType, _ := person1.RecordType.FindProp("age"); propType.String() != "T1" {
+		t.Errorf("generic record Person1 should not be modified but age is %s", propType.String())
+	}
+}
+
+func TestUnionAndLiteralTypes(t *testing.T) {
+	source := `type Gender = "Male" | "Female"
+type Maybe<T> = T | nil
+let g1: Gender = "Male"
+let g2: Gender = "Other"
+var id: int | string = 1
+id = "a"
+id = true
+let one: 1 = 1
+let two: 1 = 2
+local function show(x: int | string, m: Maybe<int>)
+    if type(x) == "string" then
+        let s: string = x
+        let n: int = x
+    end
+    let y: string = x
+    let z: string = m
+end
+type(g1)
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		`test.lua:4:18: warning: variable g2 declared as "Male" | "Female" but got string`,
+		`test.lua:9:14: warning: variable two declared as 1 but got int`,
+		`test.lua:7:6: warning: variable id declared as int | string but got bool`,
+		`test.lua:13:22: warning: variable n declared as int but got string`,
+		`test.lua:15:21: warning: variable y declared as string but got int | string`,
+		`test.lua:16:21: warning: variable z declared as string but got int | nil`,
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestUntypedVariableWidening(t *testing.T) {
+	source := `type Gender = "Male" | "Female"
+var x = "Male"
+x = "Other"
+let g: Gender = x
+local n = 1
+n = 2
+let one: 1 = n
+let m = "Male"
+let g2: Gender = m
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		`test.lua:4:17: warning: variable g declared as "Male" | "Female" but got string`,
+		`test.lua:7:14: warning: variable one declared as 1 but got int`,
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestFunctionTypeCheck(t *testing.T) {
+	source := `type Person = { name: string }
+type Handler = (p: Person, code: int) => string
+local function byName(p: Person): string
+    return p.name
+end
+local function byCode(p: Person, code: string): string
+    return code
+end
+local function needsMore(p: Person, code: int, extra: string): string
+    return extra
+end
+local function returnsInt(p: Person): int
+    return 1
+end
+local function anyArgs(...): string
+    return ""
+end
+let h1: Handler = byName
+let h2: Handler = byCode
+let h3: Handler = needsMore
+let h4: Handler = returnsInt
+let h5: Handler = anyArgs
+let h6: Handler = function(p, code) return "" end
+type Button = { onClick: (x: int) => nil }
+local b: Button = Button()
+b.onClick = function(x: string) end
+local function register(callback: (n: number) => string)
+end
+register(function(n: int): string return "" end)
+register(function(n: string): string return n end)
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:19:19: warning: variable h2 declared as <func Handler(p: Person, code: int): string> but got <func byCode(p: Person, code: string): string>",
+		"test.lua:20:19: warning: variable h3 declared as <func Handler(p: Person, code: int): string> but got <func needsMore(p: Person, code: int, extra: string): string>",
+		"test.lua:21:19: warning: variable h4 declared as <func Handler(p: Person, code: int): string> but got <func returnsInt(p: Person): int>",
+		"test.lua:26:13: warning: prop Button.onClick declared as <func (x: int): nil> but got <func (x: string)>",
+		"test.lua:30:10: warning: argument callback of function register declared as <func (n: number): string> but got <func (n: string): string>",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
+
+func TestContractLifecycleMethods(t *testing.T) {
+	source := `type Contract<T> = {
+    storage: T
+}
+type Storage = { name: string }
+var M = Contract<Storage>()
+offline function M:init()
+end
+function M:on_deposit(amount: string)
+end
+function M:on_deposit_asset(symbol: string)
+end
+function M:on_destroy(reason)
+end
+function M:on_upgrade()
+end
+return M
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, nil)
+	checkMessages(t, "errors", errs, []string{
+		"test.lua:6:18: error: contract method init can't be offline",
+		"test.lua:8:10: error: param amount of contract method on_deposit should accept int but declared as string",
+		"test.lua:10:10: error: contract method on_deposit_asset should have 2 params but got 1",
+		"test.lua:12:10: error: contract method on_destroy should have 0 params but got 1",
+	})
+
+	source = `type Person = { name: string }
+var M = Person()
+function M:init()
+end
+return M
+`
+	_, errs = validateSource(t, source)
+	checkMessages(t, "errors", errs, []string{
+		"test.lua:5:8: error: contract must be a Contract<T> record but got Person",
+	})
+
+	source = `type Contract<T> = {
+    storage: T
+}
+var M = Contract<int>()
+function M:init()
+end
+return M
+`
+	_, errs = validateSource(t, source)
+	checkMessages(t, "errors", errs, []string{
+		"test.lua:7:8: error: contract storage type int is not a record",
+	})
+}
+
+func TestEventDeclarations(t *testing.T) {
+	source := `event Transfer(from: string, to: string, amount: int)
+event Paused()
+local function transfer(from: string, to: string, amount: int)
+    emit Transfer(from, to, amount)
+    emit Transfer(from, to, "100")
+    emit Transfer(from, to)
+    emit Paused()
+    emit Unknown(from)
+end
+local event = 1
+event = 2
+`
+	warnings, errs := validateSource(t, source)
+	checkMessages(t, "warnings", warnings, []string{
+		"test.lua:5:29: warning: argument amount of event Transfer declared as int but got string",
+		"test.lua:6:18: warning: event Transfer expects 3 arguments but got 2",
+		"test.lua:8:17: warning: event Unknown is not declared",
+	})
+	checkMessages(t, "errors", errs, nil)
+}
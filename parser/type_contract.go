@@ -0,0 +1,102 @@
+package parser
+
+// 合约中由链调用的生命周期方法，参数个数和类型是固定的
+var lifecycleMethodNames = []string{"init", "on_deposit", "on_deposit_asset", "on_upgrade", "on_destroy"}
+
+var lifecycleMethodParams = map[string][]*TypeTreeItem{
+	"init":             {},
+	"on_deposit":       {intTypeTreeItem},
+	"on_deposit_asset": {stringTypeTreeItem, intTypeTreeItem},
+	"on_upgrade":       {},
+	"on_destroy":       {},
+}
+
+// 源码返回的是Contract类型的record或者有生命周期方法的record时当成合约检查:
+// 返回的record要是Contract<T>并且T是record，生命周期方法不能是offline，参数要和链调用时传入的一致
+func (checker *TypeChecker) validateContract(v *typeValidator) {
+	scope := checker.RootScope
+	// 最后一个有返回值的return语句返回的第一个值
+	var returnConstraint *ReturnConstraint
+	for _, constraint := range scope.ReturnConstraints {
+		if constraint.Index == 0 && !constraint.Missing {
+			returnConstraint = constraint
+		}
+	}
+	if returnConstraint == nil || returnConstraint.ValueTypeInfo == nil {
+		return
+	}
+	contractType := scope.resolve(returnConstraint.ValueTypeInfo)
+	if !contractType.IsRecordType() || contractType.RecordType == nil {
+		return
+	}
+	recordInfo := contractType.RecordType
+	isContract := recordInfo.Name == "Contract"
+	for _, name := range lifecycleMethodNames {
+		if propType, ok := recordInfo.FindProp(name); ok && propType.IsFuncType() {
+			isContract = true
+		}
+	}
+	if !isContract {
+		return
+	}
+	if recordInfo.Name != "Contract" {
+		v.error(returnConstraint.Line, returnConstraint.Range, "contract must be a Contract<T> record but got %s", recordInfo.Name)
+	} else if storageType, ok := recordInfo.FindProp("storage"); !ok || !scope.resolve(storageType).IsRecordType() {
+		storageTypeName := "nil"
+		if ok {
+			storageTypeName = storageType.String()
+		}
+		v.error(returnConstraint.Line, returnConstraint.Range, "contract storage type %s is not a record", storageTypeName)
+	}
+
+	for _, name := range lifecycleMethodNames {
+		var prop *RecordTypePropInfo
+		for _, p := range recordInfo.Props {
+			if p.PropName == name && p.PropType.IsFuncType() {
+				prop = p
+			}
+		}
+		if prop == nil {
+			continue
+		}
+		line, sourceRange := returnConstraint.Line, returnConstraint.Range
+		if constraint := scope.findFieldAssignConstraint(name); constraint != nil {
+			line, sourceRange = constraint.Line, constraint.Range
+		}
+		if prop.Offline {
+			v.error(line, sourceRange, "contract method %s can't be offline", name)
+		}
+		params := prop.PropType.FuncTypeParams
+		if len(params) > 0 && params[0].Name == "self" {
+			params = params[1:]
+		}
+		expectedParams := lifecycleMethodParams[name]
+		hasDynamicParams := false
+		for _, param := range params {
+			hasDynamicParams = hasDynamicParams || param.IsDynamicParams
+		}
+		if hasDynamicParams || len(params) != len(expectedParams) {
+			v.error(line, sourceRange, "contract method %s should have %d params but got %d", name, len(expectedParams), len(params))
+			continue
+		}
+		for i, param := range params {
+			if param.TypeInfo == nil || IsObjectType(param.TypeInfo) {
+				continue
+			}
+			if !scope.isTypeAssignable(expectedParams[i], param.TypeInfo) {
+				v.error(line, sourceRange, "param %s of contract method %s should accept %s but declared as %s",
+					param.Name, name, expectedParams[i].String(), param.TypeInfo.String())
+			}
+		}
+	}
+}
+
+// 最后一次给 a.fieldName 赋值(包括function a:fieldName())的约束
+func (scope *TypeInfoScope) findFieldAssignConstraint(fieldName string) (result *AssignConstraint) {
+	for _, constraint := range scope.AssignConstraints {
+		if constraint.FieldName == fieldName {
+			result = constraint
+		}
+	}
+	return
+}
@@ -10,15 +10,21 @@ import (
 func (checker *TypeChecker) deriveExprType(e exprDesc) (result *TypeTreeItem) {
 	switch e.kind {
 	case kindTrue:
-		return boolTypeTreeItem
+		return newLiteralValueType(true)
+	case kindFalse:
+		return newLiteralValueType(false)
 	case kindNil:
 		return nilTypeTreeItem
 	case kindConstant:
+		// 字符串字面量在parse时标注了带值的类型
+		if e.exprGuessType != nil {
+			return e.exprGuessType
+		}
 		return stringTypeTreeItem // 多种常量类型。目前这里都是字符串类型
 	case kindInt:
-		return intTypeTreeItem
+		return newLiteralValueType(e.intValue)
 	case kindNumber:
-		return numberTypeTreeItem
+		return newLiteralValueType(e.value)
 	case kindCall:
 		// 如果是调用的record类型的构造函数，类型是此record类型
 		if e.exprGuessType != nil {
@@ -29,6 +35,9 @@ func (checker *TypeChecker) deriveExprType(e exprDesc) (result *TypeTreeItem) {
 		if len(e.symbol) < 1 {
 			return notDerivedTypeTreeItem
 		}
+		if narrowed := checker.narrowedTypeOf(e.symbol); narrowed != nil {
+			return narrowed
+		}
 		resolved, _, _, ok := checker.CurrentProtoScope.get(e.symbol)
 		if ok {
 			return resolved
@@ -38,22 +47,63 @@ func (checker *TypeChecker) deriveExprType(e exprDesc) (result *TypeTreeItem) {
 		if len(e.symbol) < 1 {
 			return notDerivedTypeTreeItem
 		}
+		if narrowed := checker.narrowedTypeOf(e.symbol); narrowed != nil {
+			return narrowed
+		}
+		resolved, _, _, ok := checker.CurrentProtoScope.get(e.symbol)
+		if ok {
+			return resolved
+		}
+		return notDerivedTypeTreeItem
+	case kindIndexed:
+		// a.b在parse时根据a的record类型标注了类型
+		if e.exprGuessType != nil {
+			return e.exprGuessType
+		}
+		if len(e.symbol) < 1 || len(e.fieldName) > 0 {
+			return notDerivedTypeTreeItem
+		}
 		resolved, _, _, ok := checker.CurrentProtoScope.get(e.symbol)
 		if ok {
 			return resolved
 		}
 		return notDerivedTypeTreeItem
 	default:
+		// 函数表达式等在parse时标注了类型. 字面量参与运算后的结果不再是字面量
+		if e.exprGuessType != nil {
+			return e.exprGuessType.widen()
+		}
 		return notDerivedTypeTreeItem
 	}
 }
 
+// 展开类型中引用的类型名称的函数
+type typeResolver func(typeInfo *TypeTreeItem) *TypeTreeItem
+
+func noResolve(typeInfo *TypeTreeItem) *TypeTreeItem {
+	return typeInfo
+}
+
 // 判断valueType类型是否可以当成declareType用或者赋值给declareType类型
 func IsTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem) bool {
-	log.Printf("value: %s-%d, declare: %s-%d\n", valueType.Name, valueType.ItemType, declareType.Name, declareType.ItemType)
+	return isTypeAssignable(valueType, declareType, noResolve)
+}
+
+// 在作用域中判断类型是否兼容，函数类型等复合类型中引用的类型名称会在比较时展开
+func (scope *TypeInfoScope) isTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem) bool {
+	return isTypeAssignable(valueType, declareType, scope.resolve)
+}
+
+func isTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem, resolve typeResolver) bool {
 	if declareType == nil || valueType == nil {
 		return true
 	}
+	if valueType == declareType {
+		return true
+	}
+	valueType = resolve(valueType)
+	declareType = resolve(declareType)
+	log.Printf("value: %s-%d, declare: %s-%d\n", valueType.Name, valueType.ItemType, declareType.Name, declareType.ItemType)
 	if valueType.ItemType == simpleNotDerivedType {
 		return true
 	}
@@ -64,12 +114,50 @@ func IsTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem) bool {
 		return true
 	}
 
+	// 联合类型的值的每种可能类型都要能赋值给申明的类型
+	if valueType.ItemType == simpleUnionType {
+		for _, item := range valueType.UnionTypes {
+			if !isTypeAssignable(item, declareType, resolve) {
+				return false
+			}
+		}
+		return true
+	}
+	// 值能赋值给联合类型中的一种类型即可
+	if declareType.ItemType == simpleUnionType {
+		for _, item := range declareType.UnionTypes {
+			if isTypeAssignable(valueType, item, resolve) {
+				return true
+			}
+		}
+		return false
+	}
+	// 字面量类型只接受相同的字面量值
+	if declareType.ItemType == simpleLiteralType {
+		return valueType.LiteralValue != nil && literalValueEqual(valueType.LiteralValue, declareType.LiteralValue)
+	}
+	if valueType.ItemType == simpleLiteralType {
+		valueType = &TypeTreeItem{ItemType: simpleInnerType, Name: valueType.Name}
+	}
+
+	// 内置的function类型和函数签名类型互相兼容
+	if valueType.ItemType == simpleFuncType && declareType.ItemType == simpleInnerType && declareType.Name == "function" {
+		return true
+	}
+	if declareType.ItemType == simpleFuncType && valueType.ItemType == simpleInnerType && valueType.Name == "function" {
+		return true
+	}
+
 	// TODO: 提前准备类型的继承树，方便判断类型
 
 	if valueType.ItemType != declareType.ItemType {
 		return false
 	}
 
+	if valueType.ItemType == simpleFuncType {
+		return isFuncTypeAssignable(valueType, declareType, resolve)
+	}
+
 	if valueType.ItemType == simpleRecordType && declareType.ItemType == simpleRecordType {
 		return valueType.Name == declareType.Name
 	}
@@ -89,3 +177,73 @@ func IsTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem) bool {
 	// TODO
 	return true
 }
+
+// 比较两个字面量值，int和number的值按数值比较
+func literalValueEqual(a interface{}, b interface{}) bool {
+	toNumber := func(value interface{}) (float64, bool) {
+		switch v := value.(type) {
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+		return 0, false
+	}
+	if numberA, ok := toNumber(a); ok {
+		numberB, ok := toNumber(b)
+		return ok && numberA == numberB
+	}
+	return a == b
+}
+
+// 函数的固定参数和是否有...参数
+func splitFuncParams(funcType *TypeTreeItem) (fixedParams []*FuncTypeParamInfo, isVarArg bool) {
+	for _, param := range funcType.FuncTypeParams {
+		if param.IsDynamicParams {
+			isVarArg = true
+		} else {
+			fixedParams = append(fixedParams, param)
+		}
+	}
+	return
+}
+
+// 没有申明类型的参数可以接受任何类型
+func isUntypedParam(param *FuncTypeParamInfo) bool {
+	return param.TypeInfo == nil || param.TypeInfo == objectTypeTreeItem ||
+		(param.TypeInfo.ItemType == simpleInnerType && param.TypeInfo.Name == "object")
+}
+
+// 函数值valueType能否当成申明的函数类型declareType使用. 参数类型是逆变的，返回值类型是协变的
+func isFuncTypeAssignable(valueType *TypeTreeItem, declareType *TypeTreeItem, resolve typeResolver) bool {
+	valueParams, valueIsVarArg := splitFuncParams(valueType)
+	declareParams, declareIsVarArg := splitFuncParams(declareType)
+	for i, declareParam := range declareParams {
+		if i >= len(valueParams) {
+			if !valueIsVarArg {
+				break // 多传的参数会被函数忽略
+			}
+			continue
+		}
+		valueParam := valueParams[i]
+		if isUntypedParam(valueParam) || isUntypedParam(declareParam) {
+			continue
+		}
+		// 调用方按申明的类型传参，函数要能接受申明的参数类型
+		if !isTypeAssignable(declareParam.TypeInfo, valueParam.TypeInfo, resolve) {
+			return false
+		}
+	}
+	if len(valueParams) > len(declareParams) && !declareIsVarArg {
+		// 调用方不会传的参数，函数要求是有类型的参数时不兼容
+		for _, param := range valueParams[len(declareParams):] {
+			if !isUntypedParam(param) {
+				return false
+			}
+		}
+	}
+	if valueType.FuncReturnType == nil || declareType.FuncReturnType == nil {
+		return true
+	}
+	return isTypeAssignable(valueType.FuncReturnType, declareType.FuncReturnType, resolve)
+}
@@ -5,6 +5,7 @@ package parser
 type TypeInfoConstraint struct {
 	Name            string        // 变量名称
 	Line            int           // 使用地方所在的代码行
+	Range           SourceRange   // 被约束的表达式在源码中的范围
 	UsingAsTypeInfo *TypeTreeItem // name被当成什么类型来使用。要求name的实际类型能和这个类型兼容，也就是需要name的类型是usingAsTypeInfo的子类型或者本身
 }
 
@@ -13,15 +14,90 @@ type VariableType int
 const (
 	VAR_VARIABLE   VariableType = iota // 可变类型变量
 	CONST_VARIABLE                     // 不可变类型变量
+	LOCAL_VARIABLE                     // local申明的变量，和var一样可变
+	PARAM_VARIABLE                     // 函数参数，可变
 )
 
 // 修改变量的语句的约束
 type AssignConstraint struct {
 	Name          string        // 变量名称
+	FieldName     string        // 给a.b赋值时的b，这时只检查a是否是类型名称
+	Global        bool          // 是否给全局变量赋值，全局变量不检查是否申明过和值的类型
+	IsConst       bool          // 赋值时变量是否是let变量或者类型名称，在赋值的时候确定，避免被后面的同名申明覆盖
+	IsTypeName    bool          // 赋值时变量是否是类型名称
 	Line          int           // 所在代码行
+	Range         SourceRange   // 赋值右侧表达式在源码中的范围
 	ValueTypeInfo *TypeTreeItem // 新的值的类型
 }
 
+// 函数调用的约束，参数个数和类型要和函数签名匹配
+type CallConstraint struct {
+	FuncName        string          // 被调用的函数名称，a.b(...)或者a:b(...)时是a
+	FieldName       string          // a.b(...)或者a:b(...)时的b
+	IsMethodCall    bool            // 是否a:b(...)的调用，这时函数签名的第一个参数self不需要传
+	Line            int             // 所在代码行
+	Range           SourceRange     // 调用表达式在源码中的范围
+	ArgTypes        []*TypeTreeItem // 各个参数的类型
+	ArgRanges       []SourceRange   // 各个参数在源码中的范围
+	HasMultipleArgs bool            // 最后一个参数是函数调用或者...，实际参数个数不确定
+}
+
+func (constraint *CallConstraint) funcDisplayName() string {
+	switch {
+	case len(constraint.FieldName) < 1:
+		return constraint.FuncName
+	case constraint.IsMethodCall:
+		return constraint.FuncName + ":" + constraint.FieldName
+	default:
+		return constraint.FuncName + "." + constraint.FieldName
+	}
+}
+
+// 返回语句的约束，返回值类型要和函数申明的返回类型兼容
+type ReturnConstraint struct {
+	Line          int           // 所在代码行
+	Range         SourceRange   // 返回的表达式在源码中的范围，没有返回值时是return的范围
+	ValueTypeInfo *TypeTreeItem // 返回的值的类型
+	Index         int           // 第几个返回值，从0开始
+	Missing       bool          // 没有返回值的return语句
+}
+
+// record属性访问的约束，属性要在record类型中存在，赋值时值的类型要和属性的类型兼容
+type FieldConstraint struct {
+	ObjectType    *TypeTreeItem // a.b中a的类型
+	FieldName     string        // a.b中的b
+	Line          int           // 所在代码行
+	Range         SourceRange   // 读取时是a.b表达式的范围，赋值时是右侧表达式的范围
+	ValueTypeInfo *TypeTreeItem // 赋值时新的值的类型，读取时为空
+}
+
+// record属性默认值的约束，默认值类型要和属性申明的类型兼容
+type PropDefaultConstraint struct {
+	RecordName    string        // record类型名称
+	PropName      string        // 属性名称
+	PropType      *TypeTreeItem // 属性申明的类型
+	Line          int           // 所在代码行
+	Range         SourceRange   // 默认值在源码中的范围
+	ValueTypeInfo *TypeTreeItem // 默认值的类型
+}
+
+// event Name(params) 申明的event参数
+type EventDeclaration struct {
+	Name   string
+	Params []*FuncTypeParamInfo
+	Line   int         // 所在代码行
+	Range  SourceRange // event名称在源码中的范围
+}
+
+// emit Name(args) 的约束，参数个数和类型要和event申明匹配
+type EmitConstraint struct {
+	EventName string
+	Line      int             // 所在代码行
+	Range     SourceRange     // emit的参数在源码中的范围
+	ArgTypes  []*TypeTreeItem // 各个参数的类型
+	ArgRanges []SourceRange   // 各个参数在源码中的范围
+}
+
 // 类型信息作用域
 type TypeInfoScope struct {
 	StartLine         int
@@ -33,6 +109,12 @@ type TypeInfoScope struct {
 	Constraints       []*TypeInfoConstraint    `json:"Constraints,omitempty"`       // 本词法作用域中的类型约束
 	AssignConstraints []*AssignConstraint      `json:"AssignConstraints,omitempty"` // 本词法作用域中的变量赋值的约束
 	ReturnTypes []*TypeTreeItem // 所有返回语句返回的表达式类型
+	FuncType          *TypeTreeItem            `json:"FuncType,omitempty"`          // 作用域对应的函数的签名类型，根作用域时为空
+	CallConstraints   []*CallConstraint        `json:"CallConstraints,omitempty"`   // 本词法作用域中的函数调用的约束
+	ReturnConstraints []*ReturnConstraint      `json:"ReturnConstraints,omitempty"` // 本词法作用域中的返回语句的约束
+	PropDefaultConstraints []*PropDefaultConstraint `json:"PropDefaultConstraints,omitempty"` // 本词法作用域中定义的record属性默认值的约束
+	FieldConstraints       []*FieldConstraint       `json:"FieldConstraints,omitempty"`       // 本词法作用域中的record属性访问的约束
+	EmitConstraints        []*EmitConstraint        `json:"EmitConstraints,omitempty"`        // 本词法作用域中的emit语句的约束
 
 	Children []*TypeInfoScope `json:"Children,omitempty"` // 子作用域
 	Parent   *TypeInfoScope   `json:"-"`                  // 上级作用域
@@ -72,6 +154,19 @@ func (scope *TypeInfoScope) get(name string) (result *TypeTreeItem, line int, va
 	return
 }
 
+// name是否是内置类型、record类型或者类型重命名的名称
+func (scope *TypeInfoScope) isTypeName(name string) bool {
+	item, _, varType, ok := scope.get(name)
+	if !ok || item == nil || varType != CONST_VARIABLE || item.Name != name {
+		return false
+	}
+	switch item.ItemType {
+	case simpleInnerType, simpleRecordType, simpleAliasType, simpleUnionType, simpleFuncType:
+		return true
+	}
+	return false
+}
+
 // 如果类型信息还没展开(比如是名称，或者是typedef的类型)，则展开这种类型
 func (scope *TypeInfoScope) resolve(typeInfo *TypeTreeItem) (result *TypeTreeItem) {
 	result = typeInfo
@@ -89,21 +184,187 @@ func (scope *TypeInfoScope) resolve(typeInfo *TypeTreeItem) (result *TypeTreeIte
 	}
 	// typedef等类型的展开，比如P<T1, T2> 展开
 	if typeInfo.ItemType == simpleAliasType {
-		// TODO: 如果有泛型参数，给alias target type的泛型实例参数增加新项
-		resolved, _, _, ok := scope.get(typeInfo.AliasTypeName)
-		if !ok {
+		target, _, _, ok := scope.get(typeInfo.AliasTypeName)
+		if !ok || target == typeInfo {
 			return
 		}
-		result = resolved
-		if result == typeInfo {
+		result = scope.applyGenericTypeParams(scope.resolve(target), typeInfo.AliasTypeParams)
+		// type P12<T> = P1<int, T> 中的T是展开后类型的泛型参数
+		if len(typeInfo.GenericTypeParams) > 0 && result != target {
+			genericResult := new(TypeTreeItem)
+			*genericResult = *result
+			genericResult.GenericTypeParams = append(append([]*TypeTreeItem{}, typeInfo.GenericTypeParams...), result.GenericTypeParams...)
+			result = genericResult
+		}
+		return
+	}
+	// 联合类型展开每一种类型
+	if typeInfo.ItemType == simpleUnionType {
+		var unionTypes []*TypeTreeItem
+		for i, item := range typeInfo.UnionTypes {
+			resolved := scope.resolve(item)
+			if resolved != item && unionTypes == nil {
+				unionTypes = append([]*TypeTreeItem{}, typeInfo.UnionTypes[:i]...)
+			}
+			if unionTypes != nil {
+				unionTypes = append(unionTypes, resolved)
+			}
+		}
+		if unionTypes != nil {
+			result = new(TypeTreeItem)
+			*result = *typeInfo
+			result.UnionTypes = unionTypes
+		}
+		return
+	}
+	// P<T1, T2> 展开成实例化后的类型
+	if typeInfo.ItemType == simpleNameWithGenericTypesType {
+		base, _, _, ok := scope.get(typeInfo.Name)
+		if !ok {
 			return
 		}
-		result = scope.resolve(result)
+		result = scope.applyGenericTypeParams(scope.resolve(base), typeInfo.GenericTypeParams)
 		return
 	}
 	return
 }
 
+// 用泛型参数实例化展开后的类型. record类型替换属性中的泛型参数，Array<T>这类内置类型记录泛型参数
+func (scope *TypeInfoScope) applyGenericTypeParams(typeInfo *TypeTreeItem, genericTypeParams []*TypeTreeItem) *TypeTreeItem {
+	if len(genericTypeParams) < 1 {
+		return typeInfo
+	}
+	switch typeInfo.ItemType {
+	case simpleRecordType:
+		result, err := typeInfo.ApplyRecordGenericTypeParams(genericTypeParams)
+		if err != nil {
+			return typeInfo
+		}
+		return result
+	case simpleInnerType:
+		result := new(TypeTreeItem)
+		*result = *typeInfo
+		result.GenericTypeParams = genericTypeParams
+		return result
+	case simpleUnionType:
+		// type Maybe<T> = T | nil 用泛型参数替换每一种类型
+		b := newBinding(nil)
+		for i := 0; i < len(typeInfo.GenericTypeParams) && i < len(genericTypeParams); i++ {
+			b.bind(typeInfo.GenericTypeParams[i].Name, genericTypeParams[i])
+		}
+		unionTypes, err := applyBindingToItems(typeInfo.UnionTypes, b)
+		if err != nil {
+			return typeInfo
+		}
+		result := new(TypeTreeItem)
+		*result = *typeInfo
+		result.GenericTypeParams = nil
+		result.UnionTypes = unionTypes
+		return scope.resolve(result)
+	}
+	return typeInfo
+}
+
 func (scope *TypeInfoScope) addReturnType(returnType *TypeTreeItem) {
 	scope.ReturnTypes = append(scope.ReturnTypes, returnType)
 }
+
+// objectType是record类型时查找它的属性fieldName的类型，找不到时返回nil
+func (scope *TypeInfoScope) findPropType(objectType *TypeTreeItem, fieldName string) *TypeTreeItem {
+	if objectType == nil || len(fieldName) < 1 {
+		return nil
+	}
+	objectType = scope.resolve(objectType)
+	if !objectType.IsRecordType() || objectType.RecordType == nil {
+		return nil
+	}
+	propType, ok := objectType.RecordType.FindProp(fieldName)
+	if !ok {
+		return nil
+	}
+	return propType
+}
+
+// 查找被调用的函数name或者name.fieldName的函数签名类型，不是函数类型时返回nil
+func (scope *TypeInfoScope) findCalleeType(name string, fieldName string) *TypeTreeItem {
+	if len(name) < 1 {
+		return nil
+	}
+	calleeType, _, _, ok := scope.get(name)
+	if !ok || calleeType == nil {
+		return nil
+	}
+	calleeType = scope.resolve(calleeType)
+	if len(fieldName) > 0 {
+		if !calleeType.IsRecordType() || calleeType.RecordType == nil {
+			return nil
+		}
+		calleeType, ok = calleeType.RecordType.FindProp(fieldName)
+		if !ok || calleeType == nil {
+			return nil
+		}
+		calleeType = scope.resolve(calleeType)
+	}
+	if !calleeType.IsFuncType() {
+		return nil
+	}
+	return calleeType
+}
+
+// 查找name对应的类型信息，找不到时到上级作用域查找. line是变量申明时所在的代码行
+func (scope *TypeInfoScope) Lookup(name string) (result *TypeTreeItem, line int, varType VariableType, ok bool) {
+	return scope.get(name)
+}
+
+// 展开名称和typedef类型，得到实际的类型
+func (scope *TypeInfoScope) Resolve(typeInfo *TypeTreeItem) *TypeTreeItem {
+	return scope.resolve(typeInfo)
+}
+
+// 找到包含line这一行的最内层作用域
+func (scope *TypeInfoScope) FindScopeAtLine(line int) *TypeInfoScope {
+	for _, child := range scope.Children {
+		if child.StartLine <= line && line <= child.EndLine {
+			return child.FindScopeAtLine(line)
+		}
+	}
+	return scope
+}
+
+// 找到签名类型是funcType的函数作用域，找不到时返回nil
+func (scope *TypeInfoScope) FindFuncScope(funcType *TypeTreeItem) *TypeInfoScope {
+	if scope.FuncType == funcType {
+		return scope
+	}
+	for _, child := range scope.Children {
+		if result := child.FindFuncScope(funcType); result != nil {
+			return result
+		}
+	}
+	return nil
+}
+
+// 从函数中所有return语句推导出的返回类型，多种类型时是联合类型.
+// 有推导不出类型的返回值时是object，没有return语句时返回nil
+func (scope *TypeInfoScope) DerivedReturnType() *TypeTreeItem {
+	var returnTypes []*TypeTreeItem
+	var typeNames []string
+	for _, returnType := range scope.ReturnTypes {
+		if returnType == nil || returnType.IsNotDerivedType() {
+			return objectTypeTreeItem
+		}
+		returnType = returnType.widen()
+		if !ContainsString(typeNames, returnType.String()) {
+			typeNames = append(typeNames, returnType.String())
+			returnTypes = append(returnTypes, returnType)
+		}
+	}
+	switch len(returnTypes) {
+	case 0:
+		return nil
+	case 1:
+		return returnTypes[0]
+	default:
+		return &TypeTreeItem{ItemType: simpleUnionType, UnionTypes: returnTypes}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 type value interface{}
@@ -14,19 +16,40 @@ type pc int
 
 var none value = &struct{}{}
 
+// asm字符串中换行、回车、制表符写成\n、\r、\t，';'和其他控制字符写成\xHH，避免断行或被当成注释
 func escapeString(v string)(result string){
 	buf := bytes.NewBuffer([]byte{})
 	c := byte(0)
 	for i:=0;i<len(v);i++{
 		c = v[i]
-		if(c=='"' || c=='\\' || c=='\n'|| c=='\t'|| c=='\a'|| c=='\b'|| c=='\f'|| c=='\r'|| c=='\v') {
+		switch {
+		case c=='"' || c=='\\':
 			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c=='\n':
+			buf.WriteString("\\n")
+		case c=='\r':
+			buf.WriteString("\\r")
+		case c=='\t':
+			buf.WriteString("\\t")
+		case c==';' || c<0x20 || c==0x7f:
+			buf.WriteString(fmt.Sprintf("\\x%02x", c))
+		default:
+			buf.WriteByte(c)
 		}
-		buf.WriteByte(c)
 	}
 	return string(buf.Bytes())
 }
 
+// 浮点数总是带小数点或指数，汇编器据此区分浮点数和整数
+func floatLiteral(v float64) string {
+	result := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(result, ".e") {
+		result += ".0"
+	}
+	return result
+}
+
 func literalValueString(v value) (result string, ok bool) {
 	switch v := v.(type) {
 	case string:
@@ -34,7 +57,7 @@ func literalValueString(v value) (result string, ok bool) {
 	case int64:
 		return fmt.Sprintf("%d", v), true
 	case float64:
-		return fmt.Sprintf("%f", v), true
+		return floatLiteral(v), true
 	case nil:
 		return "nil", true
 	case bool:
@@ -1,18 +1,19 @@
 package parser
 
 import (
-	"log"
+	"errors"
 	"os"
 )
 
+// 断言失败和语法错误都通过panic抛出，由Compile统一recover成Diagnostic，不会退出进程
 func lua_assert(cond bool) {
 	if !cond {
-		log.Fatal("assertion failure")
+		panic(errors.New("assertion failure"))
 	}
 }
 
-func lua_throw_error(err error, msg string) {
-	log.Fatalf(err.Error()+": %s\n", msg)
+func lua_throw_error(d *Diagnostic) {
+	panic(d)
 }
 
 func CheckFileExists(filepath string) (bool, error) {